@@ -0,0 +1,142 @@
+// Command mercury exports and imports mercury namespaces over the HTTP api.
+//
+//	mercury export -url http://localhost:8060 -session ID -space 'svc.staging.*' -format tar -o staging.tar.gz
+//	mercury import -url http://localhost:8060 -session ID -f staging.tar.gz -rewrite 'svc.staging.*:svc.prod.*' -mode merge
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mercury export|import [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = importDump(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mercury:", err)
+		os.Exit(1)
+	}
+}
+
+type client struct {
+	url     string
+	session string
+}
+
+func (c *client) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.url, "url", "http://localhost:8060", "api base url")
+	fs.StringVar(&c.session, "session", os.Getenv("MERCURY_SESSION"), "session id, defaults to $MERCURY_SESSION")
+}
+
+func (c *client) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.session != "" {
+		req.Header.Set("Authorization", "session "+c.session)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return res, nil
+}
+
+func export(args []string) error {
+	var c client
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	c.flags(fs)
+	space := fs.String("space", "", "namespace to export. eg. svc.staging.*")
+	format := fs.String("format", "json", "archive format json or tar")
+	out := fs.String("o", "-", "output file")
+	fs.Parse(args)
+
+	if *space == "" {
+		return fmt.Errorf("export: -space is required")
+	}
+
+	res, err := c.do("GET", "/v1/mercury-export", url.Values{"space": {*space}, "format": {*format}}, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func importDump(args []string) error {
+	var c client
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	c.flags(fs)
+	file := fs.String("f", "-", "input file")
+	rewrite := fs.String("rewrite", "", "rewrite a space prefix. eg. svc.staging.*:svc.prod.*")
+	mode := fs.String("mode", "merge", "merge or replace existing spaces")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	query := url.Values{"mode": {*mode}}
+	if *rewrite != "" {
+		query.Set("rewrite", *rewrite)
+	}
+
+	res, err := c.do("POST", "/v1/mercury-import", query, r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
@@ -0,0 +1,82 @@
+package dbm
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// AssetFS reads migrations from go-bindata style asset funcs. Migrate
+// used to take these funcs and now takes an fs.FS, so older callers wrap
+// them:
+//
+//	dbm.Migrate(dbm.AssetFS{File: Asset, Dir: AssetDir})
+type AssetFS struct {
+	File func(string) ([]byte, error)
+	Dir  func(string) ([]string, error)
+}
+
+var _ fs.ReadDirFS = AssetFS{}
+var _ fs.ReadFileFS = AssetFS{}
+
+// Open implements fs.FS
+func (a AssetFS) Open(name string) (fs.File, error) {
+	b, err := a.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &assetFile{assetInfo{path.Base(name), int64(len(b))}, bytes.NewReader(b)}, nil
+}
+
+// ReadFile implements fs.ReadFileFS
+func (a AssetFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	b, err := a.File(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return b, nil
+}
+
+// ReadDir implements fs.ReadDirFS
+// The entries are all reported as files.
+func (a AssetFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	names, err := a.Dir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Strings(names)
+
+	lis := make([]fs.DirEntry, len(names))
+	for i, n := range names {
+		lis[i] = fs.FileInfoToDirEntry(assetInfo{name: n})
+	}
+	return lis, nil
+}
+
+type assetFile struct {
+	info assetInfo
+	*bytes.Reader
+}
+
+func (f *assetFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *assetFile) Close() error               { return nil }
+
+type assetInfo struct {
+	name string
+	size int64
+}
+
+func (i assetInfo) Name() string       { return i.name }
+func (i assetInfo) Size() int64        { return i.size }
+func (i assetInfo) Mode() fs.FileMode  { return 0444 }
+func (i assetInfo) ModTime() time.Time { return time.Time{} }
+func (i assetInfo) IsDir() bool        { return false }
+func (i assetInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,187 @@
+package dbm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"sour.is/x/toolbox/log"
+)
+
+var (
+	// BulkParams are the most bind parameters in a statement for each dialect.
+	BulkParams = map[string]int{"postgres": 65535, "sqlite": 999, "mysql": 65535}
+	// BulkBatch is the most rows written in a batch.
+	BulkBatch = 1000
+	// BulkCopy uses COPY FROM STDIN for bulk inserts with the lib/pq driver.
+	BulkCopy = true
+)
+
+// BulkProgress is called after each batch with the rows written so far.
+type BulkProgress func(done, total int)
+
+type bulkProgressKey struct{}
+
+// WithBulkProgress reports the progress of bulk inserts of transactions
+// started with the context.
+func WithBulkProgress(ctx context.Context, fn BulkProgress) context.Context {
+	return context.WithValue(ctx, bulkProgressKey{}, fn)
+}
+
+// BulkInsert writes rows, structs or pointers to structs described by d,
+// into the table of d. Rows are written in batches of multi row VALUES
+// that keep under the parameter limit of the dialect, or with COPY on
+// Postgres. All rows must be of the same type. AUTO columns are left to the
+// database unless the rows set them, which must be all rows or none.
+func (tx *Tx) BulkInsert(d DbInfo, rows []interface{}) (n int, err error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	lis := make([]reflect.Value, len(rows))
+	for i, row := range rows {
+		v := reflect.Indirect(reflect.ValueOf(row))
+		if v.Kind() != reflect.Struct {
+			return 0, fmt.Errorf("DBM: bulk insert row %d is %T not a struct", i, row)
+		}
+		if i > 0 && v.Type() != lis[0].Type() {
+			return 0, fmt.Errorf("DBM: bulk insert row %d is %s not %s", i, v.Type(), lis[0].Type())
+		}
+		lis[i] = v
+	}
+
+	var fields, cols []string
+	for i, field := range d.SCols {
+		if _, ok := lis[0].Type().FieldByName(field); !ok {
+			return 0, fmt.Errorf("DBM: bulk insert row type %s has no field %s for %s", lis[0].Type(), field, d.Table)
+		}
+		if hasString(d.Auto, field) {
+			switch set := countSet(lis, field); {
+			case set == 0:
+				continue
+			case set < len(lis):
+				return 0, fmt.Errorf("DBM: bulk insert into %s sets AUTO field %s in %d of %d rows", d.Table, field, set, len(lis))
+			}
+		}
+		fields = append(fields, field)
+		cols = append(cols, d.Cols[i])
+	}
+
+	values := func(v reflect.Value) []interface{} {
+		vals := make([]interface{}, len(fields))
+		for i, field := range fields {
+			vals[i] = v.FieldByName(field).Interface()
+		}
+		return vals
+	}
+
+	if len(cols) == 0 {
+		return 0, fmt.Errorf("DBM: bulk insert into %s has no columns", d.Table)
+	}
+
+	progress, _ := tx.Context.Value(bulkProgressKey{}).(BulkProgress)
+	report := func(done int) {
+		log.Debugf("DBM: Bulk insert %d of %d rows into %s", done, len(rows), d.Table)
+		if progress != nil {
+			progress(done, len(rows))
+		}
+	}
+
+	if BulkCopy && tx.dialect() == "postgres" {
+		return tx.bulkCopy(d.Table, cols, lis, values, report)
+	}
+
+	size := BulkBatch
+	limit, ok := BulkParams[tx.dialect()]
+	if !ok {
+		limit = BulkParams["sqlite"]
+	}
+	if max := limit / len(cols); max < size {
+		size = max
+	}
+
+	for start := 0; start < len(lis); start += size {
+		end := start + size
+		if end > len(lis) {
+			end = len(lis)
+		}
+
+		insert := tx.Insert(d.Table).Columns(cols...)
+		for _, v := range lis[start:end] {
+			insert = insert.Values(values(v)...)
+		}
+		if _, err = insert.ExecContext(tx.Context); err != nil {
+			return n, err
+		}
+
+		n = end
+		report(n)
+	}
+
+	return n, nil
+}
+
+// bulkCopy writes the rows with COPY FROM STDIN. The lib/pq driver sends
+// rows of the prepared statement with each Exec and ends it on an empty
+// Exec.
+func (tx *Tx) bulkCopy(table string, cols []string, lis []reflect.Value, values func(reflect.Value) []interface{}, report func(int)) (n int, err error) {
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoteIdent(col)
+	}
+	var parts []string
+	for _, part := range strings.Split(table, ".") {
+		parts = append(parts, quoteIdent(part))
+	}
+	copySQL := "COPY " + strings.Join(parts, ".") + " (" + strings.Join(quoted, ", ") + ") FROM STDIN"
+	log.Debugs("BulkInsert", "sql", copySQL)
+
+	stmt, err := tx.PrepareContext(tx.Context, copySQL)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i, v := range lis {
+		if _, err = stmt.ExecContext(tx.Context, values(v)...); err != nil {
+			return n, err
+		}
+		if (i+1)%BulkBatch == 0 {
+			n = i + 1
+			report(n)
+		}
+	}
+	if _, err = stmt.ExecContext(tx.Context); err != nil {
+		return n, err
+	}
+
+	if n != len(lis) {
+		n = len(lis)
+		report(n)
+	}
+	return n, nil
+}
+
+// dialect returns the SQL dialect of the transaction.
+func (tx *Tx) dialect() string {
+	return DB{DbType: tx.DbType}.Dialect()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// countSet returns the number of rows where the field is not the zero value.
+func countSet(lis []reflect.Value, field string) (n int) {
+	for _, v := range lis {
+		if !isZero(v.FieldByName(field)) {
+			n++
+		}
+	}
+	return
+}
+
+func isZero(f reflect.Value) bool {
+	return reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface())
+}
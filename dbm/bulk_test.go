@@ -0,0 +1,134 @@
+package dbm
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBulkInsert(t *testing.T) {
+	d := GetDbInfo(repoItem{})
+
+	rows := func(n int, ids bool) []interface{} {
+		lis := make([]interface{}, n)
+		for i := range lis {
+			o := repoItem{Name: fmt.Sprint("item", i), Qty: i}
+			if ids {
+				o.ID = int64(i + 100)
+			}
+			lis[i] = &o
+		}
+		return lis
+	}
+
+	Convey("Given a sqlite database", t, func() {
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+
+		_, err := db.Conn.Exec("CREATE TABLE item (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, qty INTEGER)")
+		So(err, ShouldBeNil)
+
+		var done []int
+		ctx := WithBulkProgress(context.Background(), func(n, total int) {
+			So(total, ShouldEqual, 1200)
+			done = append(done, n)
+		})
+
+		insert := func(lis []interface{}) (n int, err error) {
+			err = db.TransactionContext(ctx, func(tx *Tx) (err error) {
+				n, err = tx.BulkInsert(d, lis)
+				return
+			})
+			return
+		}
+		count := func() (n, max int) {
+			db.Conn.QueryRow("SELECT count(1), max(id) FROM item").Scan(&n, &max)
+			return
+		}
+
+		Convey("rows are written in batches under the parameter limit", func() {
+			n, err := insert(rows(1200, false))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1200)
+
+			// 999 params over 2 columns is 499 rows a batch.
+			So(done, ShouldResemble, []int{499, 998, 1200})
+
+			rows, max := count()
+			So(rows, ShouldEqual, 1200)
+			So(max, ShouldEqual, 1200)
+		})
+
+		Convey("AUTO columns that are set are written", func() {
+			n, err := insert(rows(1200, true))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1200)
+			So(done, ShouldResemble, []int{333, 666, 999, 1200})
+
+			_, max := count()
+			So(max, ShouldEqual, 1299)
+		})
+
+		Convey("rows that are not structs are refused", func() {
+			_, err := insert([]interface{}{1})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("rows of another type are refused", func() {
+			_, err := insert([]interface{}{&repoItem{Name: "one"}, &struct{ Name string }{"two"}})
+			So(err, ShouldNotBeNil)
+
+			_, err = insert([]interface{}{&struct{ Name string }{"two"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("AUTO columns must be set in all rows or none", func() {
+			lis := rows(3, false)
+			lis[1].(*repoItem).ID = 7
+			_, err := insert(lis)
+			So(err, ShouldNotBeNil)
+
+			n, _ := count()
+			So(n, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a postgres database", t, func() {
+		conn, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		db := DB{Conn: conn, DbType: "postgres", Placeholder: sq.Dollar, Returns: true}
+
+		Convey("rows are written with COPY", func() {
+			old := BulkBatch
+			BulkBatch = 2
+			defer func() { BulkBatch = old }()
+
+			mock.ExpectBegin()
+			copyIn := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "item" ("name", "qty") FROM STDIN`))
+			for i := 0; i < 3; i++ {
+				copyIn.ExpectExec().WithArgs(fmt.Sprint("item", i), i).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			copyIn.ExpectExec().WithArgs().WillReturnResult(driver.RowsAffected(3))
+			mock.ExpectCommit()
+
+			var done []int
+			ctx := WithBulkProgress(context.Background(), func(n, total int) { done = append(done, n) })
+
+			err := db.TransactionContext(ctx, func(tx *Tx) error {
+				_, err := tx.BulkInsert(d, rows(3, false))
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(done, ShouldResemble, []int{2, 3})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
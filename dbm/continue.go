@@ -0,0 +1,275 @@
+package dbm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/uuid"
+)
+
+var (
+	// TxIdleTimeout is how long a continued transaction may go unused
+	// before it is rolled back.
+	TxIdleTimeout = 5 * time.Minute
+	// TxMaxLifetime is how long a continued transaction may stay open.
+	TxMaxLifetime = 30 * time.Minute
+
+	txReapInterval = 30 * time.Second
+)
+
+var (
+	// ErrTxNotFound is returned for a TxID that is not open.
+	ErrTxNotFound = errors.New("DBM: transaction not found")
+	// ErrTxExpired is returned for a TxID that passed a timeout.
+	ErrTxExpired = errors.New("DBM: transaction expired")
+)
+
+// txSession is an open continued transaction.
+type txSession struct {
+	sync.Mutex
+	tx      *Tx
+	db      string
+	started time.Time
+	used    int64
+}
+
+func (s *txSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.used)))
+}
+
+func (s *txSession) expired(now time.Time) bool {
+	return s.idle(now) > TxIdleTimeout || now.Sub(s.started) > TxMaxLifetime
+}
+
+var txSessions struct {
+	sync.Mutex
+	lis     map[string]*txSession
+	expired uint64
+	reaper  sync.Once
+}
+
+// TxInfo describes an open continued transaction.
+type TxInfo struct {
+	ID   string        `json:"id"`
+	Name string        `json:"name"`
+	Age  time.Duration `json:"age"`
+	Idle time.Duration `json:"idle"`
+}
+
+// TransactionContinue returns a transaction that can be continued by suppling the
+// TxID that gets passed into the txFunc.
+func TransactionContinue(TxID string, txFunc func(*Tx, string) error) (err error) {
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.TransactionContinue(TxID, txFunc)
+}
+
+// TransactionContinue returns a transaction that can be continued by suppling the
+// TxID that gets passed into the txFunc. An empty TxID starts a new one.
+//
+// The transaction stays open until it is ended with CommitTx or RollbackTx, or
+// it passes TxIdleTimeout or TxMaxLifetime. If txFunc fails it is rolled back.
+func (db DB) TransactionContinue(TxID string, txFunc func(*Tx, string) error) (err error) {
+	var s *txSession
+
+	if TxID == "" {
+		tx, err := db.NewTx(context.Background(), false)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+
+		TxID = uuid.V4()
+		s = &txSession{tx: tx, db: db.Name, started: time.Now()}
+		s.Lock()
+		txPut(TxID, s)
+	} else {
+		if s, err = txTake(TxID); err != nil {
+			return err
+		}
+	}
+	defer s.Unlock()
+	atomic.StoreInt64(&s.used, time.Now().UnixNano())
+
+	defer func() {
+		if p := recover(); p != nil {
+			switch p := p.(type) {
+			case error:
+				err = p
+			default:
+				err = fmt.Errorf("%s", p)
+			}
+		}
+
+		if err != nil {
+			txRm(TxID)
+			s.tx.Rollback()
+			log.Error(err.Error())
+
+			debug.PrintStack()
+		}
+	}()
+
+	err = txFunc(s.tx, TxID)
+	return err
+}
+
+// CommitTx commits and ends the continued transaction.
+func CommitTx(TxID string) error {
+	s, err := txTake(TxID)
+	if err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	txRm(TxID)
+	return s.tx.Commit()
+}
+
+// RollbackTx rolls back and ends the continued transaction.
+func RollbackTx(TxID string) error {
+	s, err := txTake(TxID)
+	if err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	txRm(TxID)
+	return s.tx.Rollback()
+}
+
+// OpenTx returns the open continued transactions, oldest first.
+func OpenTx() []TxInfo {
+	now := time.Now()
+
+	txSessions.Lock()
+	defer txSessions.Unlock()
+
+	lis := make([]TxInfo, 0, len(txSessions.lis))
+	for id, s := range txSessions.lis {
+		lis = append(lis, TxInfo{ID: id, Name: s.db, Age: now.Sub(s.started), Idle: s.idle(now)})
+	}
+	sort.Slice(lis, func(i, j int) bool { return lis[i].Age > lis[j].Age })
+
+	return lis
+}
+
+// ExpiredTx returns the count of continued transactions that timed out.
+func ExpiredTx() uint64 {
+	return atomic.LoadUint64(&txSessions.expired)
+}
+
+func txPut(id string, s *txSession) {
+	txSessions.Lock()
+	defer txSessions.Unlock()
+
+	if txSessions.lis == nil {
+		txSessions.lis = make(map[string]*txSession)
+	}
+	txSessions.lis[id] = s
+
+	txSessions.reaper.Do(func() { go txReaper(txReapInterval) })
+}
+
+// txTake returns the session locked for use. An expired one is rolled back.
+func txTake(id string) (*txSession, error) {
+	txSessions.Lock()
+	s, ok := txSessions.lis[id]
+	txSessions.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTxNotFound, id)
+	}
+
+	s.Lock()
+	if _, ok := txGet(id); !ok {
+		// Ended while waiting for the lock.
+		s.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTxNotFound, id)
+	}
+	if s.expired(time.Now()) {
+		txExpire(id, s)
+		s.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTxExpired, id)
+	}
+
+	return s, nil
+}
+
+func txGet(id string) (*txSession, bool) {
+	txSessions.Lock()
+	defer txSessions.Unlock()
+
+	s, ok := txSessions.lis[id]
+	return s, ok
+}
+
+func txRm(id string) {
+	txSessions.Lock()
+	defer txSessions.Unlock()
+
+	delete(txSessions.lis, id)
+}
+
+// txExpire rolls back a session the caller holds locked.
+func txExpire(id string, s *txSession) {
+	txRm(id)
+	atomic.AddUint64(&txSessions.expired, 1)
+	if err := s.tx.Rollback(); err != nil {
+		log.Warning("DBM: Rollback expired tx ", id, ": ", err)
+	}
+	log.Notice("DBM: Expired tx ", id)
+}
+
+// txReap rolls back the expired sessions that are not in use.
+func txReap(now time.Time) {
+	txSessions.Lock()
+	lis := make(map[string]*txSession, len(txSessions.lis))
+	for id, s := range txSessions.lis {
+		lis[id] = s
+	}
+	txSessions.Unlock()
+
+	for id, s := range lis {
+		if !s.TryLock() {
+			continue
+		}
+		if _, ok := txGet(id); ok && s.expired(now) {
+			txExpire(id, s)
+		}
+		s.Unlock()
+	}
+}
+
+// txReaper reaps expired sessions every interval. On shutdown all open
+// sessions are rolled back.
+func txReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	httpsrv.WaitShutdown.Add(1)
+	defer httpsrv.WaitShutdown.Done()
+
+	for {
+		select {
+		case <-ticker.C:
+			txReap(time.Now())
+
+		case <-httpsrv.SignalShutdown:
+			log.Debug("DBM: Shutting Down Tx Reaper")
+			for _, t := range OpenTx() {
+				RollbackTx(t.ID)
+			}
+			return
+		}
+	}
+}
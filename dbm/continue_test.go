@@ -0,0 +1,95 @@
+package dbm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransactionContinue(t *testing.T) {
+	Convey("Given a database", t, func() {
+		db := newSqliteDB(t)
+		db.Name = "test"
+		defer db.Conn.Close()
+
+		_, err := db.Conn.Exec("CREATE TABLE item (id INTEGER)")
+		So(err, ShouldBeNil)
+
+		count := func() (n int) {
+			db.Conn.QueryRow("SELECT count(1) FROM item").Scan(&n)
+			return
+		}
+		insert := func(id string) (txID string, err error) {
+			err = db.TransactionContinue(id, func(tx *Tx, id string) error {
+				txID = id
+				_, err := tx.Exec("INSERT INTO item VALUES (1)")
+				return err
+			})
+			return
+		}
+
+		Convey("a continued transaction stays open until committed", func() {
+			id, err := insert("")
+			So(err, ShouldBeNil)
+			So(OpenTx(), ShouldHaveLength, 1)
+			So(OpenTx()[0].Name, ShouldEqual, "test")
+
+			_, err = insert(id)
+			So(err, ShouldBeNil)
+
+			So(CommitTx(id), ShouldBeNil)
+			So(OpenTx(), ShouldBeEmpty)
+			So(count(), ShouldEqual, 2)
+
+			_, err = insert(id)
+			So(errors.Is(err, ErrTxNotFound), ShouldBeTrue)
+			So(errors.Is(CommitTx(id), ErrTxNotFound), ShouldBeTrue)
+		})
+
+		Convey("it can be rolled back", func() {
+			id, err := insert("")
+			So(err, ShouldBeNil)
+
+			So(RollbackTx(id), ShouldBeNil)
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("a failed step rolls it back", func() {
+			id, err := insert("")
+			So(err, ShouldBeNil)
+
+			err = db.TransactionContinue(id, func(tx *Tx, id string) error {
+				return errors.New("fail")
+			})
+			So(err, ShouldNotBeNil)
+			So(OpenTx(), ShouldBeEmpty)
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("idle and old transactions expire", func() {
+			oldIdle, oldMax := TxIdleTimeout, TxMaxLifetime
+			defer func() { TxIdleTimeout, TxMaxLifetime = oldIdle, oldMax }()
+			expired := ExpiredTx()
+
+			TxIdleTimeout = time.Millisecond
+			id, err := insert("")
+			So(err, ShouldBeNil)
+			time.Sleep(5 * time.Millisecond)
+
+			_, err = insert(id)
+			So(errors.Is(err, ErrTxExpired), ShouldBeTrue)
+			So(OpenTx(), ShouldBeEmpty)
+			So(count(), ShouldEqual, 0)
+
+			TxIdleTimeout, TxMaxLifetime = time.Hour, time.Millisecond
+			_, err = insert("")
+			So(err, ShouldBeNil)
+
+			txReap(time.Now().Add(time.Second))
+			So(OpenTx(), ShouldBeEmpty)
+			So(ExpiredTx(), ShouldEqual, expired+2)
+		})
+	})
+}
@@ -14,9 +14,14 @@ import (
 */
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/spf13/viper"
 	"sour.is/x/toolbox/log"
@@ -28,80 +33,376 @@ import (
 
 // DB database connection and settings
 type DB struct {
+	Name             string
 	Conn             *sql.DB
 	DbType           string
 	Placeholder      sq.PlaceholderFormat
 	Returns          bool
 	TxOptionsDisable bool
+	// Retry is the policy for transactions that fail with a retryable error.
+	Retry RetryPolicy
+
+	primary   *pool
+	replicas  *replicaSet
+	stopCheck context.CancelFunc
+}
+
+// Defaults for the pool settings of GetDB.
+const (
+	DefaultMaxConn        = 5
+	DefaultMaxIdle        = 3
+	DefaultMaxLifetime    = 25 * time.Minute
+	DefaultConnectRetries = 5
+	DefaultConnectBackoff = time.Second
+	MaxConnectBackoff     = 30 * time.Second
+)
+
+// PoolConfig are the settings of a connection pool.
+type PoolConfig struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+	MaxIdleTime time.Duration
+}
+
+// GetPoolConfig reads the pool settings under pfx. Durations may be given
+// as a number of minutes or as a duration like "90s".
+func GetPoolConfig(pfx string) PoolConfig {
+	c := PoolConfig{
+		MaxOpen:     viper.GetInt(pfx + ".max_conn"),
+		MaxIdle:     DefaultMaxIdle,
+		MaxLifetime: getDuration(pfx+".max_lifetime", time.Minute),
+		MaxIdleTime: getDuration(pfx+".max_idle_time", time.Minute),
+	}
+	if c.MaxOpen == 0 {
+		c.MaxOpen = DefaultMaxConn
+	}
+	if viper.IsSet(pfx + ".max_idle") {
+		c.MaxIdle = viper.GetInt(pfx + ".max_idle")
+	}
+	if c.MaxLifetime == 0 {
+		c.MaxLifetime = DefaultMaxLifetime
+	}
+	return c
 }
 
-// GetDB returns a database connection.
+// Apply sets up the pool of conn.
+func (c PoolConfig) Apply(conn *sql.DB) {
+	conn.SetMaxOpenConns(c.MaxOpen)
+	conn.SetMaxIdleConns(c.MaxIdle)
+	conn.SetConnMaxLifetime(c.MaxLifetime)
+	conn.SetConnMaxIdleTime(c.MaxIdleTime)
+}
+
+// getDuration reads a duration setting. Plain numbers are in unit.
+func getDuration(key string, unit time.Duration) time.Duration {
+	s := viper.GetString(key)
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * unit
+	}
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+// GetDB returns a database connection. The settings under pfx are:
+//
+//	type, connect          driver and connect string (required)
+//	max_conn, max_idle     open and idle connections in the pool
+//	max_lifetime           lifetime of a connection
+//	max_idle_time          time a connection may stay idle
+//	connect_retries        tries to connect at startup before failing
+//	connect_backoff        wait before the first retry, doubled each try
+//	health_check           how often the pools are pinged
+//	replicas               connect strings of read only replicas
+//	tx_options_disable     do not pass read only options to the driver
+//	retry_attempts         most times a transaction is run (see RetryPolicy)
+//	retry_backoff          wait before the first retry, doubled each retry
+//	retry_max_backoff      longest wait between retries
 func GetDB(pfx string) (db DB, err error) {
 
 	dbType := viper.GetString(pfx + ".type")
 	connect := viper.GetString(pfx + ".connect")
-	maxConn := viper.GetInt(pfx + ".max_conn")
-	maxLifetime := viper.GetInt(pfx + ".max_lifetime")
 	txOptionsDisable := viper.GetBool(pfx + ".tx_options_disable")
+	replicas := viper.GetStringSlice(pfx + ".replicas")
+	healthCheck := getDuration(pfx+".health_check", time.Second)
 
 	if dbType == "" {
-		log.Fatal("Database Type is not set!")
+		return db, fmt.Errorf("DBM: %s.type is not set", pfx)
 	}
 	if connect == "" {
-		log.Fatal("Database Connect is not set!")
+		return db, fmt.Errorf("DBM: %s.connect is not set", pfx)
+	}
+
+	retries := DefaultConnectRetries
+	if viper.IsSet(pfx + ".connect_retries") {
+		retries = viper.GetInt(pfx + ".connect_retries")
+	}
+	backoff := getDuration(pfx+".connect_backoff", time.Second)
+	if backoff <= 0 {
+		backoff = DefaultConnectBackoff
 	}
 
 	var conn *sql.DB
 	if conn, err = sql.Open(dbType, connect); err != nil {
-		log.Error(err)
 		return
 	}
 
-	if maxConn != 0 {
-		conn.SetMaxOpenConns(maxConn)
-	}
-
-	if maxLifetime == 0 {
-		maxLifetime = 5
-	}
-	conn.SetMaxOpenConns(5)
-	conn.SetMaxIdleConns(3)
-	conn.SetConnMaxLifetime(25 * time.Minute)
+	pc := GetPoolConfig(pfx)
+	pc.Apply(conn)
 
-	if err = conn.Ping(); err != nil {
-		log.Error(err)
+	if err = connectRetry(conn, MaskConnect(connect), retries, backoff); err != nil {
+		conn.Close()
 		return
 	}
 
+	db.Name = strings.TrimPrefix(pfx, "db.")
 	db.Conn = conn
 	db.DbType = dbType
 	db.Placeholder = sq.Question
 	db.TxOptionsDisable = txOptionsDisable
+	db.Retry = GetRetryPolicy(pfx)
 	if strings.Contains(db.DbType, "postgres") {
 		db.Placeholder = sq.Dollar
 		db.Returns = true
 	}
 
-	connect = regexp.MustCompile(`:.*@`).ReplaceAllString(connect, ":****@")
-	connect = regexp.MustCompile(`password=.[[:graph:]]+`).ReplaceAllString(connect, "password=****")
+	log.Notice("DBM: Database Connected: ", MaskConnect(connect))
 
-	log.Notice("DBM: Database Connected: ", connect)
+	db.primary = &pool{conn: conn, connect: MaskConnect(connect), healthy: 1}
+	db.replicas = openReplicas(dbType, replicas, pc.Apply)
+
+	if healthCheck <= 0 {
+		healthCheck = DefaultHealthCheck
+	}
+	db.startHealthCheck(healthCheck)
 
 	return
 }
 
-var stdDB DB
+// connectRetry pings conn until it answers, waiting twice as long after
+// each failure up to MaxConnectBackoff.
+func connectRetry(conn *sql.DB, name string, retries int, backoff time.Duration) (err error) {
+	for i := 0; ; i++ {
+		if err = conn.Ping(); err == nil {
+			return nil
+		}
+		if i >= retries {
+			return fmt.Errorf("DBM: connect %s: %w", name, err)
+		}
+
+		log.Warning("DBM: Connect ", name, " failed, retry in ", backoff, ": ", err)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > MaxConnectBackoff {
+			backoff = MaxConnectBackoff
+		}
+	}
+}
 
-// Config read configuration from viper
+// Dialect returns the SQL dialect of the database type. It is one of
+// Dialects or the type when it is not known.
+func (db DB) Dialect() string {
+	for _, d := range Dialects {
+		if strings.Contains(db.DbType, d) {
+			return d
+		}
+	}
+	return db.DbType
+}
+
+var registry struct {
+	sync.RWMutex
+	dbs  map[string]DB
+	name string
+}
+
+// Config connects the default database named by the database setting from
+// its db.<name> settings and exits if it fails. Use Connect to handle the
+// error instead.
 func Config() {
-	if viper.IsSet("database") {
-		pfx := "db." + viper.GetString("database")
+	if err := Connect(); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// Connect connects the default database named by the database setting from
+// its db.<name> settings. Other databases in db.* are connected when first
+// requested with Get.
+func Connect() error {
+	if !viper.IsSet("database") {
+		return nil
+	}
+	name := viper.GetString("database")
+
+	db, err := GetDB("db." + name)
+	if err != nil {
+		return err
+	}
+
+	Register(name, db)
+	registry.Lock()
+	registry.name = name
+	registry.Unlock()
+
+	return nil
+}
+
+// Register adds a database by name. The first one added is the default
+// until Config or SetDefault selects another.
+func Register(name string, db DB) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.dbs == nil {
+		registry.dbs = make(map[string]DB)
+	}
+	registry.dbs[name] = db
+	if registry.name == "" {
+		registry.name = name
+	}
+}
 
-		var err error
+// SetDefault selects the default database. It is connected if needed.
+func SetDefault(name string) error {
+	if _, err := Get(name); err != nil {
+		return err
+	}
+
+	registry.Lock()
+	registry.name = name
+	registry.Unlock()
+	return nil
+}
 
-		stdDB, err = GetDB(pfx)
-		if err != nil {
-			log.Fatal(err.Error())
+// Get returns the named database. A database that is not registered but
+// has db.<name> settings is connected and registered. Concurrent callers
+// share a single connect and the registry is not locked while connecting.
+func Get(name string) (DB, error) {
+	registry.RLock()
+	db, ok := registry.dbs[name]
+	registry.RUnlock()
+	if ok {
+		return db, nil
+	}
+
+	pfx := "db." + name
+	if !viper.IsSet(pfx + ".type") {
+		return db, fmt.Errorf("DBM: database %q is not configured", name)
+	}
+
+	connecting.Lock()
+	if c, ok := connecting.calls[name]; ok {
+		connecting.Unlock()
+		c.wg.Wait()
+		return c.db, c.err
+	}
+
+	// Another caller may have connected it before the lock was taken.
+	registry.RLock()
+	db, ok = registry.dbs[name]
+	registry.RUnlock()
+	if ok {
+		connecting.Unlock()
+		return db, nil
+	}
+
+	if connecting.calls == nil {
+		connecting.calls = make(map[string]*connectCall)
+	}
+	c := new(connectCall)
+	c.wg.Add(1)
+	connecting.calls[name] = c
+	connecting.Unlock()
+
+	c.db, c.err = GetDB(pfx)
+	if c.err == nil {
+		registry.Lock()
+		if registry.dbs == nil {
+			registry.dbs = make(map[string]DB)
 		}
+		registry.dbs[name] = c.db
+		registry.Unlock()
+	}
+
+	// Removed after the database is registered so later callers find it there.
+	connecting.Lock()
+	delete(connecting.calls, name)
+	connecting.Unlock()
+	c.wg.Done()
+
+	return c.db, c.err
+}
+
+// connecting holds the connects in progress by name.
+var connecting struct {
+	sync.Mutex
+	calls map[string]*connectCall
+}
+
+type connectCall struct {
+	wg  sync.WaitGroup
+	db  DB
+	err error
+}
+
+// ErrNoDefault is returned by the package level helpers when no database is
+// registered as the default.
+var ErrNoDefault = errors.New("DBM: no default database")
+
+// Default returns the default database. It is the zero DB if none is
+// registered.
+func Default() DB {
+	db, _ := getDefault()
+	return db
+}
+
+func getDefault() (DB, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	db, ok := registry.dbs[registry.name]
+	if !ok {
+		return db, ErrNoDefault
 	}
+	return db, nil
+}
+
+type contextKey struct {
+	name string
+}
+
+func (c *contextKey) String() string {
+	return "dbm context key " + c.name
+}
+
+// DBKey is the context key for the name of the database to use.
+var DBKey = contextKey{"dbm.DB"}
+
+// WithDB selects the named database for the package level helpers that are
+// passed the returned context.
+func WithDB(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, DBKey, name)
+}
+
+// FromContext returns the database selected with WithDB or the default.
+func FromContext(ctx context.Context) (DB, error) {
+	if name, ok := ctx.Value(DBKey).(string); ok {
+		return Get(name)
+	}
+	return getDefault()
+}
+
+var (
+	connectUserPass = regexp.MustCompile(`:.*@`)
+	connectPassword = regexp.MustCompile(`password=.[[:graph:]]+`)
+)
+
+// MaskConnect hides the password in a database connect string.
+func MaskConnect(connect string) string {
+	connect = connectUserPass.ReplaceAllString(connect, ":****@")
+	connect = connectPassword.ReplaceAllString(connect, "password=****")
+	return connect
 }
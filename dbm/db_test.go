@@ -3,6 +3,7 @@ package dbm // import "sour.is/x/toolbox/dbm"
 import (
 	"bytes"
 	"context"
+	"sync"
 	"testing"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
@@ -64,3 +65,84 @@ func TestConfig(t *testing.T) {
 
 	})
 }
+
+func TestRegistry(t *testing.T) {
+	Convey("Given named databases", t, func() {
+		one, two := newSqliteDB(t), newSqliteDB(t)
+		defer one.Conn.Close()
+		defer two.Conn.Close()
+
+		_, err := two.Conn.Exec("CREATE TABLE only_two (id INTEGER)")
+		So(err, ShouldBeNil)
+
+		old := registry.dbs
+		oldName := registry.name
+		registry.dbs, registry.name = nil, ""
+		Reset(func() { registry.dbs, registry.name = old, oldName })
+
+		Register("one", one)
+		Register("two", two)
+
+		Convey("the first is the default", func() {
+			So(Default(), ShouldResemble, one)
+			So(Ping(), ShouldBeTrue)
+
+			So(SetDefault("two"), ShouldBeNil)
+			So(Default(), ShouldResemble, two)
+		})
+
+		Convey("the context selects the database", func() {
+			count := func(ctx context.Context) error {
+				return QueryContext(ctx, func(tx *Tx) error {
+					_, err := tx.Count("only_two", nil)
+					return err
+				})
+			}
+
+			So(count(context.Background()), ShouldNotBeNil)
+			So(count(WithDB(context.Background(), "two")), ShouldBeNil)
+		})
+
+		Convey("configured databases are connected once", func() {
+			viper.Set("db.three.type", "sqlite3")
+			viper.Set("db.three.connect", ":memory:")
+			Reset(func() { viper.Set("db.three.type", nil) })
+
+			var wg sync.WaitGroup
+			lis := make([]DB, 4)
+			for i := range lis {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					lis[i], _ = Get("three")
+				}(i)
+			}
+			wg.Wait()
+
+			So(lis[0].Conn, ShouldNotBeNil)
+			for _, db := range lis {
+				So(db.Conn, ShouldEqual, lis[0].Conn)
+			}
+			So(registry.dbs, ShouldContainKey, "three")
+		})
+
+		Convey("unknown databases fail", func() {
+			_, err := Get("missing")
+			So(err, ShouldNotBeNil)
+			So(SetDefault("missing"), ShouldNotBeNil)
+
+			_, err = NewTx(WithDB(context.Background(), "missing"), true)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("without a default the helpers fail", func() {
+			registry.dbs, registry.name = nil, ""
+
+			_, err := FromContext(context.Background())
+			So(err, ShouldEqual, ErrNoDefault)
+			So(Transaction(func(*Tx) error { return nil }), ShouldEqual, ErrNoDefault)
+			So(TransactionContinue("", func(*Tx, string) error { return nil }), ShouldEqual, ErrNoDefault)
+			So(Ping(), ShouldBeFalse)
+		})
+	})
+}
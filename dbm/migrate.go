@@ -1,21 +1,171 @@
 package dbm
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/spf13/viper"
 	"sour.is/x/toolbox/log"
 )
 
-type asset struct {
-	File func(string) ([]byte, error)
-	Dir  func(string) ([]string, error)
+// Dialects that migration files can be written for.
+var Dialects = []string{"postgres", "sqlite", "mysql"}
+
+// Migration is a schema version read from the files in the schema dir.
+// Files are named NNNN-name.sql or NNNN-name.up.sql for the change and
+// NNNN-name.down.sql to undo it. A dialect before the direction, as in
+// NNNN-name.postgres.sql or NNNN-name.sqlite.down.sql, limits a file to
+// that dialect and is used instead of the plain file.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus is a migration and if it is applied. Drift is set when the
+// file was changed after it was applied.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedOn time.Time
+	Drift     bool
+}
+
+// MigrationStep runs a migration up or, when Revert is set, down.
+type MigrationStep struct {
+	Migration
+	Revert bool
+}
+
+// SQL returns the statements the step runs.
+func (s MigrationStep) SQL() string {
+	if s.Revert {
+		return s.Down
+	}
+	return s.Up
+}
+
+func (s MigrationStep) String() string {
+	dir := "up"
+	if s.Revert {
+		dir = "down"
+	}
+	return fmt.Sprintf("%s %04d-%s", dir, s.Version, s.Name)
 }
 
-// Migrate runs SQL DDL to update tables.
-func Migrate(a asset) (err error) {
+// Checksum returns the checksum recorded for the SQL of a migration.
+func Checksum(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadMigrations reads the migrations for dialect in the schema dir of fsys
+// in version order.
+func LoadMigrations(fsys fs.FS, dialect string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "schema")
+	if err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		name     string
+		specific bool
+	}
+	type key struct {
+		version int
+		down    bool
+	}
+
+	names := make(map[int]string)
+	files := make(map[key]file)
+	for _, e := range entries {
+		parts := strings.SplitN(e.Name(), "-", 2)
+		if e.IsDir() || len(parts) != 2 || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		v, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+
+		name, down := strings.TrimSuffix(parts[1], ".sql"), false
+		if strings.HasSuffix(name, ".down") {
+			name, down = strings.TrimSuffix(name, ".down"), true
+		}
+		name = strings.TrimSuffix(name, ".up")
+
+		var fileDialect string
+		for _, d := range Dialects {
+			if strings.HasSuffix(name, "."+d) {
+				name, fileDialect = strings.TrimSuffix(name, "."+d), d
+			}
+		}
+		if fileDialect != "" && fileDialect != dialect {
+			continue
+		}
+
+		if n, ok := names[v]; ok && n != name {
+			return nil, fmt.Errorf("DBM: migration %04d has files for %s and %s", v, n, name)
+		}
+		names[v] = name
+
+		k := key{v, down}
+		if f, ok := files[k]; ok {
+			if f.specific == (fileDialect != "") {
+				return nil, fmt.Errorf("DBM: migration %04d-%s has more than one file for %s", v, name, e.Name())
+			}
+			if f.specific {
+				continue
+			}
+		}
+		files[k] = file{name: e.Name(), specific: fileDialect != ""}
+	}
+
+	lis := make([]Migration, 0, len(names))
+	for v, name := range names {
+		m := Migration{Version: v, Name: name}
+
+		up, ok := files[key{v, false}]
+		if !ok {
+			return nil, fmt.Errorf("DBM: migration %04d-%s has no up file", v, name)
+		}
+		b, err := fs.ReadFile(fsys, path.Join("schema", up.name))
+		if err != nil {
+			return nil, err
+		}
+		m.Up, m.Checksum = string(b), Checksum(string(b))
+
+		if down, ok := files[key{v, true}]; ok {
+			if b, err = fs.ReadFile(fsys, path.Join("schema", down.name)); err != nil {
+				return nil, err
+			}
+			m.Down = string(b)
+		}
+
+		lis = append(lis, m)
+	}
+	sort.Slice(lis, func(i, j int) bool { return lis[i].Version < lis[j].Version })
+
+	return lis, nil
+}
+
+// Migrate runs SQL DDL to update tables. The files are read from the schema
+// dir of fsys, which may be an embed.FS. Asset funcs that were passed to
+// older versions are wrapped with AssetFS.
+func Migrate(fsys fs.FS) (err error) {
 	if viper.IsSet("database") {
 		pfx := "db." + viper.GetString("database")
 		if !viper.GetBool(pfx) {
@@ -24,54 +174,125 @@ func Migrate(a asset) (err error) {
 		}
 	}
 
-	err = Transaction(func(tx *Tx) (err error) {
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.Migrate(fsys)
+}
 
-		if _, err = tx.Exec(sqlschema); err != nil {
+// MigrateTo runs the migrations up or down to version on the default database.
+func MigrateTo(fsys fs.FS, version int) error {
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.MigrateTo(fsys, version)
+}
+
+// Rollback runs the down migrations of the last n applied on the default database.
+func Rollback(fsys fs.FS, n int) error {
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.Rollback(fsys, n)
+}
+
+// Status lists the migrations and applied versions of the default database.
+func Status(fsys fs.FS) ([]MigrationStatus, error) {
+	db, err := getDefault()
+	if err != nil {
+		return nil, err
+	}
+	return db.Status(fsys)
+}
+
+// DryRun writes the SQL that MigrateTo would run on the default database.
+func DryRun(fsys fs.FS, version int, w io.Writer) error {
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.DryRun(fsys, version, w)
+}
+
+// Migrate runs all pending migrations.
+func (db DB) Migrate(fsys fs.FS) (err error) {
+	return db.MigrateTo(fsys, -1)
+}
+
+// MigrateTo runs the pending migrations up to version and the down
+// migrations of any applied after it in one transaction. A negative version
+// is the latest. It fails without changes if an applied file has drifted.
+// The migration lock is held so only one process migrates at a time.
+func (db DB) MigrateTo(fsys fs.FS, version int) (err error) {
+	migrations, err := LoadMigrations(fsys, db.Dialect())
+	if err != nil {
+		return
+	}
+
+	unlock, err := db.lockMigrations(context.Background())
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if err = db.ensureVersionTable(); err != nil {
+		return
+	}
+
+	err = db.Transaction(func(tx *Tx) (err error) {
+		applied, err := appliedVersions(tx)
+		if err != nil {
 			return
 		}
 
-		version := 0
-		if err = tx.QueryRow(`select ifnull(max(version), 0) as version from schema_version`).Scan(&version); err != nil {
-			log.Debug("DBM: ", err)
+		status := migrationStatus(migrations, applied)
+		if err = checkDrift(status); err != nil {
 			return
 		}
 
-		log.Infof("DBM: Current Schema Version: %04d", version)
+		log.Infof("DBM: Current Schema Version: %04d", currentVersion(status))
 
-		var d []string
-		d, err = a.Dir("schema")
+		steps, err := planMigration(status, version)
 		if err != nil {
 			return
 		}
 
-		sort.Strings(d)
-		for _, name := range d {
-			var v int
-			v, err = strconv.Atoi(strings.SplitN(name, "-", 2)[0])
-			if err != nil {
-				continue
-			}
-
-			if version >= v {
-				continue
-			}
-
-			log.Print("DBM: Migrating ", name)
+		for _, step := range steps {
+			log.Print("DBM: Migrating ", step)
 
-			var file []byte
-			if file, err = a.File("schema/" + name); err != nil {
+			if _, err = tx.Exec(step.SQL()); err != nil {
 				return
 			}
 
-			if _, err = tx.Exec(string(file)); err != nil {
-				return
+			if step.Revert {
+				_, err = tx.Delete("schema_version").Where(sq.Eq{"version": step.Version}).Exec()
+			} else {
+				_, err = tx.Insert("schema_version").
+					Columns("version", "name", "checksum").
+					Values(step.Version, step.Name, step.Checksum).
+					Exec()
 			}
-
-			if _, err = tx.Exec(`insert into schema_version (version) values (?)`, v); err != nil {
+			if err != nil {
 				return
 			}
 
-			log.Print("DBM: Finished ", name)
+			log.Print("DBM: Finished ", step)
+		}
+
+		// Versions applied before checksums were kept adopt the current file.
+		for _, s := range status {
+			if s.Applied && applied[s.Version].Checksum == "" && s.Checksum != "" {
+				_, err = tx.Update("schema_version").
+					Set("checksum", s.Checksum).
+					Where(sq.Eq{"version": s.Version}).
+					Exec()
+				if err != nil {
+					return
+				}
+			}
 		}
 
 		return
@@ -86,9 +307,351 @@ func Migrate(a asset) (err error) {
 	return
 }
 
+// Rollback runs the down migrations of the last n applied versions.
+func (db DB) Rollback(fsys fs.FS, n int) error {
+	status, err := db.Status(fsys)
+	if err != nil {
+		return err
+	}
+
+	var versions []int
+	for _, s := range status {
+		if s.Applied {
+			versions = append(versions, s.Version)
+		}
+	}
+
+	if n <= 0 {
+		return nil
+	}
+	if n >= len(versions) {
+		return db.MigrateTo(fsys, 0)
+	}
+	return db.MigrateTo(fsys, versions[len(versions)-n-1])
+}
+
+// Status lists each migration file and applied version in version order.
+// The database is not changed.
+func (db DB) Status(fsys fs.FS) (status []MigrationStatus, err error) {
+	migrations, err := LoadMigrations(fsys, db.Dialect())
+	if err != nil {
+		return
+	}
+
+	exists, missing := db.versionTable()
+	if !exists {
+		return migrationStatus(migrations, nil), nil
+	}
+
+	// Read from the primary as a replica may lag behind a migration.
+	err = db.QueryContext(WithPrimary(context.Background()), func(tx *Tx) error {
+		applied, err := appliedVersions(tx, missing...)
+		status = migrationStatus(migrations, applied)
+		return err
+	})
+
+	return
+}
+
+// DryRun writes the SQL that MigrateTo would run for version without
+// changing the database.
+func (db DB) DryRun(fsys fs.FS, version int, w io.Writer) error {
+	status, err := db.Status(fsys)
+	if err != nil {
+		return err
+	}
+	if err = checkDrift(status); err != nil {
+		return err
+	}
+
+	steps, err := planMigration(status, version)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if _, err = fmt.Fprintf(w, "-- %s\n%s\n", step, strings.TrimSpace(step.SQL())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateLockTimeout is how long to wait for the migration lock.
+var MigrateLockTimeout = 10 * time.Minute
+
+// MigrateLockStale is how long a lock row may go without being refreshed
+// before it is taken as left by a process that died. The holder refreshes
+// it four times as often.
+var MigrateLockStale = 2 * time.Minute
+
+// migrateLockPoll is how often a held lock row is checked.
+var migrateLockPoll = time.Second
+
+// migrateLockID is the postgres advisory lock key.
+const migrateLockID = 0x64626d // "dbm"
+
+// lockMigrations takes the migration lock and returns the func to release
+// it. Postgres uses a session advisory lock. Other databases insert a row in
+// the schema_lock table, which fails while another process holds it. The
+// row is refreshed until it is released so a long migration is not taken
+// as stale.
+func (db DB) lockMigrations(ctx context.Context) (unlock func(), err error) {
+	if db.Dialect() == "postgres" {
+		conn, err := db.Conn.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(MigrateLockTimeout)
+		for {
+			var locked bool
+			if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrateLockID).Scan(&locked); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if locked {
+				break
+			}
+			if time.Now().After(deadline) {
+				conn.Close()
+				return nil, fmt.Errorf("DBM: timeout waiting for migration lock")
+			}
+
+			log.Info("DBM: Waiting for migration lock")
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return nil, ctx.Err()
+			case <-time.After(migrateLockPoll):
+			}
+		}
+
+		return func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrateLockID); err != nil {
+				log.Error("DBM: ", err)
+			}
+			conn.Close()
+		}, nil
+	}
+
+	if _, err = db.Conn.ExecContext(ctx, sqllock); err != nil {
+		return nil, err
+	}
+
+	del := sq.Delete("schema_lock").PlaceholderFormat(db.Placeholder).RunWith(db.Conn)
+	ins := sq.Insert("schema_lock").Columns("id", "locked_on").PlaceholderFormat(db.Placeholder).RunWith(db.Conn)
+
+	deadline := time.Now().Add(MigrateLockTimeout)
+	for {
+		now := time.Now().UTC()
+		if _, err = del.Where(sq.Lt{"locked_on": now.Add(-MigrateLockStale)}).ExecContext(ctx); err != nil {
+			return nil, err
+		}
+
+		if _, err = ins.Values(1, now).ExecContext(ctx); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("DBM: timeout waiting for migration lock: %v", err)
+		}
+
+		log.Info("DBM: Waiting for migration lock")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(migrateLockPoll):
+		}
+	}
+
+	hctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(MigrateLockStale / 4)
+		defer ticker.Stop()
+
+		upd := sq.Update("schema_lock").Where(sq.Eq{"id": 1}).PlaceholderFormat(db.Placeholder).RunWith(db.Conn)
+		for {
+			select {
+			case <-hctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := upd.Set("locked_on", time.Now().UTC()).ExecContext(hctx); err != nil && hctx.Err() == nil {
+					log.Warning("DBM: Refresh migration lock: ", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		if _, err := del.ExecContext(context.Background()); err != nil {
+			log.Error("DBM: ", err)
+		}
+	}, nil
+}
+
+// versionTable reports if the schema_version table exists and which of the
+// columns added since it was first created it is missing.
+func (db DB) versionTable() (exists bool, missing []string) {
+	for _, col := range []string{"version", "name", "checksum"} {
+		rows, err := db.Conn.Query("SELECT " + col + " FROM schema_version WHERE 1=0")
+		if err == nil {
+			rows.Close()
+			exists = true
+			continue
+		}
+		if col == "version" {
+			return false, nil
+		}
+		missing = append(missing, col)
+	}
+	return
+}
+
+// ensureVersionTable creates the schema_version table and adds the columns
+// missing from tables created by older versions.
+func (db DB) ensureVersionTable() error {
+	exists, missing := db.versionTable()
+	if !exists {
+		_, err := db.Conn.Exec(sqlschema)
+		return err
+	}
+
+	for _, col := range missing {
+		log.Notice("DBM: Adding schema_version.", col)
+		if _, err := db.Conn.Exec("ALTER TABLE schema_version ADD COLUMN " + col + " VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appliedVersions reads the schema_version table. Missing columns are read
+// as empty.
+func appliedVersions(tx *Tx, missing ...string) (map[int]MigrationStatus, error) {
+	cols := []string{"version", "name", "checksum", "updated_on"}
+	for i, col := range cols {
+		for _, m := range missing {
+			if col == m {
+				cols[i] = "'' AS " + col
+			}
+		}
+	}
+
+	applied := make(map[int]MigrationStatus)
+	err := tx.Fetch(
+		"schema_version",
+		cols,
+		nil, 0, 0, []string{"version asc"},
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				var s MigrationStatus
+				var on interface{}
+				if err := rows.Scan(&s.Version, &s.Name, &s.Checksum, &on); err != nil {
+					return err
+				}
+				s.Applied = true
+				s.AppliedOn, _ = on.(time.Time)
+				applied[s.Version] = s
+			}
+			return rows.Err()
+		},
+	)
+	return applied, err
+}
+
+// migrationStatus joins the files with the applied versions.
+func migrationStatus(migrations []Migration, applied map[int]MigrationStatus) (lis []MigrationStatus) {
+	seen := make(map[int]struct{}, len(migrations))
+	for _, m := range migrations {
+		seen[m.Version] = struct{}{}
+
+		s := MigrationStatus{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedOn = a.AppliedOn
+			s.Drift = a.Checksum != "" && a.Checksum != m.Checksum
+		}
+		lis = append(lis, s)
+	}
+
+	// Applied versions without a file are listed so they can be seen.
+	for v, a := range applied {
+		if _, ok := seen[v]; !ok {
+			lis = append(lis, a)
+		}
+	}
+	sort.Slice(lis, func(i, j int) bool { return lis[i].Version < lis[j].Version })
+
+	return
+}
+
+func checkDrift(status []MigrationStatus) error {
+	var drift []string
+	for _, s := range status {
+		if s.Drift {
+			drift = append(drift, fmt.Sprintf("%04d-%s", s.Version, s.Name))
+		}
+	}
+	if len(drift) > 0 {
+		return fmt.Errorf("DBM: migrations changed after they were applied: %s", strings.Join(drift, ", "))
+	}
+	return nil
+}
+
+func currentVersion(status []MigrationStatus) (version int) {
+	for _, s := range status {
+		if s.Applied && s.Version > version {
+			version = s.Version
+		}
+	}
+	return
+}
+
+// planMigration returns the down steps for applied versions after version
+// from the newest and then the up steps for pending versions up to it.
+func planMigration(status []MigrationStatus, version int) (steps []MigrationStep, err error) {
+	for i := len(status) - 1; i >= 0; i-- {
+		s := status[i]
+		if !s.Applied || version < 0 || s.Version <= version {
+			continue
+		}
+		if s.Up == "" {
+			return nil, fmt.Errorf("DBM: migration %04d-%s is applied but has no file", s.Version, s.Name)
+		}
+		if s.Down == "" {
+			return nil, fmt.Errorf("DBM: migration %04d-%s has no down file", s.Version, s.Name)
+		}
+		steps = append(steps, MigrationStep{Migration: s.Migration, Revert: true})
+	}
+
+	for _, s := range status {
+		if s.Applied || (version >= 0 && s.Version > version) {
+			continue
+		}
+		steps = append(steps, MigrationStep{Migration: s.Migration})
+	}
+
+	return
+}
+
 var sqlschema = `
 CREATE TABLE IF NOT EXISTS schema_version (
-  version     INT(8) NOT NULL,
+  version     INTEGER NOT NULL,
+  name        VARCHAR(255) NOT NULL DEFAULT '',
+  checksum    VARCHAR(255) NOT NULL DEFAULT '',
   updated_on  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (version)
 );`
+
+var sqllock = `
+CREATE TABLE IF NOT EXISTS schema_lock (
+  id         INTEGER NOT NULL,
+  locked_on  TIMESTAMP NOT NULL,
+  PRIMARY KEY (id)
+);`
@@ -0,0 +1,290 @@
+package dbm
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mapFS serves the files in m as the schema dir.
+func mapFS(m map[string]string) fstest.MapFS {
+	fsys := make(fstest.MapFS, len(m))
+	for name, data := range m {
+		fsys["schema/"+name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	return fsys
+}
+
+func newSqliteDB(t *testing.T) DB {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+
+	return DB{Conn: conn, DbType: "sqlite3", Placeholder: sq.Question}
+}
+
+func TestMigrate(t *testing.T) {
+	files := map[string]string{
+		"0001-users.up.sql":   "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+		"0001-users.down.sql": "DROP TABLE users;",
+		"0002-name.up.sql":    "ALTER TABLE users ADD COLUMN name TEXT;",
+		"0002-name.down.sql":  "CREATE TABLE users2 (id INTEGER PRIMARY KEY); DROP TABLE users; ALTER TABLE users2 RENAME TO users;",
+		"0003-posts.sql":      "CREATE TABLE posts (id INTEGER PRIMARY KEY);",
+		"README.md":           "not a migration",
+	}
+
+	Convey("Given a sqlite database and migrations", t, func() {
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+
+		hasTable := func(name string) bool {
+			var n int
+			db.Conn.QueryRow("SELECT count(1) FROM sqlite_master WHERE type='table' AND name=?", name).Scan(&n)
+			return n > 0
+		}
+		applied := func(status []MigrationStatus) (lis []int) {
+			for _, s := range status {
+				if s.Applied {
+					lis = append(lis, s.Version)
+				}
+			}
+			return
+		}
+
+		Convey("migrations are read in pairs", func() {
+			lis, err := LoadMigrations(mapFS(files), "sqlite")
+			So(err, ShouldBeNil)
+			So(lis, ShouldHaveLength, 3)
+			So(lis[0].Name, ShouldEqual, "users")
+			So(lis[0].Down, ShouldEqual, "DROP TABLE users;")
+			So(lis[2].Down, ShouldBeEmpty)
+			So(lis[2].Checksum, ShouldEqual, Checksum(files["0003-posts.sql"]))
+
+			_, err = LoadMigrations(mapFS(map[string]string{"0001-x.down.sql": ""}), "sqlite")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("files for the dialect are used", func() {
+			files := map[string]string{
+				"0001-users.sql":          "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+				"0001-users.postgres.sql": "CREATE EXTENSION nope;",
+				"0002-posts.sql":          "CREATE EXTENSION nope;",
+				"0002-posts.sqlite.sql":   "CREATE TABLE posts (id INTEGER PRIMARY KEY);",
+				"0002-posts.mysql.sql":    "CREATE EXTENSION nope;",
+			}
+
+			So(db.Migrate(mapFS(files)), ShouldBeNil)
+			So(hasTable("users"), ShouldBeTrue)
+			So(hasTable("posts"), ShouldBeTrue)
+
+			lis, err := LoadMigrations(mapFS(files), "postgres")
+			So(err, ShouldBeNil)
+			So(lis[0].Up, ShouldEqual, "CREATE EXTENSION nope;")
+			So(lis[1].Up, ShouldEqual, "CREATE EXTENSION nope;")
+		})
+
+		Convey("the migration lock is held by one at a time", func() {
+			old := migrateLockPoll
+			migrateLockPoll = 10 * time.Millisecond
+			defer func() { migrateLockPoll = old }()
+
+			unlock, err := db.lockMigrations(context.Background())
+			So(err, ShouldBeNil)
+
+			done := make(chan error)
+			go func() { done <- db.Migrate(mapFS(files)) }()
+
+			select {
+			case <-done:
+				t.Error("migrated while locked")
+			case <-time.After(50 * time.Millisecond):
+			}
+			So(hasTable("users"), ShouldBeFalse)
+
+			unlock()
+			So(<-done, ShouldBeNil)
+			So(hasTable("users"), ShouldBeTrue)
+		})
+
+		Convey("a held lock is refreshed and a stale one is taken", func() {
+			oldPoll, oldStale := migrateLockPoll, MigrateLockStale
+			migrateLockPoll, MigrateLockStale = 10*time.Millisecond, 40*time.Millisecond
+			defer func() { migrateLockPoll, MigrateLockStale = oldPoll, oldStale }()
+
+			unlock, err := db.lockMigrations(context.Background())
+			So(err, ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+			defer cancel()
+			_, err = db.lockMigrations(ctx)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			unlock()
+
+			_, err = db.Conn.Exec("INSERT INTO schema_lock (id, locked_on) VALUES (1, ?)", time.Now().UTC().Add(-time.Second))
+			So(err, ShouldBeNil)
+
+			unlock, err = db.lockMigrations(context.Background())
+			So(err, ShouldBeNil)
+			unlock()
+		})
+
+		Convey("dry run lists pending SQL without changes", func() {
+			var buf bytes.Buffer
+			So(db.DryRun(mapFS(files), -1, &buf), ShouldBeNil)
+			So(buf.String(), ShouldStartWith, "-- up 0001-users\nCREATE TABLE users")
+			So(buf.String(), ShouldContainSubstring, "-- up 0003-posts\n")
+			So(hasTable("schema_version"), ShouldBeFalse)
+		})
+
+		Convey("it migrates up, down and reports status", func() {
+			So(db.MigrateTo(mapFS(files), 2), ShouldBeNil)
+			So(hasTable("users"), ShouldBeTrue)
+			So(hasTable("posts"), ShouldBeFalse)
+
+			So(db.Migrate(mapFS(files)), ShouldBeNil)
+			status, err := db.Status(mapFS(files))
+			So(err, ShouldBeNil)
+			So(applied(status), ShouldResemble, []int{1, 2, 3})
+
+			Convey("a migration without a down file can not be rolled back", func() {
+				So(db.Rollback(mapFS(files), 1), ShouldNotBeNil)
+				So(hasTable("posts"), ShouldBeTrue)
+			})
+
+			Convey("edited files are found as drift", func() {
+				edited := map[string]string{}
+				for k, v := range files {
+					edited[k] = v
+				}
+				edited["0001-users.up.sql"] = "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT);"
+
+				status, err := db.Status(mapFS(edited))
+				So(err, ShouldBeNil)
+				So(status[0].Drift, ShouldBeTrue)
+				So(status[1].Drift, ShouldBeFalse)
+
+				err = db.Migrate(mapFS(edited))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "0001-users")
+			})
+		})
+
+		Convey("rollback undoes the last applied", func() {
+			So(db.MigrateTo(mapFS(files), 2), ShouldBeNil)
+
+			So(db.Rollback(mapFS(files), 1), ShouldBeNil)
+			status, err := db.Status(mapFS(files))
+			So(err, ShouldBeNil)
+			So(applied(status), ShouldResemble, []int{1})
+			So(hasTable("users"), ShouldBeTrue)
+
+			So(db.MigrateTo(mapFS(files), 0), ShouldBeNil)
+			So(hasTable("users"), ShouldBeFalse)
+		})
+
+		Convey("tables from before checksums are upgraded", func() {
+			_, err := db.Conn.Exec(`CREATE TABLE schema_version (version INT(8) NOT NULL, updated_on TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (version));
+				CREATE TABLE users (id INTEGER PRIMARY KEY);
+				INSERT INTO schema_version (version) VALUES (1);`)
+			So(err, ShouldBeNil)
+
+			status, err := db.Status(mapFS(files))
+			So(err, ShouldBeNil)
+			So(applied(status), ShouldResemble, []int{1})
+
+			So(db.Migrate(mapFS(files)), ShouldBeNil)
+
+			var sum string
+			So(db.Conn.QueryRow("SELECT checksum FROM schema_version WHERE version = 1").Scan(&sum), ShouldBeNil)
+			So(sum, ShouldEqual, Checksum(files["0001-users.up.sql"]))
+		})
+	})
+}
+
+func TestLockMigrationsPostgres(t *testing.T) {
+	Convey("Given a postgres database", t, func() {
+		conn, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		db := DB{Conn: conn, DbType: "postgres", Placeholder: sq.Dollar}
+
+		oldPoll, oldTimeout := migrateLockPoll, MigrateLockTimeout
+		migrateLockPoll = time.Millisecond
+		defer func() { migrateLockPoll, MigrateLockTimeout = oldPoll, oldTimeout }()
+
+		locked := func(ok bool) *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(ok)
+		}
+
+		Convey("the lock is tried until it is free", func() {
+			mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(migrateLockID).WillReturnRows(locked(false))
+			mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(migrateLockID).WillReturnRows(locked(true))
+			mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(migrateLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			unlock, err := db.lockMigrations(context.Background())
+			So(err, ShouldBeNil)
+			unlock()
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("waiting stops at the lock timeout", func() {
+			MigrateLockTimeout = 0
+			mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(migrateLockID).WillReturnRows(locked(false))
+
+			_, err := db.lockMigrations(context.Background())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "timeout")
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
+
+func TestAssetFS(t *testing.T) {
+	Convey("Given go-bindata style asset funcs", t, func() {
+		files := map[string]string{
+			"schema/0001-users.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);",
+		}
+		a := AssetFS{
+			File: func(name string) ([]byte, error) {
+				if data, ok := files[name]; ok {
+					return []byte(data), nil
+				}
+				return nil, fmt.Errorf("not found")
+			},
+			Dir: func(name string) ([]string, error) {
+				return []string{"0001-users.sql"}, nil
+			},
+		}
+
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+
+		Convey("the migrations are run", func() {
+			So(db.Migrate(a), ShouldBeNil)
+
+			status, err := db.Status(a)
+			So(err, ShouldBeNil)
+			So(status, ShouldHaveLength, 1)
+			So(status[0].Applied, ShouldBeTrue)
+		})
+
+		Convey("missing files are not found", func() {
+			_, err := fs.ReadFile(a, "schema/0002-posts.sql")
+			So(errors.Is(err, fs.ErrNotExist), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package dbm
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestPool(t *testing.T) {
+	Convey("Given pool settings", t, func() {
+		Reset(func() {
+			for _, k := range []string{"max_conn", "max_idle", "max_lifetime", "max_idle_time", "type", "connect", "connect_retries", "connect_backoff"} {
+				viper.Set("db.pool."+k, nil)
+			}
+		})
+
+		Convey("defaults are used when not set", func() {
+			c := GetPoolConfig("db.pool")
+			So(c, ShouldResemble, PoolConfig{MaxOpen: DefaultMaxConn, MaxIdle: DefaultMaxIdle, MaxLifetime: DefaultMaxLifetime})
+		})
+
+		Convey("they are read in minutes or as durations", func() {
+			viper.Set("db.pool.max_conn", 20)
+			viper.Set("db.pool.max_idle", 0)
+			viper.Set("db.pool.max_lifetime", 60)
+			viper.Set("db.pool.max_idle_time", "90s")
+
+			c := GetPoolConfig("db.pool")
+			So(c, ShouldResemble, PoolConfig{MaxOpen: 20, MaxIdle: 0, MaxLifetime: time.Hour, MaxIdleTime: 90 * time.Second})
+		})
+
+		Convey("they are applied to the connection", func() {
+			viper.Set("db.pool.type", "sqlite3")
+			viper.Set("db.pool.connect", ":memory:")
+			viper.Set("db.pool.max_conn", 7)
+
+			db, err := GetDB("db.pool")
+			So(err, ShouldBeNil)
+			defer db.Close()
+
+			So(db.Conn.Stats().MaxOpenConnections, ShouldEqual, 7)
+			So(db.Healthy(), ShouldBeTrue)
+		})
+
+		Convey("closing stops the health check", func() {
+			viper.Set("db.pool.type", "sqlite3")
+			viper.Set("db.pool.connect", ":memory:")
+			before := runtime.NumGoroutine()
+
+			db, err := GetDB("db.pool")
+			So(err, ShouldBeNil)
+			So(db.Close(), ShouldBeNil)
+			So(db.Conn.Ping(), ShouldNotBeNil)
+
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+		})
+
+		Convey("missing settings are returned as errors", func() {
+			_, err := GetDB("db.pool")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "db.pool.type")
+
+			viper.Set("db.pool.type", "sqlite3")
+			_, err = GetDB("db.pool")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "db.pool.connect")
+		})
+
+		Convey("connecting is retried before failing", func() {
+			viper.Set("db.pool.type", "sqlite3")
+			viper.Set("db.pool.connect", "file:/nonexistent/dir/db?mode=ro")
+			viper.Set("db.pool.connect_retries", 2)
+			viper.Set("db.pool.connect_backoff", "1ms")
+
+			start := time.Now()
+			_, err := GetDB("db.pool")
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 3*time.Millisecond)
+		})
+	})
+
+	Convey("Given registered databases", t, func() {
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+		db.primary = &pool{conn: db.Conn, connect: "test", healthy: 1}
+
+		old, oldName := registry.dbs, registry.name
+		registry.dbs, registry.name = nil, ""
+		Reset(func() { registry.dbs, registry.name = old, oldName })
+		Register("test", db)
+
+		Convey("they are ready while the primary is healthy", func() {
+			So(Ready(), ShouldBeNil)
+
+			db.Conn.Close()
+			db.check(context.Background())
+			So(Ready(), ShouldNotBeNil)
+			So(Ready().Error(), ShouldContainSubstring, "test")
+		})
+	})
+}
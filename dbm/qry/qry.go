@@ -64,3 +64,10 @@ func Qry(db dbm.DbInfo, input *gql.QueryInput) (out Input, err error) {
 
 	return
 }
+
+var _ dbm.Lister = Input{}
+
+// ListQuery returns the query for dbm.Repo.List.
+func (in Input) ListQuery() dbm.Query {
+	return dbm.Query{Search: in.Search, Limit: in.Limit, Offset: in.Offset, Sort: in.Sort}
+}
@@ -0,0 +1,310 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/log"
+)
+
+// DefaultHealthCheck is how often pools are pinged when db.<name>.health_check is not set.
+const DefaultHealthCheck = 10 * time.Second
+
+// pool is a connection pool and its health.
+type pool struct {
+	conn    *sql.DB
+	connect string
+	healthy int32
+	reads   uint64
+}
+
+// replicaSet routes read only transactions over replicas in turn.
+type replicaSet struct {
+	lis   []*pool
+	next  uint32
+	reads uint64
+}
+
+// PoolStats are the counters of a connection pool.
+type PoolStats struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Connect string `json:"connect"`
+	Healthy bool   `json:"healthy"`
+	// Reads are the read only transactions routed to a replica. For the
+	// primary they are the reads that fell back to it.
+	Reads uint64 `json:"reads"`
+
+	sql.DBStats
+}
+
+type primaryKey struct{}
+
+// WithPrimary makes read only transactions started with the context use the
+// primary. Use it to read back a write before the replicas catch up.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// IsPrimary returns true if the context was made with WithPrimary.
+func IsPrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryKey{}).(bool)
+	return v
+}
+
+// openReplicas connects the replicas. Replicas that fail to connect are
+// marked unhealthy and tried again by the health check.
+func openReplicas(dbType string, connects []string, setup func(*sql.DB)) *replicaSet {
+	if len(connects) == 0 {
+		return nil
+	}
+
+	rs := &replicaSet{}
+	for _, connect := range connects {
+		conn, err := sql.Open(dbType, connect)
+		if err != nil {
+			log.Error("DBM: ", err)
+			continue
+		}
+		setup(conn)
+
+		r := &pool{conn: conn, connect: MaskConnect(connect)}
+		r.check(context.Background())
+		rs.lis = append(rs.lis, r)
+
+		log.Notice("DBM: Replica Connected: ", r.connect)
+	}
+
+	return rs
+}
+
+// pick returns the next healthy replica or nil if there are none.
+func (rs *replicaSet) pick() *pool {
+	if rs == nil {
+		return nil
+	}
+
+	n := uint32(len(rs.lis))
+	for i := uint32(0); i < n; i++ {
+		r := rs.lis[(atomic.AddUint32(&rs.next, 1)-1)%n]
+		if r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+// beginRead starts a read only transaction on a replica. It returns nil if
+// no replica could start one so the primary is used. Replicas are only
+// marked unhealthy for connection errors.
+func (rs *replicaSet) beginRead(ctx context.Context, opts *sql.TxOptions) *sql.Tx {
+	if rs == nil || IsPrimary(ctx) || ctx.Err() != nil {
+		return nil
+	}
+
+	for i := 0; i < len(rs.lis); i++ {
+		r := rs.pick()
+		if r == nil {
+			break
+		}
+
+		tx, err := r.conn.BeginTx(ctx, opts)
+		if err == nil {
+			atomic.AddUint64(&r.reads, 1)
+			return tx
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		log.Warning("DBM: Replica ", r.connect, " failed: ", err)
+		if isConnError(err) {
+			atomic.StoreInt32(&r.healthy, 0)
+		}
+	}
+
+	atomic.AddUint64(&rs.reads, 1)
+	return nil
+}
+
+// isConnError returns true if err is from a lost or refused connection.
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &netErr)
+}
+
+func (r *pool) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// check pings the pool and records if it is healthy.
+func (r *pool) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var healthy int32
+	if err := r.conn.PingContext(ctx); err == nil {
+		healthy = 1
+	} else {
+		log.Debug("DBM: Pool ", r.connect, ": ", err)
+	}
+
+	if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+		if healthy == 1 {
+			log.Notice("DBM: Pool ", r.connect, " is healthy")
+		} else {
+			log.Warning("DBM: Pool ", r.connect, " is unhealthy")
+		}
+	}
+}
+
+// startHealthCheck pings the primary and replicas every interval until
+// shutdown or the DB is closed.
+func (db *DB) startHealthCheck(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.stopCheck = cancel
+
+	httpsrv.WaitShutdown.Add(1)
+	go db.healthCheck(ctx, interval)
+}
+
+func (db DB) healthCheck(ctx context.Context, interval time.Duration) {
+	defer httpsrv.WaitShutdown.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.check(ctx)
+
+		case <-ctx.Done():
+			return
+
+		case <-httpsrv.SignalShutdown:
+			log.Debug("DBM: Shutting Down Health Check")
+			return
+		}
+	}
+}
+
+// Close stops the health check and closes the primary and replica pools.
+func (db DB) Close() error {
+	if db.stopCheck != nil {
+		db.stopCheck()
+	}
+	if db.replicas != nil {
+		for _, r := range db.replicas.lis {
+			if err := r.conn.Close(); err != nil {
+				log.Error("DBM: ", err)
+			}
+		}
+	}
+	if db.Conn == nil {
+		return nil
+	}
+	return db.Conn.Close()
+}
+
+// check pings the primary and replicas once.
+func (db DB) check(ctx context.Context) {
+	if db.primary != nil {
+		db.primary.check(ctx)
+	}
+	if db.replicas != nil {
+		for _, r := range db.replicas.lis {
+			r.check(ctx)
+		}
+	}
+}
+
+// Healthy returns true if the primary passed its last health check. A
+// database without a health check is pinged.
+func (db DB) Healthy() bool {
+	if db.primary != nil {
+		return db.primary.isHealthy()
+	}
+	return db.Conn != nil && db.Conn.Ping() == nil
+}
+
+func init() {
+	httpsrv.RegisterReady("db", Ready)
+}
+
+// Ready returns an error naming the registered databases whose primary is
+// not healthy. Unhealthy replicas do not fail it as reads use the primary.
+func Ready() error {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	var names []string
+	for name, db := range registry.dbs {
+		if !db.Healthy() {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("DBM: unhealthy: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Stats returns the counters of the primary and replica pools.
+func (db DB) Stats() []PoolStats {
+	var lis []PoolStats
+	if db.Conn != nil {
+		s := PoolStats{Name: db.Name, Role: "primary", Healthy: db.Healthy(), DBStats: db.Conn.Stats()}
+		if db.primary != nil {
+			s.Connect = db.primary.connect
+		}
+		if db.replicas != nil {
+			s.Reads = atomic.LoadUint64(&db.replicas.reads)
+		}
+		lis = append(lis, s)
+	}
+
+	if db.replicas != nil {
+		for _, r := range db.replicas.lis {
+			lis = append(lis, PoolStats{
+				Name:    db.Name,
+				Role:    "replica",
+				Connect: r.connect,
+				Healthy: r.isHealthy(),
+				Reads:   atomic.LoadUint64(&r.reads),
+				DBStats: r.conn.Stats(),
+			})
+		}
+	}
+
+	return lis
+}
+
+// Stats returns the pool counters of the registered databases.
+func Stats() (lis []PoolStats) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for _, db := range registry.dbs {
+		lis = append(lis, db.Stats()...)
+	}
+	return
+}
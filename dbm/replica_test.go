@@ -0,0 +1,128 @@
+package dbm
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReplicas(t *testing.T) {
+	Convey("Given a primary with two replicas", t, func() {
+		db := newSqliteDB(t)
+		one, two := newSqliteDB(t), newSqliteDB(t)
+		defer db.Conn.Close()
+		defer one.Conn.Close()
+		defer two.Conn.Close()
+
+		for name, d := range map[string]DB{"primary": db, "one": one, "two": two} {
+			_, err := d.Conn.Exec("CREATE TABLE role (name TEXT); INSERT INTO role VALUES ('" + name + "')")
+			So(err, ShouldBeNil)
+		}
+
+		db.Name = "test"
+		db.replicas = &replicaSet{lis: []*pool{
+			{conn: one.Conn, connect: "one", healthy: 1},
+			{conn: two.Conn, connect: "two", healthy: 1},
+		}}
+
+		role := func(ctx context.Context, readonly bool) (name string) {
+			tx, err := db.NewTx(ctx, readonly)
+			So(err, ShouldBeNil)
+			defer tx.Rollback()
+
+			So(tx.QueryRow("SELECT name FROM role").Scan(&name), ShouldBeNil)
+			return
+		}
+		ctx := context.Background()
+
+		Convey("reads go to the replicas in turn", func() {
+			So(role(ctx, true), ShouldEqual, "one")
+			So(role(ctx, true), ShouldEqual, "two")
+			So(role(ctx, true), ShouldEqual, "one")
+			So(role(ctx, false), ShouldEqual, "primary")
+		})
+
+		Convey("reads can be forced to the primary", func() {
+			So(role(WithPrimary(ctx), true), ShouldEqual, "primary")
+		})
+
+		Convey("unhealthy replicas are skipped", func() {
+			db.replicas.lis[0].healthy = 0
+			So(role(ctx, true), ShouldEqual, "two")
+			So(role(ctx, true), ShouldEqual, "two")
+
+			db.replicas.lis[1].healthy = 0
+			So(role(ctx, true), ShouldEqual, "primary")
+
+			Convey("and used again once they pass a check", func() {
+				db.replicas.lis[0].check(ctx)
+				So(db.replicas.lis[0].isHealthy(), ShouldBeTrue)
+				So(role(ctx, true), ShouldEqual, "one")
+			})
+		})
+
+		Convey("a cancelled context does not mark replicas unhealthy", func() {
+			cctx, cancel := context.WithCancel(ctx)
+			cancel()
+
+			_, err := db.NewTx(cctx, true)
+			So(err, ShouldNotBeNil)
+			So(db.replicas.lis[0].isHealthy(), ShouldBeTrue)
+			So(db.replicas.lis[1].isHealthy(), ShouldBeTrue)
+		})
+
+		Convey("other errors fall back without marking replicas unhealthy", func() {
+			closed := newSqliteDB(t)
+			closed.Conn.Close()
+			db.replicas.lis[1].conn = closed.Conn
+
+			So(role(ctx, true), ShouldEqual, "one")
+			So(role(ctx, true), ShouldEqual, "one")
+			So(db.replicas.lis[1].isHealthy(), ShouldBeTrue)
+		})
+
+		Convey("migration status is read from the primary", func() {
+			So(db.ensureVersionTable(), ShouldBeNil)
+			_, err := db.Status(mapFS(map[string]string{"0001-users.up.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY);"}))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("pool stats are reported", func() {
+			role(ctx, true)
+			role(ctx, true)
+
+			lis := db.Stats()
+			So(lis, ShouldHaveLength, 3)
+			So(lis[0].Role, ShouldEqual, "primary")
+			So(lis[1].Reads, ShouldEqual, 1)
+			So(lis[2].Reads, ShouldEqual, 1)
+			So(lis[2].Healthy, ShouldBeTrue)
+		})
+	})
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad conn", driver.ErrBadConn, true},
+		{"eof", fmt.Errorf("read: %w", io.EOF), true},
+		{"net", &net.OpError{Op: "dial", Err: fmt.Errorf("refused")}, true},
+		{"context", context.Canceled, false},
+		{"query", fmt.Errorf("syntax error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isConnError(tt.err); got != tt.want {
+				t.Errorf("isConnError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
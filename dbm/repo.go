@@ -0,0 +1,303 @@
+package dbm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"sour.is/x/toolbox/log"
+)
+
+// ErrNoPrimary is returned by a Repo for a struct without PRIMARY or AUTO columns.
+var ErrNoPrimary = errors.New("DBM: no primary key")
+
+// Query selects the rows to list.
+type Query struct {
+	Search interface{}
+	Limit  uint64
+	Offset uint64
+	Sort   []string
+}
+
+// Lister returns the rows to list. qry.Input is one.
+type Lister interface {
+	ListQuery() Query
+}
+
+// ListQuery returns the query.
+func (q Query) ListQuery() Query { return q }
+
+// Repo reads and writes rows of a struct described by GetDbInfo. Rows are
+// keyed by the PRIMARY columns or by the AUTO columns if there are none.
+// Field types must be scannable and valuable by the driver.
+type Repo struct {
+	DbInfo
+	typ reflect.Type
+}
+
+// NewRepo returns a Repo for the struct type of o.
+func NewRepo(o interface{}) Repo {
+	t := reflect.TypeOf(o)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return Repo{DbInfo: GetDbInfo(reflect.Zero(t).Interface()), typ: t}
+}
+
+// Get reads the row with the primary key into o.
+// It returns sql.ErrNoRows if there is none.
+func (r Repo) Get(tx *Tx, o interface{}, pk ...interface{}) error {
+	where, err := r.keyEq(pk...)
+	if err != nil {
+		return err
+	}
+	cols, dest, err := r.scan(o)
+	if err != nil {
+		return err
+	}
+
+	return tx.Select(cols, r.View).Where(where).QueryRowContext(tx.Context).Scan(dest...)
+}
+
+// List appends the rows of q to lis, a pointer to a slice of the struct.
+func (r Repo) List(tx *Tx, lis interface{}, q Lister) error {
+	out := reflect.ValueOf(lis)
+	if out.Kind() != reflect.Ptr || out.Elem().Kind() != reflect.Slice || out.Elem().Type().Elem() != r.typ {
+		return fmt.Errorf("DBM: list wants *[]%s got %T", r.typ, lis)
+	}
+	out = out.Elem()
+
+	qry := q.ListQuery()
+	o := reflect.New(r.typ)
+	cols, dest, err := r.scan(o.Interface())
+	if err != nil {
+		return err
+	}
+
+	return tx.Fetch(r.View, cols, qry.Search, qry.Limit, qry.Offset, qry.Sort,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				if err := rows.Scan(dest...); err != nil {
+					return err
+				}
+				out.Set(reflect.Append(out, o.Elem()))
+			}
+			return rows.Err()
+		})
+}
+
+// Count returns the count of rows that match where.
+func (r Repo) Count(tx *Tx, where interface{}) (uint64, error) {
+	return tx.Count(r.View, where)
+}
+
+// Insert adds o as a new row. The AUTO columns are set on o from the row.
+func (r Repo) Insert(tx *Tx, o interface{}) error {
+	v, err := r.value(o)
+	if err != nil {
+		return err
+	}
+	return r.insert(tx, v)
+}
+
+// Update writes o over the row with its primary key. AUTO columns are
+// not written. It returns sql.ErrNoRows if there is none.
+func (r Repo) Update(tx *Tx, o interface{}) error {
+	v, err := r.value(o)
+	if err != nil {
+		return err
+	}
+	where, err := r.keyOf(v)
+	if err != nil {
+		return err
+	}
+
+	set := r.setMap(v, append(append([]string(nil), r.keys()...), r.Auto...))
+	if len(set) == 0 {
+		return r.exists(tx, where)
+	}
+
+	result, err := tx.Update(r.Table).SetMap(set).Where(where).ExecContext(tx.Context)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// MySQL counts changed rows so an update to the same values is zero.
+		return r.exists(tx, where)
+	}
+	return nil
+}
+
+// exists returns sql.ErrNoRows if there is no row for the key.
+func (r Repo) exists(tx *Tx, where sq.Eq) error {
+	var one int
+	return tx.Select([]string{"1"}, r.Table).Where(where).Limit(1).QueryRowContext(tx.Context).Scan(&one)
+}
+
+// Upsert inserts o or updates the row with its primary key in one
+// statement. A zero primary key is always inserted.
+func (r Repo) Upsert(tx *Tx, o interface{}) error {
+	v, err := r.value(o)
+	if err != nil {
+		return err
+	}
+	if len(r.keys()) == 0 {
+		return ErrNoPrimary
+	}
+	if r.zeroKey(v) {
+		return r.insert(tx, v)
+	}
+
+	var skip []string
+	for _, field := range r.Auto {
+		if !hasString(r.keys(), field) {
+			skip = append(skip, field)
+		}
+	}
+	return tx.Upsert(r.DbInfo, o, r.setMap(v, skip), r.keys()...)
+}
+
+// Delete removes the row with the primary key.
+// It returns sql.ErrNoRows if there is none.
+func (r Repo) Delete(tx *Tx, pk ...interface{}) error {
+	where, err := r.keyEq(pk...)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Delete(r.Table).Where(where).ExecContext(tx.Context)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// insert adds the row. AUTO columns are read back with RETURNING if the
+// database has it or from LastInsertId.
+func (r Repo) insert(tx *Tx, v reflect.Value) error {
+	ins := tx.Insert(r.Table).SetMap(r.setMap(v, r.Auto))
+
+	if len(r.Auto) == 0 {
+		_, err := ins.ExecContext(tx.Context)
+		return err
+	}
+
+	auto, dest, err := r.DbInfo.StructMap(v.Addr().Interface(), r.Auto)
+	if err != nil {
+		return err
+	}
+
+	if tx.Returns {
+		ins = ins.Suffix(`RETURNING "` + strings.Join(auto, `","`) + `"`)
+
+		s, a, _ := ins.ToSql()
+		log.Debugs("Repo.Insert", "sql", s, "args", a)
+
+		return ins.QueryRowContext(tx.Context).Scan(dest...)
+	}
+
+	s, a, _ := ins.ToSql()
+	log.Debugs("Repo.Insert", "sql", s, "args", a)
+
+	result, err := ins.ExecContext(tx.Context)
+	if err != nil {
+		return err
+	}
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return tx.Select(auto, r.View).Where(sq.Eq{auto[0]: lastID}).QueryRowContext(tx.Context).Scan(dest...)
+}
+
+// keys returns the fields of the primary key.
+func (r Repo) keys() []string {
+	if len(r.Primary) > 0 {
+		return r.Primary
+	}
+	return r.Auto
+}
+
+// keyEq returns the where clause for the primary key values.
+func (r Repo) keyEq(pk ...interface{}) (sq.Eq, error) {
+	keys := r.keys()
+	if len(keys) == 0 {
+		return nil, ErrNoPrimary
+	}
+	if len(pk) != len(keys) {
+		return nil, fmt.Errorf("argument missmatch. want=%d, got=%d", len(keys), len(pk))
+	}
+
+	where := sq.Eq{}
+	for i, k := range keys {
+		where[r.ColPanic(k)] = pk[i]
+	}
+	return where, nil
+}
+
+// keyOf returns the where clause for the primary key of v.
+func (r Repo) keyOf(v reflect.Value) (sq.Eq, error) {
+	var pk []interface{}
+	for _, k := range r.keys() {
+		pk = append(pk, v.FieldByName(k).Interface())
+	}
+	return r.keyEq(pk...)
+}
+
+func (r Repo) zeroKey(v reflect.Value) bool {
+	for _, k := range r.keys() {
+		if !isZero(v.FieldByName(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+// setMap returns the column values of v without the skipped fields.
+func (r Repo) setMap(v reflect.Value, skip []string) map[string]interface{} {
+	set := make(map[string]interface{}, len(r.SCols))
+	for i, field := range r.SCols {
+		if hasString(skip, field) {
+			continue
+		}
+		set[r.Cols[i]] = v.FieldByName(field).Interface()
+	}
+	return set
+}
+
+// scan returns the columns and scan targets of o.
+func (r Repo) scan(o interface{}) ([]string, []interface{}, error) {
+	if _, err := r.value(o); err != nil {
+		return nil, nil, err
+	}
+	return r.DbInfo.StructMap(o, nil)
+}
+
+// value returns the struct o points to.
+func (r Repo) value(o interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(o)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != r.typ {
+		return v, fmt.Errorf("DBM: repo wants *%s got %T", r.typ, o)
+	}
+	return v.Elem(), nil
+}
+
+func hasString(lis []string, s string) bool {
+	for _, v := range lis {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
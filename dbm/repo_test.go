@@ -0,0 +1,167 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type repoItem struct {
+	ID   int64  `json:"id" db:",AUTO" table:"item"`
+	Name string `json:"name"`
+	Qty  int    `json:"qty"`
+}
+
+type repoTag struct {
+	Space string `json:"space" db:",PRIMARY" table:"tag"`
+	Name  string `json:"name" db:",PRIMARY"`
+	Note  string `json:"note"`
+}
+
+func TestRepo(t *testing.T) {
+	Convey("Given a database and repos", t, func() {
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+
+		_, err := db.Conn.Exec(`CREATE TABLE item (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, qty INTEGER);
+			CREATE TABLE tag (space TEXT, name TEXT, note TEXT, PRIMARY KEY (space, name));`)
+		So(err, ShouldBeNil)
+
+		items := NewRepo(repoItem{})
+		tags := NewRepo(&repoTag{})
+
+		tx, err := db.NewTx(context.Background(), false)
+		So(err, ShouldBeNil)
+		defer tx.Rollback()
+
+		Convey("inserts read back AUTO columns", func() {
+			a, b := repoItem{Name: "a", Qty: 1}, repoItem{Name: "b", Qty: 2}
+			So(items.Insert(tx, &a), ShouldBeNil)
+			So(items.Insert(tx, &b), ShouldBeNil)
+			So(a.ID, ShouldEqual, 1)
+			So(b.ID, ShouldEqual, 2)
+
+			var got repoItem
+			So(items.Get(tx, &got, b.ID), ShouldBeNil)
+			So(got, ShouldResemble, b)
+			So(items.Get(tx, &got, 99), ShouldEqual, sql.ErrNoRows)
+
+			Convey("and can be listed, counted, updated and deleted", func() {
+				var lis []repoItem
+				So(items.List(tx, &lis, Query{Sort: []string{"id desc"}}), ShouldBeNil)
+				So(lis, ShouldResemble, []repoItem{b, a})
+
+				n, err := items.Count(tx, sq.Gt{"qty": 1})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+
+				a.Qty = 5
+				So(items.Update(tx, &a), ShouldBeNil)
+				So(items.Get(tx, &got, a.ID), ShouldBeNil)
+				So(got.Qty, ShouldEqual, 5)
+
+				So(items.Delete(tx, a.ID), ShouldBeNil)
+				So(items.Delete(tx, a.ID), ShouldEqual, sql.ErrNoRows)
+				So(items.Update(tx, &a), ShouldEqual, sql.ErrNoRows)
+			})
+
+			Convey("upsert inserts new keys and updates known ones", func() {
+				c := repoItem{Name: "c"}
+				So(items.Upsert(tx, &c), ShouldBeNil)
+				So(c.ID, ShouldEqual, 3)
+
+				c.Qty = 7
+				So(items.Upsert(tx, &c), ShouldBeNil)
+				So(items.Get(tx, &got, c.ID), ShouldBeNil)
+				So(got.Qty, ShouldEqual, 7)
+
+				d := repoItem{ID: 10, Name: "d"}
+				So(items.Upsert(tx, &d), ShouldBeNil)
+				So(items.Get(tx, &got, 10), ShouldBeNil)
+				So(got.Name, ShouldEqual, "d")
+
+				n, err := items.Count(tx, nil)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 4)
+			})
+		})
+
+		Convey("composite primary keys are used", func() {
+			tag := repoTag{Space: "s", Name: "n", Note: "one"}
+			So(tags.Insert(tx, &tag), ShouldBeNil)
+
+			tag.Note = "two"
+			So(tags.Upsert(tx, &tag), ShouldBeNil)
+
+			var got repoTag
+			So(tags.Get(tx, &got, "s", "n"), ShouldBeNil)
+			So(got.Note, ShouldEqual, "two")
+			So(tags.Get(tx, &got, "s"), ShouldNotBeNil)
+		})
+
+		Convey("the wrong types are refused", func() {
+			So(items.Insert(tx, repoItem{}), ShouldNotBeNil)
+			So(items.Insert(tx, &repoTag{}), ShouldNotBeNil)
+
+			var lis []repoTag
+			So(items.List(tx, &lis, Query{}), ShouldNotBeNil)
+		})
+	})
+}
+
+type repoRev struct {
+	Key  string `json:"key" db:",PRIMARY" table:"rev"`
+	Rev  int64  `json:"rev" db:",AUTO"`
+	Note string `json:"note"`
+}
+
+func TestRepo_Update(t *testing.T) {
+	Convey("Given a mysql database", t, func() {
+		conn, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		db := DB{Conn: conn, DbType: "mysql", Placeholder: sq.Question}
+		revs := NewRepo(repoRev{})
+		mock.ExpectBegin()
+
+		update := func(o *repoRev) (err error) {
+			return db.TransactionContext(context.Background(), func(tx *Tx) error {
+				return revs.Update(tx, o)
+			})
+		}
+
+		Convey("AUTO columns are not written", func() {
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE rev SET note = ? WHERE key = ?")).
+				WithArgs("one", "a").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			So(update(&repoRev{Key: "a", Rev: 3, Note: "one"}), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("an update that changes nothing finds the row", func() {
+			mock.ExpectExec("UPDATE rev").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT 1 FROM rev WHERE key = ? LIMIT 1")).
+				WithArgs("a").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			mock.ExpectCommit()
+
+			So(update(&repoRev{Key: "a", Note: "one"}), ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("a missing row is not found", func() {
+			mock.ExpectExec("UPDATE rev").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT 1 FROM rev").WillReturnRows(sqlmock.NewRows([]string{"1"}))
+			mock.ExpectRollback()
+
+			So(update(&repoRev{Key: "b", Note: "one"}), ShouldEqual, sql.ErrNoRows)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,197 @@
+package dbm
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"sour.is/x/toolbox/log"
+)
+
+// DefaultMaxRetryBackoff caps the wait between retries when MaxBackoff is not set.
+const DefaultMaxRetryBackoff = 2 * time.Second
+
+// RetryPolicy sets how transactions that fail with an error that can be
+// retried are run again. The zero value does not retry.
+type RetryPolicy struct {
+	// Attempts is the most times a transaction is run.
+	Attempts int
+	// Backoff is the wait before the first retry. It doubles for each
+	// retry up to MaxBackoff. Each wait is jittered down by up to half.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// GetRetryPolicy reads the retry settings under pfx. Durations may be given
+// as a number of milliseconds or as a duration like "50ms".
+func GetRetryPolicy(pfx string) RetryPolicy {
+	return RetryPolicy{
+		Attempts:   viper.GetInt(pfx + ".retry_attempts"),
+		Backoff:    getDuration(pfx+".retry_backoff", time.Millisecond),
+		MaxBackoff: getDuration(pfx+".retry_max_backoff", time.Millisecond),
+	}
+}
+
+// wait returns the jittered wait before the given retry.
+func (p RetryPolicy) wait(retry int) time.Duration {
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxRetryBackoff
+	}
+
+	d := p.Backoff
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type retryKey struct{}
+
+// WithRetry sets the retry policy of transactions started with the
+// context in place of the policy of the database.
+func WithRetry(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, p)
+}
+
+// Retryable reports if err is a transient error of the dialect that can be
+// retried.
+type Retryable func(err error) bool
+
+var retryable = map[string]Retryable{
+	"postgres": func(err error) bool {
+		if s, ok := err.(interface{ SQLState() string }); ok {
+			return s.SQLState() == "40001" || s.SQLState() == "40P01"
+		}
+		msg := err.Error()
+		return strings.Contains(msg, "could not serialize access") ||
+			strings.Contains(msg, "deadlock detected")
+	},
+	"sqlite": func(err error) bool {
+		msg := err.Error()
+		return strings.Contains(msg, "database is locked") ||
+			strings.Contains(msg, "database table is locked") ||
+			strings.Contains(msg, "SQLITE_BUSY")
+	},
+	"mysql": func(err error) bool {
+		msg := err.Error()
+		return strings.HasPrefix(msg, "Error 1213") || strings.HasPrefix(msg, "Error 1205")
+	},
+}
+var retryableMu sync.RWMutex
+
+// RegisterRetryable sets how errors of the dialect are classified. Use it
+// for drivers that report errors that are not found by default.
+func RegisterRetryable(dialect string, fn Retryable) {
+	retryableMu.Lock()
+	defer retryableMu.Unlock()
+
+	retryable[dialect] = fn
+}
+
+// IsRetryable returns true if err is a serialization failure, deadlock or
+// busy error of the dialect.
+func IsRetryable(dialect string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	retryableMu.RLock()
+	fn, ok := retryable[dialect]
+	retryableMu.RUnlock()
+
+	return ok && fn(err)
+}
+
+// RetryStats are the retry counters of a database.
+type RetryStats struct {
+	Name string `json:"name"`
+	// Retries are the transactions run again after a retryable error.
+	Retries uint64 `json:"retries"`
+	// Exhausted are the transactions that failed after the last attempt.
+	Exhausted uint64 `json:"exhausted"`
+}
+
+var retryCounts struct {
+	sync.Mutex
+	m map[string]*RetryStats
+}
+
+func retryCount(name string) *RetryStats {
+	retryCounts.Lock()
+	defer retryCounts.Unlock()
+
+	if retryCounts.m == nil {
+		retryCounts.m = make(map[string]*RetryStats)
+	}
+	s, ok := retryCounts.m[name]
+	if !ok {
+		s = &RetryStats{Name: name}
+		retryCounts.m[name] = s
+	}
+	return s
+}
+
+// GetRetryStats returns the retry counters of each database.
+func GetRetryStats() []RetryStats {
+	retryCounts.Lock()
+	defer retryCounts.Unlock()
+
+	lis := make([]RetryStats, 0, len(retryCounts.m))
+	for _, s := range retryCounts.m {
+		lis = append(lis, RetryStats{
+			Name:      s.Name,
+			Retries:   atomic.LoadUint64(&s.Retries),
+			Exhausted: atomic.LoadUint64(&s.Exhausted),
+		})
+	}
+	sort.Slice(lis, func(i, j int) bool { return lis[i].Name < lis[j].Name })
+
+	return lis
+}
+
+// retry runs txFunc in a new transaction for each attempt until it does not
+// fail with a retryable error. Each attempt is rolled back before the next.
+func (db DB) retry(ctx context.Context, readonly bool, txFunc func(*Tx) error) (err error) {
+	p := db.Retry
+	if v, ok := ctx.Value(retryKey{}).(RetryPolicy); ok {
+		p = v
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = db.run(ctx, readonly, txFunc); err == nil {
+			return nil
+		}
+		if attempt >= p.Attempts || !IsRetryable(db.Dialect(), err) {
+			break
+		}
+
+		atomic.AddUint64(&retryCount(db.Name).Retries, 1)
+		wait := p.wait(attempt)
+		log.Debug("DBM: Retry ", attempt, " in ", wait, ": ", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			log.Error(err.Error())
+			return err
+		}
+	}
+
+	if p.Attempts > 1 && IsRetryable(db.Dialect(), err) {
+		atomic.AddUint64(&retryCount(db.Name).Exhausted, 1)
+	}
+	log.Error(err.Error())
+	return err
+}
@@ -0,0 +1,115 @@
+package dbm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type sqlState string
+
+func (e sqlState) Error() string    { return "pq: error " + string(e) }
+func (e sqlState) SQLState() string { return string(e) }
+
+func TestRetry(t *testing.T) {
+	Convey("Retryable errors are found by dialect", t, func() {
+		tests := []struct {
+			dialect string
+			err     error
+			ok      bool
+		}{
+			{"postgres", sqlState("40001"), true},
+			{"postgres", sqlState("40P01"), true},
+			{"postgres", sqlState("23505"), false},
+			{"postgres", errors.New("pq: deadlock detected"), true},
+			{"sqlite", errors.New("database is locked"), true},
+			{"sqlite", errors.New("no such table: x"), false},
+			{"mysql", errors.New("Error 1213: Deadlock found when trying to get lock"), true},
+			{"mysql", errors.New("Error 1062: Duplicate entry"), false},
+			{"other", errors.New("database is locked"), false},
+			{"sqlite", nil, false},
+		}
+		for _, tt := range tests {
+			So(IsRetryable(tt.dialect, tt.err), ShouldEqual, tt.ok)
+		}
+	})
+
+	Convey("Given a database with a retry policy", t, func() {
+		db := newSqliteDB(t)
+		db.Name = "retry"
+		db.Retry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+		defer db.Conn.Close()
+
+		_, err := db.Conn.Exec("CREATE TABLE item (id INTEGER)")
+		So(err, ShouldBeNil)
+
+		count := func() (n int) {
+			db.Conn.QueryRow("SELECT count(1) FROM item").Scan(&n)
+			return
+		}
+		stats := func() RetryStats {
+			for _, s := range GetRetryStats() {
+				if s.Name == "retry" {
+					return s
+				}
+			}
+			return RetryStats{}
+		}
+		before := stats()
+
+		// failing inserts a row then fails with err for the first n runs.
+		failing := func(n int, err error) (func(*Tx) error, *int) {
+			runs := 0
+			return func(tx *Tx) error {
+				runs++
+				if _, err := tx.Exec("INSERT INTO item VALUES (?)", runs); err != nil {
+					return err
+				}
+				if runs <= n {
+					return err
+				}
+				return nil
+			}, &runs
+		}
+
+		Convey("busy transactions are run again from the start", func() {
+			fn, runs := failing(2, errors.New("database is locked"))
+			So(db.TransactionContext(context.Background(), fn), ShouldBeNil)
+			So(*runs, ShouldEqual, 3)
+			So(count(), ShouldEqual, 1)
+			So(stats().Retries-before.Retries, ShouldEqual, 2)
+		})
+
+		Convey("retries stop after the last attempt", func() {
+			fn, runs := failing(5, errors.New("database is locked"))
+			So(db.TransactionContext(context.Background(), fn), ShouldNotBeNil)
+			So(*runs, ShouldEqual, 3)
+			So(count(), ShouldEqual, 0)
+			So(stats().Exhausted-before.Exhausted, ShouldEqual, 1)
+		})
+
+		Convey("other errors are not retried", func() {
+			fn, runs := failing(1, errors.New("constraint failed"))
+			So(db.TransactionContext(context.Background(), fn), ShouldNotBeNil)
+			So(*runs, ShouldEqual, 1)
+		})
+
+		Convey("the context can turn retries off", func() {
+			fn, runs := failing(1, errors.New("database is locked"))
+			ctx := WithRetry(context.Background(), RetryPolicy{})
+			So(db.TransactionContext(ctx, fn), ShouldNotBeNil)
+			So(*runs, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Waits grow and are jittered", t, func() {
+		p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}
+		for retry, max := range []time.Duration{10, 20, 40, 40} {
+			d := p.wait(retry + 1)
+			So(d, ShouldBeBetweenOrEqual, max*time.Millisecond/2, max*time.Millisecond)
+		}
+	})
+}
@@ -5,11 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"runtime/debug"
-	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"sour.is/x/toolbox/log"
-	"sour.is/x/toolbox/uuid"
 
 	sq "github.com/Masterminds/squirrel"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -25,6 +23,8 @@ type Tx struct {
 }
 
 // NewTx create new transaction
+// Read only transactions use a healthy replica when there are any, unless
+// the context was made with WithPrimary.
 func (db DB) NewTx(ctx context.Context, readonly bool) (tx *Tx, err error) {
 	sp, nctx := opentracing.StartSpanFromContext(ctx, "NewTx")
 	defer sp.Finish()
@@ -37,7 +37,12 @@ func (db DB) NewTx(ctx context.Context, readonly bool) (tx *Tx, err error) {
 
 	tx = new(Tx)
 	tx.Context = nctx
-	tx.Tx, err = db.Conn.BeginTx(nctx, opts)
+	if readonly {
+		tx.Tx = db.replicas.beginRead(nctx, opts)
+	}
+	if tx.Tx == nil {
+		tx.Tx, err = db.Conn.BeginTx(nctx, opts)
+	}
 	tx.Placeholder = db.Placeholder
 	tx.DbType = db.DbType
 	tx.Returns = db.Returns
@@ -45,14 +50,28 @@ func (db DB) NewTx(ctx context.Context, readonly bool) (tx *Tx, err error) {
 	return
 }
 
+// NewTx create new transaction on the default database.
+// The caller is responsible to commit or rollback the transaction.
+func NewTx(ctx context.Context, readonly bool) (tx *Tx, err error) {
+	db, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewTx(ctx, readonly)
+}
+
 // Transaction starts a new database tranaction and executes the supplied func.
 func Transaction(txFunc func(*Tx) error) (err error) {
-	return stdDB.TransactionContext(context.Background(), txFunc)
+	return TransactionContext(context.Background(), txFunc)
 }
 
 // TransactionContext starts a new database tranaction and executes the supplied func with context.
 func TransactionContext(ctx context.Context, txFunc func(*Tx) error) (err error) {
-	return stdDB.TransactionContext(ctx, txFunc)
+	db, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return db.TransactionContext(ctx, txFunc)
 }
 
 // Transaction starts a new database transction and executes the supplied func.
@@ -61,46 +80,31 @@ func (db DB) Transaction(fn func(*Tx) error) error {
 }
 
 // TransactionContext starts a new database transction with context and executes the supplied func.
+// Failures that can be retried are retried under the retry policy.
 func (db DB) TransactionContext(ctx context.Context, txFunc func(*Tx) error) (err error) {
-	tx, err := db.NewTx(ctx, false)
-
-	if err != nil {
-		log.Error(err.Error())
-		return
-	}
-	defer func() {
-		if p := recover(); p != nil {
-			switch p := p.(type) {
-			case error:
-				err = p
-			default:
-				err = fmt.Errorf("%s", p)
-			}
-		}
-		if err != nil {
-			tx.Rollback()
-			log.Error(err.Error())
-
-			debug.PrintStack()
-			return
-		}
-		err = tx.Commit()
-	}()
-	err = txFunc(tx)
-	return err
+	return db.retry(ctx, false, txFunc)
 }
 
 // QueryContext starts a new database tranaction and executes the supplied func with context.
 func QueryContext(ctx context.Context, txFunc func(*Tx) error) (err error) {
-	return stdDB.QueryContext(ctx, txFunc)
+	db, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return db.QueryContext(ctx, txFunc)
 }
 
 // QueryContext starts a new database transction with context and executes the supplied func.
+// Failures that can be retried are retried under the retry policy.
 func (db DB) QueryContext(ctx context.Context, txFunc func(*Tx) error) (err error) {
-	tx, err := db.NewTx(ctx, true)
+	return db.retry(ctx, true, txFunc)
+}
 
+// run executes txFunc in a new transaction. It is committed if txFunc
+// returns without error and rolled back otherwise.
+func (db DB) run(ctx context.Context, readonly bool, txFunc func(*Tx) error) (err error) {
+	tx, err := db.NewTx(ctx, readonly)
 	if err != nil {
-		log.Error(err.Error())
 		return
 	}
 	defer func() {
@@ -111,12 +115,10 @@ func (db DB) QueryContext(ctx context.Context, txFunc func(*Tx) error) (err erro
 			default:
 				err = fmt.Errorf("%s", p)
 			}
+			debug.PrintStack()
 		}
 		if err != nil {
 			tx.Rollback()
-			log.Error(err.Error())
-
-			debug.PrintStack()
 			return
 		}
 		err = tx.Commit()
@@ -127,7 +129,11 @@ func (db DB) QueryContext(ctx context.Context, txFunc func(*Tx) error) (err erro
 
 // Transactionx starts a new database tranaction and executes the supplied func.
 func Transactionx(txFunc func(*sqlx.Tx) error) (err error) {
-	return stdDB.Transactionx(txFunc)
+	db, err := getDefault()
+	if err != nil {
+		return err
+	}
+	return db.Transactionx(txFunc)
 }
 
 // Transactionx starts a new database tranaction and executes the supplied func.
@@ -160,81 +166,3 @@ func (db DB) Transactionx(txFunc func(*sqlx.Tx) error) (err error) {
 	err = txFunc(tx)
 	return err
 }
-
-// TransactionContinue returns a transaction that can be continued by suppling the
-// TxID that gets passed into the txFunc.
-func TransactionContinue(TxID string, txFunc func(*Tx, string) error) (err error) {
-	return stdDB.TransactionContinue(TxID, txFunc)
-}
-
-// TransactionContinue returns a transaction that can be continued by suppling the
-// TxID that gets passed into the txFunc.
-func (db DB) TransactionContinue(TxID string, txFunc func(*Tx, string) error) (err error) {
-	var tx *Tx
-
-	if TxID == "" {
-
-		TxID = uuid.V4()
-		tx, err = db.NewTx(context.Background(), false)
-		if err != nil {
-			log.Error(err.Error())
-			return
-		}
-		txSet(TxID, tx)
-
-	} else {
-		if tx = txGet(TxID); tx != nil {
-			err = txFunc(tx, TxID)
-			return err
-		}
-		return fmt.Errorf("unable to find tx %s", TxID)
-	}
-
-	defer func() {
-		if p := recover(); p != nil {
-			switch p := p.(type) {
-			case error:
-				err = p
-			default:
-				err = fmt.Errorf("%s", p)
-			}
-		}
-
-		if err != nil {
-			tx.Rollback()
-			log.Error(err.Error())
-
-			debug.PrintStack()
-			return
-		}
-
-		err = tx.Commit()
-		if err != nil {
-			log.Error(err.Error())
-		}
-
-		txRm(TxID)
-	}()
-
-	err = txFunc(tx, TxID)
-	return err
-}
-
-var txMap = make(map[string]*Tx)
-var txMutex = sync.Mutex{}
-
-func txSet(id string, tx *Tx) {
-	txMutex.Lock()
-	defer txMutex.Unlock()
-	txMap[id] = tx
-}
-func txGet(id string) *Tx {
-	txMutex.Lock()
-	defer txMutex.Unlock()
-	return txMap[id]
-}
-func txRm(id string) {
-	txMutex.Lock()
-	defer txMutex.Unlock()
-	delete(txMap, id)
-}
@@ -0,0 +1,164 @@
+package dbm
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type upsertSpace struct {
+	ID    int64  `json:"id" db:",AUTO" table:"space"`
+	Space string `json:"space" db:",SECONDARY"`
+	Note  string `json:"note"`
+}
+
+func TestUpsert(t *testing.T) {
+	d := GetDbInfo(upsertSpace{})
+
+	Convey("Given a database", t, func() {
+		db := newSqliteDB(t)
+		defer db.Conn.Close()
+
+		_, err := db.Conn.Exec(`CREATE TABLE space (id INTEGER PRIMARY KEY AUTOINCREMENT, space TEXT UNIQUE, note TEXT)`)
+		So(err, ShouldBeNil)
+
+		upsert := func(o *upsertSpace) error {
+			return db.Transaction(func(tx *Tx) error {
+				return tx.Upsert(d, o, map[string]interface{}{"space": o.Space, "note": o.Note})
+			})
+		}
+
+		Convey("rows are inserted then updated on the secondary key", func() {
+			a := upsertSpace{Space: "a", Note: "one"}
+			So(upsert(&a), ShouldBeNil)
+			So(a.ID, ShouldEqual, 1)
+
+			b := upsertSpace{Space: "b"}
+			So(upsert(&b), ShouldBeNil)
+			So(b.ID, ShouldEqual, 2)
+
+			again := upsertSpace{Space: "a", Note: "two"}
+			So(upsert(&again), ShouldBeNil)
+			So(again.ID, ShouldEqual, 1)
+
+			var note string
+			So(db.Conn.QueryRow("SELECT note FROM space WHERE id = 1").Scan(&note), ShouldBeNil)
+			So(note, ShouldEqual, "two")
+		})
+
+		Convey("a set without any key is refused", func() {
+			err := db.Transaction(func(tx *Tx) error {
+				return tx.Upsert(d, &upsertSpace{}, map[string]interface{}{"note": "x"})
+			})
+			So(err, ShouldEqual, ErrNoPrimary)
+		})
+	})
+
+	Convey("The statement is built for each dialect", t, func() {
+		tests := []struct {
+			dbType string
+			ph     sq.PlaceholderFormat
+			want   string
+		}{
+			{"sqlite3", sq.Question, `INSERT INTO space (note,space) VALUES (?,?) ON CONFLICT ("space") DO UPDATE SET "note" = EXCLUDED."note"`},
+			{"postgres", sq.Dollar, `INSERT INTO space (note,space) VALUES ($1,$2) ON CONFLICT ("space") DO UPDATE SET "note" = EXCLUDED."note" RETURNING "id"`},
+			{"mysql", sq.Question, "INSERT INTO space (note,space) VALUES (?,?) ON DUPLICATE KEY UPDATE `note` = VALUES(`note`)"},
+		}
+		for _, tt := range tests {
+			conn, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+
+			mock.ExpectBegin()
+			if tt.dbType == "postgres" {
+				mock.ExpectQuery(regexp.QuoteMeta(tt.want)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			} else {
+				mock.ExpectExec(regexp.QuoteMeta(tt.want)).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT id FROM space").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			}
+			mock.ExpectCommit()
+
+			db := DB{Conn: conn, DbType: tt.dbType, Placeholder: tt.ph, Returns: tt.dbType == "postgres"}
+			err = db.Transaction(func(tx *Tx) error {
+				return tx.Upsert(d, &upsertSpace{}, map[string]interface{}{"space": "a", "note": "x"})
+			})
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+			conn.Close()
+		}
+	})
+
+	Convey("Given key fields", t, func() {
+		conn, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		db := DB{Conn: conn, DbType: "postgres", Placeholder: sq.Dollar, Returns: true}
+		mock.ExpectBegin()
+
+		Convey("the conflict is on their columns", func() {
+			mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO space (id,note,space) VALUES ($1,$2,$3) ON CONFLICT ("id") DO UPDATE SET "note" = EXCLUDED."note", "space" = EXCLUDED."space" RETURNING "id"`)).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+			mock.ExpectCommit()
+
+			o := upsertSpace{ID: 5, Space: "a", Note: "x"}
+			err := db.Transaction(func(tx *Tx) error {
+				return NewRepo(upsertSpace{}).Upsert(tx, &o)
+			})
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("they must be set", func() {
+			mock.ExpectRollback()
+
+			err := db.Transaction(func(tx *Tx) error {
+				return tx.Upsert(d, &upsertSpace{}, map[string]interface{}{"space": "a"}, "ID")
+			})
+			So(err, ShouldNotBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given concurrent writers", t, func() {
+		conn, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "upsert.db")+"?_busy_timeout=10000&_txlock=immediate")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		conn.SetMaxOpenConns(8)
+
+		db := DB{Conn: conn, DbType: "sqlite3", Placeholder: sq.Question}
+		_, err = conn.Exec(`CREATE TABLE space (id INTEGER PRIMARY KEY AUTOINCREMENT, space TEXT UNIQUE, note TEXT)`)
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 40)
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				o := upsertSpace{Space: fmt.Sprint("s", i%4), Note: fmt.Sprint(i)}
+				errs <- db.Transaction(func(tx *Tx) error {
+					return tx.Upsert(d, &o, map[string]interface{}{"space": o.Space, "note": o.Note})
+				})
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		Convey("no duplicate rows are written", func() {
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+
+			var n int
+			So(conn.QueryRow("SELECT count(1) FROM space").Scan(&n), ShouldBeNil)
+			So(n, ShouldEqual, 4)
+		})
+	})
+}
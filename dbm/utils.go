@@ -3,6 +3,7 @@ package dbm
 import (
 	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 
 	sq "github.com/Masterminds/squirrel"
@@ -139,6 +140,8 @@ func (tx *Tx) Delete(table string) sq.DeleteBuilder {
 }
 
 // Replace begin new replace statement.
+// It counts the rows of where before it writes so concurrent callers can
+// both insert. Use Upsert to write in one statement.
 func (tx *Tx) Replace(
 	d DbInfo,
 	o interface{},
@@ -249,9 +252,141 @@ func (tx *Tx) Replace(
 	return
 }
 
-// Ping attempt a connection to database
+// Upsert inserts the set columns into the table of d or updates the other
+// set columns of the row they conflict with. The conflict is on the columns
+// of the key fields, which must all be in set. Without key fields it is on
+// the first of the PRIMARY, SECONDARY or AUTO columns that are all in set.
+// The AUTO columns of the row are scanned into o.
+func (tx *Tx) Upsert(d DbInfo, o interface{}, set map[string]interface{}, key ...string) (err error) {
+	keys, err := d.conflictKeys(set, key)
+	if err != nil {
+		return
+	}
+
+	quote := func(s string) string { return `"` + s + `"` }
+	if strings.Contains(tx.DbType, "mysql") {
+		quote = func(s string) string { return "`" + s + "`" }
+	}
+
+	var cols []string
+	for col := range set {
+		if !hasString(keys, col) {
+			cols = append(cols, col)
+		}
+	}
+	sort.Strings(cols)
+
+	var suffix string
+	if strings.Contains(tx.DbType, "mysql") {
+		if len(cols) == 0 {
+			cols = keys[:1]
+		}
+		var lis []string
+		for _, col := range cols {
+			lis = append(lis, quote(col)+" = VALUES("+quote(col)+")")
+		}
+		suffix = "ON DUPLICATE KEY UPDATE " + strings.Join(lis, ", ")
+	} else {
+		if len(cols) == 0 {
+			// Update a key to itself so the row is still returned.
+			cols = keys[:1]
+		}
+		var quoted, lis []string
+		for _, col := range keys {
+			quoted = append(quoted, quote(col))
+		}
+		for _, col := range cols {
+			lis = append(lis, quote(col)+" = EXCLUDED."+quote(col))
+		}
+		suffix = "ON CONFLICT (" + strings.Join(quoted, ", ") + ") DO UPDATE SET " + strings.Join(lis, ", ")
+	}
+
+	insert := tx.Insert(d.Table).SetMap(set).Suffix(suffix)
+
+	var auto []string
+	var dest []interface{}
+	if len(d.Auto) > 0 {
+		if auto, dest, err = d.StructMap(o, d.Auto); err != nil {
+			return
+		}
+	}
+
+	if tx.Returns && len(auto) > 0 {
+		insert = insert.Suffix(`RETURNING "` + strings.Join(auto, `","`) + `"`)
+
+		s, a, _ := insert.ToSql()
+		log.Debugs("Upsert", "sql", s, "args", a, "return", d.Auto)
+
+		return insert.QueryRowContext(tx.Context).Scan(dest...)
+	}
+
+	s, a, _ := insert.ToSql()
+	log.Debugs("Upsert", "sql", s, "args", a)
+
+	if _, err = insert.ExecContext(tx.Context); err != nil || len(auto) == 0 {
+		return
+	}
+
+	where := sq.Eq{}
+	for _, col := range keys {
+		where[col] = set[col]
+	}
+	return tx.Select(auto, d.View).Where(where).QueryRowContext(tx.Context).Scan(dest...)
+}
+
+// conflictKeys returns the columns of the key fields, or of the first of
+// the PRIMARY, SECONDARY or AUTO fields that are all in set.
+func (d DbInfo) conflictKeys(set map[string]interface{}, key []string) ([]string, error) {
+	if len(key) > 0 {
+		keys := make([]string, len(key))
+		for i, field := range key {
+			col, err := d.Col(field)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := set[col]; !ok {
+				return nil, fmt.Errorf("DBM: upsert key %s is not set", field)
+			}
+			keys[i] = col
+		}
+		return keys, nil
+	}
+
+	for _, fields := range [][]string{d.Primary, d.Secondary, d.Auto} {
+		if len(fields) == 0 {
+			continue
+		}
+
+		var keys []string
+		for _, field := range fields {
+			col, err := d.Col(field)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := set[col]; !ok {
+				break
+			}
+			keys = append(keys, col)
+		}
+		if len(keys) == len(fields) {
+			return keys, nil
+		}
+	}
+	return nil, ErrNoPrimary
+}
+
+// Ping attempt a connection to the default database
 func Ping() bool {
-	err := stdDB.Conn.Ping()
+	return Default().Ping()
+}
+
+// Ping attempt a connection to database
+func (db DB) Ping() bool {
+	if db.Conn == nil {
+		return false
+	}
+
+	err := db.Conn.Ping()
 	if err != nil {
 		log.Error(err)
 		return false
@@ -1,6 +1,6 @@
 module sour.is/x/toolbox
 
-go 1.12
+go 1.18
 
 require (
 	github.com/99designs/gqlgen v0.10.1
@@ -9,24 +9,36 @@ require (
 	github.com/Masterminds/squirrel v0.0.0-20190511014652-b4b75d10d7bf
 	github.com/bouk/monkey v1.0.0
 	github.com/cgilling/dbstats v0.0.0-20150427045024-c9db8cf218e6
-	github.com/go-sql-driver/mysql v1.4.1 // indirect
 	github.com/golang/gddo v0.0.0-20190815223733-287de01127ef
-	github.com/gopherjs/gopherjs v0.0.0-20190812055157-5d271430af9f // indirect
 	github.com/gorilla/mux v1.7.3
 	github.com/jmoiron/sqlx v0.0.0-20150110152746-69738bd20981
+	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/opentracing/opentracing-go v1.1.0
+	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/smartystreets/goconvey v0.0.0-20170602164621-9e8dc3f972df
+	github.com/spf13/viper v1.4.0
+	github.com/yosssi/gmq v0.0.1
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/go-sql-driver/mysql v1.4.1 // indirect
+	github.com/gopherjs/gopherjs v0.0.0-20190812055157-5d271430af9f // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/lann/builder v0.0.0-20180802200727-47ae307949d0 // indirect
+	github.com/lann/ps v0.0.0-20150810152359-62de8c46ede0 // indirect
 	github.com/lib/pq v1.2.0 // indirect
 	github.com/magiconair/properties v1.8.1 // indirect
-	github.com/mattn/go-sqlite3 v1.11.0 // indirect
-	github.com/opentracing/opentracing-go v1.1.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/pelletier/go-toml v1.5.0 // indirect
 	github.com/smartystreets/assertions v0.0.0-20190401211740-f487f9de1cd3 // indirect
-	github.com/smartystreets/goconvey v0.0.0-20170602164621-9e8dc3f972df
 	github.com/spf13/afero v1.2.2 // indirect
+	github.com/spf13/cast v1.3.0 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/spf13/viper v1.4.0
-	github.com/yosssi/gmq v0.0.1
+	github.com/vektah/gqlparser v1.1.2 // indirect
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
 	golang.org/x/text v0.3.8 // indirect
+	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
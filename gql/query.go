@@ -5,5 +5,6 @@ type QueryInput struct {
 	Search *string  `json:"search"`
 	Limit  *uint64  `json:"limit"`
 	Offset *uint64  `json:"offset"`
+	After  *string  `json:"after"`
 	Sort   []string `json:"sort"`
 }
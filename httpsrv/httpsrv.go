@@ -143,6 +143,8 @@ func Config() {
 			{"Files", path, http.Dir(dir)},
 		})
 	}
+
+	ConfigMiddleware()
 }
 
 // RegisterModule stores a module
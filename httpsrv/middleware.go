@@ -2,7 +2,10 @@ package httpsrv
 
 import (
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/spf13/viper"
 	"sour.is/x/toolbox/ident"
 )
 
@@ -52,7 +55,12 @@ type MiddlewareList []Middleware
 // MiddlewareSet is a set of middlewares grouped by Event lifecycle
 var MiddlewareSet = make(map[Event][]Middleware)
 
+var middlewareMu sync.RWMutex
+
 func runMiddleware(e Event, name string, w ResponseWriter, r *http.Request, id ident.Ident) (ok bool) {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+
 	ok = true
 
 	for _, m := range MiddlewareSet[e] {
@@ -128,5 +136,38 @@ func (m Middleware) SetBlacklist(whitelist []string) Middleware {
 
 // Register inserts the middleware into the lifecycle map
 func (m Middleware) Register(event Event) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
 	MiddlewareSet[event] = append(MiddlewareSet[event], m)
 }
+
+// ConfigMiddleware reads the white and black lists of registered middleware
+// from http.middleware.<name>.whitelist and http.middleware.<name>.blacklist.
+// It may be called again to apply changed settings.
+func ConfigMiddleware() {
+	ConfigMiddlewareFrom(viper.GetViper())
+}
+
+// ConfigMiddlewareFrom sets the middleware whitelists and blacklists from settings.
+func ConfigMiddlewareFrom(settings *viper.Viper) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	for _, lis := range MiddlewareSet {
+		for i, m := range lis {
+			pfx := "http.middleware." + strings.ToLower(m.Name)
+
+			if settings.IsSet(pfx + ".whitelist") {
+				m.Whitelist = make(map[string]bool)
+				m = m.SetWhitelist(settings.GetStringSlice(pfx + ".whitelist"))
+			}
+			if settings.IsSet(pfx + ".blacklist") {
+				m.Blacklist = make(map[string]bool)
+				m = m.SetBlacklist(settings.GetStringSlice(pfx + ".blacklist"))
+			}
+
+			lis[i] = m
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ReadyFunc returns an error when a dependency is not ready to serve.
+type ReadyFunc func() error
+
+var readiness struct {
+	sync.Mutex
+	checks map[string]ReadyFunc
+}
+
+// RegisterReady adds a check to the readiness endpoint.
+func RegisterReady(name string, fn ReadyFunc) {
+	readiness.Lock()
+	defer readiness.Unlock()
+
+	if readiness.checks == nil {
+		readiness.checks = make(map[string]ReadyFunc)
+	}
+	readiness.checks[name] = fn
+}
+
+// Ready runs the checks and returns the errors of those that fail by name.
+func Ready() map[string]error {
+	readiness.Lock()
+	checks := make(map[string]ReadyFunc, len(readiness.checks))
+	for name, fn := range readiness.checks {
+		checks[name] = fn
+	}
+	readiness.Unlock()
+
+	failed := make(map[string]error)
+	for name, fn := range checks {
+		if err := fn(); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed
+}
+
+func init() {
+	HttpRegister("ready", HttpRoutes{
+		{"get-ready", "GET", "/ready", getReady},
+	})
+}
+
+// swagger:operation GET /ready ready get-ready
+//
+// Get Readiness
+//
+// Returns the status of each readiness check. The status is 503 if any fail.
+//
+// ---
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Ready
+//   "503":
+//     description: Not ready
+func getReady(w http.ResponseWriter, _ *http.Request) {
+	failed := Ready()
+
+	readiness.Lock()
+	names := make([]string, 0, len(readiness.checks))
+	for name := range readiness.checks {
+		names = append(names, name)
+	}
+	readiness.Unlock()
+	sort.Strings(names)
+
+	status := make(map[string]string, len(names))
+	for _, name := range names {
+		status[name] = "ok"
+		if err, ok := failed[name]; ok {
+			status[name] = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(status)
+}
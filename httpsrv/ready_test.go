@@ -0,0 +1,41 @@
+package httpsrv
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReady(t *testing.T) {
+	Convey("Given readiness checks", t, func() {
+		var down error
+		RegisterReady("test", func() error { return down })
+		Reset(func() {
+			readiness.Lock()
+			delete(readiness.checks, "test")
+			readiness.Unlock()
+		})
+
+		get := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			getReady(w, httptest.NewRequest("GET", "/ready", nil))
+			return w
+		}
+
+		Convey("it is ready when they pass", func() {
+			w := get()
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldContainSubstring, `"test":"ok"`)
+		})
+
+		Convey("it is not ready when one fails", func() {
+			down = errors.New("down")
+			w := get()
+			So(w.Code, ShouldEqual, 503)
+			So(w.Body.String(), ShouldContainSubstring, `"test":"down"`)
+			So(Ready(), ShouldContainKey, "test")
+		})
+	})
+}
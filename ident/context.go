@@ -56,6 +56,11 @@ func SetContextIdent(ctx context.Context, s Ident) {
 }
 
 // GetContextIdent returns a user object from session
+// or nil if the context has no ident manager.
 func GetContextIdent(ctx context.Context) (s Ident) {
-	return ctx.Value(ManagerKey).(*Manager).Ident
+	m, ok := ctx.Value(ManagerKey).(*Manager)
+	if !ok {
+		return nil
+	}
+	return *m.GetIdent()
 }
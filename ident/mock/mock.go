@@ -104,18 +104,18 @@ func (m User) GetDisplay() string {
 	return m.name
 }
 
-// GetGroups returns empty list
+// GetGroups returns the groups
 func (m User) GetGroups() []string {
-	lis := make([]string, 0, len(m.roles))
-	for i := range m.roles {
+	lis := make([]string, 0, len(m.groups))
+	for i := range m.groups {
 		lis = append(lis, i)
 	}
 	return lis
 }
 
-// GetRoles returns empty list
+// GetRoles returns the roles
 func (m User) GetRoles() []string {
-	lis := make([]string, 0, len(m.groups))
+	lis := make([]string, 0, len(m.roles))
 	for i := range m.roles {
 		lis = append(lis, i)
 	}
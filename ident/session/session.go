@@ -2,6 +2,7 @@ package session // import "sour.is/x/toolbox/ident/session"
 
 import (
 	"net/http"
+	"sync"
 	"time"
 
 	"strings"
@@ -22,6 +23,9 @@ var userGroups map[string][]string
 var sessionExpire = 10 * time.Minute
 var cookieExpire = 24 * time.Hour
 
+// mu guards the settings so Config can be called again while serving.
+var mu sync.RWMutex
+
 func init() {
 	store = cache.New(cookieExpire, 30*time.Second)
 
@@ -39,33 +43,46 @@ type User struct {
 	Meta   map[string]string   `json:"meta"`
 }
 
-// Config sets up the session module
+// Config sets up the session module.
+// It may be called again to apply changed settings.
 func Config() {
-	if viper.IsSet("idm.session.user-roles") {
-		userRoles = viper.GetStringMapStringSlice("idm.session.user-roles")
+	ConfigFrom(viper.GetViper())
+}
+
+// ConfigFrom sets the session roles, groups and cookies from settings.
+func ConfigFrom(settings *viper.Viper) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if settings.IsSet("idm.session.user-roles") {
+		userRoles = settings.GetStringMapStringSlice("idm.session.user-roles")
 	}
-	if viper.IsSet("idm.session.user-groups") {
-		userGroups = viper.GetStringMapStringSlice("idm.session.user-groups")
+	if settings.IsSet("idm.session.user-groups") {
+		userGroups = settings.GetStringMapStringSlice("idm.session.user-groups")
 	}
-	if viper.IsSet("idm.session.group-roles") {
-		groupRoles = viper.GetStringMapStringSlice("idm.session.group-roles")
+	if settings.IsSet("idm.session.group-roles") {
+		groupRoles = settings.GetStringMapStringSlice("idm.session.group-roles")
 	}
-	if viper.IsSet("idm.session.cookie") {
-		cookieName = viper.GetString("idm.session.cookie")
+	if settings.IsSet("idm.session.cookie") {
+		cookieName = settings.GetString("idm.session.cookie")
 	}
-	if viper.IsSet("idm.session.cookie-ttl") {
-		cookieExpire = time.Duration(viper.GetInt64("idm.session.cookie-ttl")) * time.Minute
+	if settings.IsSet("idm.session.cookie-ttl") {
+		cookieExpire = time.Duration(settings.GetInt64("idm.session.cookie-ttl")) * time.Minute
 	}
-	if viper.IsSet("idm.session.session-ttl") {
-		sessionExpire = time.Duration(viper.GetInt64("idm.session.cookie-ttl")) * time.Minute
+	if settings.IsSet("idm.session.session-ttl") {
+		sessionExpire = time.Duration(settings.GetInt64("idm.session.session-ttl")) * time.Minute
 	}
 }
 
 // httpSessionId attempts to read a session id out of request
 func httpSessionID(r *http.Request) string {
 
+	mu.RLock()
+	name := cookieName
+	mu.RUnlock()
+
 	// Try reading from cookies
-	cookie, err := r.Cookie(cookieName)
+	cookie, err := r.Cookie(name)
 	if err != nil {
 		// do nothing.
 	}
@@ -101,8 +118,10 @@ func GetSessionID(id string) ident.Ident {
 
 	if user, ok := store.Get(id); ok == true {
 		u := user.(User)
+		mu.RLock()
 		store.Set(u.Meta["session"], u, sessionExpire)
 		store.Set(u.Meta["cookie"], u, cookieExpire)
+		mu.RUnlock()
 
 		return u
 	}
@@ -116,6 +135,9 @@ func NewSession(ident, aspect, display string, groups []string, roles []string,
 		meta = make(map[string]string)
 	}
 
+	mu.RLock()
+	defer mu.RUnlock()
+
 	if g, ok := userGroups[ident]; ok {
 		groups = append(groups, g...)
 	}
@@ -237,6 +259,9 @@ func (u User) GetDisplay() string {
 
 // GetCookie returns a formated cookie value
 func (u User) GetCookie() *http.Cookie {
+	mu.RLock()
+	defer mu.RUnlock()
+
 	return &http.Cookie{
 		Name:     cookieName,
 		Value:    u.Meta["cookie"],
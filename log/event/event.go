@@ -2,6 +2,7 @@ package event
 
 import (
 	"fmt"
+	"strings"
 
 	"sour.is/x/toolbox/log/tag"
 )
@@ -60,6 +61,28 @@ func (e Level) String() string {
 	}
 }
 
+// ParseLevel returns the level for a name such as debug, info or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "none":
+		return VerbNone, nil
+	case "critical", "crit":
+		return VerbCritical, nil
+	case "error", "err":
+		return VerbError, nil
+	case "warning", "warn":
+		return VerbWarning, nil
+	case "notice", "note":
+		return VerbNotice, nil
+	case "info":
+		return VerbInfo, nil
+	case "debug", "dbug":
+		return VerbDebug, nil
+	default:
+		return VerbNone, fmt.Errorf("unknown log level: %s", s)
+	}
+}
+
 // Event is a log unit
 type Event struct {
 	Level   Level    `json:"level"`
@@ -0,0 +1,70 @@
+package mercury
+
+import (
+	"context"
+
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+)
+
+// AdaptHandler converts a Handler to HandlerV2.
+// The handler is not able to be cancelled and never returns read errors,
+// but HandlerList will stop waiting on it once the context is done.
+func AdaptHandler(h Handler) HandlerV2 {
+	return handlerAdapter{h}
+}
+
+type handlerAdapter struct {
+	Handler
+}
+
+// GetIndex implements HandlerV2
+func (a handlerAdapter) GetIndex(ctx context.Context, search NamespaceSearch, pgm *rsql.Program) (Config, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Handler.GetIndex(search, pgm), nil
+}
+
+// GetIndexPage implements IndexPagerV2
+func (a handlerAdapter) GetIndexPage(ctx context.Context, search NamespaceSearch, pgm *rsql.Program, page Page) (Config, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if pager, ok := a.Handler.(IndexPager); ok {
+		return pager.GetIndexPage(search, pgm, page), nil
+	}
+	return a.Handler.GetIndex(search, pgm), nil
+}
+
+// GetObjects implements HandlerV2
+func (a handlerAdapter) GetObjects(ctx context.Context, search NamespaceSearch, pgm *rsql.Program, fields []string) (Config, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Handler.GetObjects(search, pgm, fields), nil
+}
+
+// WriteObjects implements HandlerV2
+func (a handlerAdapter) WriteObjects(ctx context.Context, lis Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Handler.WriteObjects(lis)
+}
+
+// GetRules implements HandlerV2
+func (a handlerAdapter) GetRules(ctx context.Context, user ident.Ident) (Rules, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Handler.GetRules(user), nil
+}
+
+// GetNotify implements HandlerV2
+func (a handlerAdapter) GetNotify(ctx context.Context, event string) (ListNotify, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Handler.GetNotify(event), nil
+}
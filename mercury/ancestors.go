@@ -0,0 +1,98 @@
+package mercury
+
+import (
+	"context"
+
+	"sour.is/x/toolbox/ident"
+)
+
+// Ancestry is the chain of spaces that a space inherits from and the
+// merged view of them.
+type Ancestry struct {
+	// Chain holds the ancestors that exist from the least to the most specific.
+	Chain Config `json:"chain"`
+	// Merged is the chain merged with the most specific values winning.
+	Merged *Space `json:"merged"`
+}
+
+// Merge combines the spaces in order so values of later spaces replace
+// values of the same name in earlier ones. Tags are combined and the last
+// notes set are kept. Values are kept in the order first seen.
+func (lis Config) Merge(space string) *Space {
+	out := NewSpace(space)
+
+	idx := make(map[string]int)
+	for _, s := range lis {
+		out.Tags = unionStrings(out.Tags, s.Tags)
+		if len(s.Notes) > 0 {
+			out.Notes = s.Notes
+		}
+
+		for _, v := range s.List {
+			v.Space = space
+			if i, ok := idx[v.Name]; ok {
+				out.List[i] = v
+				continue
+			}
+
+			idx[v.Name] = len(out.List)
+			out.List = append(out.List, v)
+		}
+	}
+
+	for i := range out.List {
+		out.List[i].Seq = uint64(i)
+	}
+
+	return out
+}
+
+// Resolve returns the ancestors of the space the user can read in order of
+// specificity and the merged view of them. Each handler is asked for the
+// ancestors it holds. If a space is held by more than one handler the
+// highest priority one is used.
+func Resolve(ctx context.Context, user ident.Ident, space string) (*Ancestry, error) {
+	// Handler failures are returned with the results of the others.
+	var partial HandlerErrors
+
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	lis, err := Registry.GetObjectsContext(ctx, NamespaceSearch{NamespaceTrace(space)}.String(), "", "")
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	lis, err = rules.filterSpace(lis)
+	if err != nil {
+		return nil, err
+	}
+	lis = rules.Redact(lis)
+
+	// Results are in handler priority order so the first of each space wins.
+	found := make(SpaceMap, len(lis))
+	for _, s := range lis {
+		if _, ok := found[s.Space]; !ok {
+			found[s.Space] = s
+		}
+	}
+
+	a := &Ancestry{Chain: Config{}}
+	for _, name := range Ancestors(space) {
+		if s, ok := found[name]; ok {
+			a.Chain = append(a.Chain, s)
+		}
+	}
+	a.Merged = a.Chain.Merge(space)
+
+	if len(partial) > 0 {
+		return a, partial
+	}
+	return a, nil
+}
@@ -0,0 +1,93 @@
+package mercury
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident/mock"
+)
+
+func TestAncestors(t *testing.T) {
+	Convey("Given a space", t, func() {
+		So(Ancestors("svc.api.prod.host1"), ShouldResemble, []string{"svc", "svc.api", "svc.api.prod", "svc.api.prod.host1"})
+		So(Ancestors("svc"), ShouldResemble, []string{"svc"})
+		So(Ancestors(""), ShouldBeEmpty)
+
+		Convey("a trace matches only its ancestors", func() {
+			search := ParseNamespace("trace:svc.api.prod")
+			So(search, ShouldResemble, NamespaceSearch{NamespaceTrace("svc.api.prod")})
+
+			for _, s := range []string{"svc", "svc.api", "svc.api.prod"} {
+				So(search.Match(s), ShouldBeTrue)
+			}
+			for _, s := range []string{"sv", "svc.ap", "svc.api.prod.host1", "svc.other"} {
+				So(search.Match(s), ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestConfig_Merge(t *testing.T) {
+	Convey("Given a chain of spaces", t, func() {
+		chain := Config{
+			{Space: "svc", Tags: []string{"a"}, Notes: []string{"root"}, List: []Value{
+				{Name: "port", Values: []string{"80"}},
+				{Name: "log", Values: []string{"info"}},
+			}},
+			{Space: "svc.api", Tags: []string{"b"}, List: []Value{
+				{Name: "log", Values: []string{"debug"}},
+				{Name: "path", Values: []string{"/api"}},
+			}},
+		}
+
+		merged := chain.Merge("svc.api.prod")
+		So(merged.Space, ShouldEqual, "svc.api.prod")
+		So(merged.Tags, ShouldResemble, []string{"a", "b"})
+		So(merged.Notes, ShouldResemble, []string{"root"})
+		So(merged.List, ShouldResemble, []Value{
+			{Space: "svc.api.prod", Seq: 0, Name: "port", Values: []string{"80"}},
+			{Space: "svc.api.prod", Seq: 1, Name: "log", Values: []string{"debug"}},
+			{Space: "svc.api.prod", Seq: 2, Name: "path", Values: []string{"/api"}},
+		})
+	})
+}
+
+func TestResolve(t *testing.T) {
+	Convey("Given ancestors held by different handlers", t, func() {
+		root := newMemHandler()
+		root.spaces["svc"] = &Space{Space: "svc", List: []Value{{Name: "port", Values: []string{"80"}}}}
+
+		leaf := newMemHandler()
+		leaf.spaces["svc.api.prod"] = &Space{Space: "svc.api.prod", List: []Value{{Name: "port", Values: []string{"8080"}}}}
+		leaf.spaces["svc.api.prod.host1"] = &Space{Space: "svc.api.prod.host1", List: []Value{{Name: "host", Values: []string{"host1"}}}}
+		leaf.spaces["svc.api.other"] = &Space{Space: "svc.api.other", Notes: []string{"not an ancestor"}}
+
+		rules := Rules{{Role: "read", Type: "NS", Match: "svc"}, {Role: "read", Type: "NS", Match: "svc.*"}}
+
+		old := Registry
+		Registry = HandlerList{
+			{Match: "svc.api.*", Priority: 2, HandlerV2: leaf},
+			{Match: "svc", Priority: 1, HandlerV2: rulesHandler{root, rules}},
+		}
+		Reset(func() { Registry = old })
+
+		user := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+
+		Convey("the chain is in order of specificity", func() {
+			a, err := Resolve(context.Background(), user, "svc.api.prod.host1")
+			So(err, ShouldBeNil)
+			So(a.Chain.StringList(), ShouldEqual, "svc\nsvc.api.prod\nsvc.api.prod.host1\n")
+			So(a.Merged.FirstValue("port").Values, ShouldResemble, []string{"8080"})
+			So(a.Merged.FirstValue("host").Values, ShouldResemble, []string{"host1"})
+		})
+
+		Convey("unreadable ancestors are left out", func() {
+			Registry[1].HandlerV2 = rulesHandler{root, rules[1:]}
+
+			a, err := Resolve(context.Background(), user, "svc.api.prod.host1")
+			So(err, ShouldBeNil)
+			So(a.Chain.StringList(), ShouldEqual, "svc.api.prod\nsvc.api.prod.host1\n")
+		})
+	})
+}
@@ -1,12 +1,17 @@
 package app
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	"github.com/spf13/viper"
 	"sour.is/x/toolbox/dbm/rsql"
 	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
 	"sour.is/x/toolbox/ident/session"
 	"sour.is/x/toolbox/mercury"
 )
@@ -50,6 +55,29 @@ func Test_appConfig_GetRules(t *testing.T) {
 				},
 			},
 		},
+		{
+			"secret-admin",
+			args{
+				ident.Ident(
+					session.User{
+						Active: true,
+						Roles:  map[string]struct{}{"secret-admin": struct{}{}},
+					},
+				),
+			},
+			mercury.Rules{
+				{
+					Role:  "secret",
+					Type:  "NS",
+					Match: "app.settings",
+				},
+				{
+					Role:  "secret",
+					Type:  "NS",
+					Match: "app.host",
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -113,6 +141,18 @@ func Test_appConfig_GetObjects(t *testing.T) {
 			nil,
 			nil,
 		}, mercury.Config{&mercury.Space{Space: "app.settings", List: []mercury.Value{{Space: "app.settings", Name: "app.setting", Values: []string{"TRUE"}}}}}},
+
+		{"app.settings search", args{
+			mercury.ParseNamespace("app.settings"),
+			rsql.DefaultParse("value==FALSE"),
+			nil,
+		}, nil},
+
+		{"app.settings fields", args{
+			mercury.ParseNamespace("app.settings"),
+			nil,
+			[]string{"other"},
+		}, mercury.Config{&mercury.Space{Space: "app.settings"}}},
 	}
 	for _, tt := range tests {
 		viper.Set("app.setting", "TRUE")
@@ -124,3 +164,150 @@ func Test_appConfig_GetObjects(t *testing.T) {
 		})
 	}
 }
+
+func Test_isSecret(t *testing.T) {
+	viper.Set("mercury.secrets", []string{"custom.*"})
+	defer viper.Set("mercury.secrets", nil)
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"app.setting", false},
+		{"db.pg.connect", true},
+		{"vault.token", true},
+		{"http.tls.key", true},
+		{"DB_PASSWORD", true},
+		{"custom.value", true},
+		{"HOME", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := isSecret(tt.key); got != tt.want {
+				t.Errorf("isSecret() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_splitEnviron(t *testing.T) {
+	env, secrets := splitEnviron([]string{"HOME=/root", "API_TOKEN=abc", "PATH=/bin"})
+	if !reflect.DeepEqual(env, []string{"HOME=/root", "PATH=/bin"}) {
+		t.Errorf("splitEnviron() env = %v", env)
+	}
+	if !reflect.DeepEqual(secrets, []string{"API_TOKEN=abc"}) {
+		t.Errorf("splitEnviron() secrets = %v", secrets)
+	}
+}
+
+func Test_appConfig_WriteObjects(t *testing.T) {
+	reloaded := 0
+	RegisterReload("test.live", func(*viper.Viper) error {
+		reloaded++
+		return nil
+	})
+
+	viper.Set("test.live", "one")
+	viper.Set("test.static", "one")
+	viper.Set("test.password", "hunter2")
+
+	settings := func(values ...mercury.Value) mercury.Config {
+		return mercury.Config{&mercury.Space{Space: "app.settings", List: values}}
+	}
+
+	tests := []struct {
+		name     string
+		lis      mercury.Config
+		wantErr  error
+		reloaded int
+	}{
+		{"unchanged", settings(mercury.Value{Name: "test.static", Values: []string{"one"}}), nil, 0},
+		{"masked secret", settings(mercury.Value{Name: "test.password", Values: []string{"****"}}), nil, 0},
+		{"not live", settings(
+			mercury.Value{Name: "test.live", Values: []string{"two"}},
+			mercury.Value{Name: "test.static", Values: []string{"two"}},
+		), NotLiveError{Keys: []string{"test.static"}, Live: livePatterns(getHooks())}, 0},
+		{"read only", mercury.Config{mercury.NewSpace("app.host")}, ReadOnlyError("app.host"), 0},
+		{"live", settings(mercury.Value{Name: "test.live", Values: []string{"two"}}), nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaded = 0
+			a := appConfig{}
+			if err := a.WriteObjects(tt.lis); !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("appConfig.WriteObjects() error = %v, want %v", err, tt.wantErr)
+			}
+			if reloaded != tt.reloaded {
+				t.Errorf("appConfig.WriteObjects() reloaded = %v, want %v", reloaded, tt.reloaded)
+			}
+		})
+	}
+
+	if got := Settings().GetString("test.live"); got != "two" {
+		t.Errorf("test.live = %v, want two", got)
+	}
+	if got := viper.GetString("test.live"); got != "one" {
+		t.Errorf("viper test.live = %v, want one", got)
+	}
+	if got := Settings().GetString("test.static"); got != "one" {
+		t.Errorf("test.static = %v, want one", got)
+	}
+}
+
+func Test_LoadOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	RegisterReload("test.overlay", func(*viper.Viper) error { return nil })
+	viper.Set("app.overlay", filepath.Join(dir, "overlay.toml"))
+	defer viper.Set("app.overlay", "")
+
+	viper.Set("test.overlay", "one")
+	err = writeSettings([]mercury.Value{{Name: "test.overlay", Values: []string{"two"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live.Lock()
+	live.m = nil
+	live.Unlock()
+
+	if err = LoadOverlay(); err != nil {
+		t.Fatal(err)
+	}
+	if got := Settings().GetString("test.overlay"); got != "two" {
+		t.Errorf("test.overlay = %v, want two", got)
+	}
+}
+
+func Test_appHandler_WriteObjects(t *testing.T) {
+	RegisterReload("test.admin", func(*viper.Viper) error { return nil })
+	viper.Set("test.admin", "one")
+
+	user := func(roles ...string) ident.Ident {
+		return mock.NewMock("user", "test", "User", nil, roles, nil, true)
+	}
+	lis := mercury.Config{&mercury.Space{Space: "app.settings", List: []mercury.Value{{Name: "test.admin", Values: []string{"two"}}}}}
+	h := appHandler{mercury.AdaptHandler(appConfig{})}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{"no ident", context.Background(), ErrSettingsDenied},
+		{"writer", ident.WithContext(context.Background(), user("write")), ErrSettingsDenied},
+		{"admin", ident.WithContext(context.Background(), user("admin")), ErrSettingsDenied},
+		{"settings admin", ident.WithContext(context.Background(), user(SettingsAdminRole)), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.WriteObjects(tt.ctx, lis); err != tt.wantErr {
+				t.Errorf("appHandler.WriteObjects() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"sour.is/x/toolbox/vault"
+)
+
+// SecretPatterns are glob patterns for setting keys and environment variables
+// that hold secrets. More patterns can be added with the mercury.secrets setting.
+var SecretPatterns = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*token*",
+	"*credential*",
+	"*connect*",
+	"*key",
+}
+
+// SecretAdminRole is the ident role that may read raw secret values in the app spaces.
+var SecretAdminRole = "secret-admin"
+
+// isSecret returns true if the setting key or environment variable holds a secret.
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+
+	for _, k := range vault.Keys() {
+		if k == key {
+			return true
+		}
+	}
+
+	patterns := viper.GetStringSlice("mercury.secrets")
+	for _, pattern := range append(patterns, SecretPatterns...) {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), key); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitEnviron separates environment variables that hold secrets.
+func splitEnviron(environ []string) (env, secrets []string) {
+	for _, e := range environ {
+		name := e
+		if i := strings.IndexRune(e, '='); i >= 0 {
+			name = e[:i]
+		}
+
+		if isSecret(name) {
+			secrets = append(secrets, e)
+			continue
+		}
+		env = append(env, e)
+	}
+
+	return
+}
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/ident/session"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/log/event"
+	"sour.is/x/toolbox/mercury"
+)
+
+// ReloadFunc applies settings after they are changed at runtime. The
+// settings are the startup settings with the live settings over them.
+type ReloadFunc func(settings *viper.Viper) error
+
+type reloadHook struct {
+	Match string
+	Fn    ReloadFunc
+}
+
+var reloads struct {
+	sync.Mutex
+	hooks []reloadHook
+}
+
+// RegisterReload marks settings with keys matching pattern as live. After a
+// write to app.settings changes any of them fn is called to apply them.
+// Writes that change a key without a hook are rejected.
+func RegisterReload(pattern string, fn ReloadFunc) {
+	reloads.Lock()
+	defer reloads.Unlock()
+
+	reloads.hooks = append(reloads.hooks, reloadHook{Match: strings.ToLower(pattern), Fn: fn})
+}
+
+func init() {
+	RegisterReload("log.verbose", func(settings *viper.Viper) error {
+		level, err := event.ParseLevel(settings.GetString("log.verbose"))
+		if err != nil {
+			return err
+		}
+		log.SetVerbose(level)
+		return nil
+	})
+	RegisterReload("http.middleware.*", func(settings *viper.Viper) error {
+		httpsrv.ConfigMiddlewareFrom(settings)
+		return nil
+	})
+	RegisterReload("idm.session.*", func(settings *viper.Viper) error {
+		session.ConfigFrom(settings)
+		return nil
+	})
+}
+
+// NotLiveError is returned when a write changes settings that can only be set at startup.
+type NotLiveError struct {
+	// Keys are the settings that can not be changed.
+	Keys []string
+	// Live are the patterns of the settings that can be.
+	Live []string
+}
+
+func (e NotLiveError) Error() string {
+	return fmt.Sprintf("settings can not be changed at runtime: %s (live settings: %s)",
+		strings.Join(e.Keys, ", "), strings.Join(e.Live, ", "))
+}
+
+// ReadOnlyError is returned for writes to app spaces other than app.settings.
+type ReadOnlyError string
+
+func (e ReadOnlyError) Error() string {
+	return fmt.Sprintf("space is read only: %s", string(e))
+}
+
+var writeMu sync.Mutex
+
+// live holds the settings changed at runtime. The global viper is only
+// set at startup so requests can read it without locks.
+var live struct {
+	sync.RWMutex
+	m map[string]interface{}
+}
+
+// Settings returns the startup settings with the settings changed at
+// runtime over them. The copy is not shared so it is safe to read.
+//
+// Only settings with a reload hook are live and they are only seen here and
+// by the hooks. Code reading the global viper keeps the startup values.
+func Settings() *viper.Viper {
+	v := viper.New()
+	v.MergeConfigMap(viper.AllSettings())
+
+	live.RLock()
+	defer live.RUnlock()
+	for key, val := range live.m {
+		v.Set(key, val)
+	}
+
+	return v
+}
+
+// setLive stores the values over the startup settings.
+func setLive(changed map[string]interface{}) {
+	live.Lock()
+	defer live.Unlock()
+
+	if live.m == nil {
+		live.m = make(map[string]interface{})
+	}
+	for key, val := range changed {
+		live.m[key] = val
+	}
+}
+
+// writeSettings stores changed values as live settings, saves them to the
+// overlay file if one is set and calls the reload hooks for the changed
+// keys. Values that are unchanged or still masked are skipped.
+func writeSettings(lis []mercury.Value) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	hooks := getHooks()
+	settings := Settings()
+	changed := make(map[string]interface{})
+	var notLive NotLiveError
+
+	for _, v := range lis {
+		key := strings.ToLower(v.Name)
+		current := settingValues(settings, key)
+
+		if reflect.DeepEqual(current, v.Values) || isMasked(key, current, v.Values) {
+			continue
+		}
+
+		if len(matchHooks(hooks, key)) == 0 {
+			notLive.Keys = append(notLive.Keys, key)
+			continue
+		}
+
+		var val interface{} = v.Values
+		if len(v.Values) == 1 {
+			val = v.Values[0]
+		}
+		changed[key] = val
+	}
+
+	if len(notLive.Keys) > 0 {
+		notLive.Live = livePatterns(hooks)
+		return notLive
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(changed))
+	for key := range changed {
+		log.Notices("app setting changed", "key", key)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	setLive(changed)
+
+	if err := saveOverlay(changed); err != nil {
+		return err
+	}
+
+	return runHooks(hooks, keys, Settings())
+}
+
+// runHooks calls each hook that matches any of the keys once.
+func runHooks(hooks []reloadHook, keys []string, settings *viper.Viper) error {
+	var errs []string
+	run := make(map[int]struct{})
+	for _, key := range keys {
+		for _, i := range matchHooks(hooks, key) {
+			if _, ok := run[i]; ok {
+				continue
+			}
+			run[i] = struct{}{}
+
+			if err := hooks[i].Fn(settings); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", hooks[i].Match, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reload failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func getHooks() []reloadHook {
+	reloads.Lock()
+	defer reloads.Unlock()
+
+	return append([]reloadHook(nil), reloads.hooks...)
+}
+
+// livePatterns returns the sorted patterns of the hooked settings.
+func livePatterns(hooks []reloadHook) []string {
+	seen := make(map[string]struct{}, len(hooks))
+	lis := make([]string, 0, len(hooks))
+	for _, h := range hooks {
+		if _, ok := seen[h.Match]; ok {
+			continue
+		}
+		seen[h.Match] = struct{}{}
+		lis = append(lis, h.Match)
+	}
+	sort.Strings(lis)
+	return lis
+}
+
+func matchHooks(hooks []reloadHook, key string) (lis []int) {
+	for i, h := range hooks {
+		if ok, _ := filepath.Match(h.Match, key); ok {
+			lis = append(lis, i)
+		}
+	}
+	return
+}
+
+// isMasked returns true if a secret was written back as it was read by a
+// user that could not see the raw value.
+func isMasked(key string, current, values []string) bool {
+	if !isSecret(key) || len(current) != len(values) {
+		return false
+	}
+	for i := range current {
+		if mercury.MaskSecret(current[i]) != values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadOverlay applies the settings saved by runtime writes as live
+// settings and calls the reload hooks for them. The overlay file is set
+// with app.overlay and may not exist yet.
+func LoadOverlay() error {
+	ov, err := readOverlay()
+	if err != nil || ov == nil {
+		return err
+	}
+
+	keys := ov.AllKeys()
+	sort.Strings(keys)
+	changed := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		changed[key] = ov.Get(key)
+	}
+	setLive(changed)
+
+	return runHooks(getHooks(), keys, Settings())
+}
+
+func saveOverlay(changed map[string]interface{}) error {
+	ov, err := readOverlay()
+	if err != nil || ov == nil {
+		return err
+	}
+
+	for key, val := range changed {
+		ov.Set(key, val)
+	}
+
+	return ov.WriteConfigAs(viper.GetString("app.overlay"))
+}
+
+func readOverlay() (*viper.Viper, error) {
+	file := viper.GetString("app.overlay")
+	if file == "" {
+		return nil, nil
+	}
+
+	ov := viper.New()
+	ov.SetConfigFile(file)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return ov, nil
+	}
+	if err := ov.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	return ov, nil
+}
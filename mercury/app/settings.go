@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"os"
@@ -22,15 +24,34 @@ const (
 	appDotHost     = "app.host"
 )
 
+// SettingsAdminRole is the ident role that may change app.settings at runtime.
+var SettingsAdminRole = "settings-admin"
+
+// ErrSettingsDenied is returned for writes to app.settings by users without the SettingsAdminRole.
+var ErrSettingsDenied = errors.New("app.settings can only be changed by the " + SettingsAdminRole + " role")
+
 func init() {
-	mercury.Register("app.*", math.MaxInt64, appConfig{})
+	mercury.RegisterV2("app.*", math.MaxInt64, appHandler{mercury.AdaptHandler(appConfig{})})
 }
 
 type appConfig struct {
-	dummy.WriteDummy
 	dummy.NotifyDummy
 }
 
+// appHandler checks the writer has the SettingsAdminRole. The write rules
+// of other handlers may cover app.* so they are not enough.
+type appHandler struct {
+	mercury.HandlerV2
+}
+
+// WriteObjects implements HandlerV2
+func (h appHandler) WriteObjects(ctx context.Context, lis mercury.Config) error {
+	if u := ident.GetContextIdent(ctx); u == nil || !u.IsActive() || !u.HasRole(SettingsAdminRole) {
+		return ErrSettingsDenied
+	}
+	return h.HandlerV2.WriteObjects(ctx, lis)
+}
+
 // Index returns nil
 func (appConfig) GetIndex(search mercury.NamespaceSearch, _ *rsql.Program) (lis mercury.Config) {
 
@@ -49,31 +70,24 @@ func (appConfig) GetIndex(search mercury.NamespaceSearch, _ *rsql.Program) (lis
 	return
 }
 
-// Objects returns nil
-func (appConfig) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ []string) (lis mercury.Config) {
+// Objects returns the app spaces filtered by search and fields
+func (appConfig) GetObjects(search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (lis mercury.Config) {
 
 	if search.Match(appDotSettings) {
 		space := mercury.Space{
 			Space: appDotSettings,
 		}
 
-		keys := viper.AllKeys()
+		settings := Settings()
+		keys := settings.AllKeys()
 		sort.Strings(keys)
 
 		for i, key := range keys {
-			var val []string
-
-			s := viper.GetString(key)
-
-			if s != "" {
-				val = strings.Split(s, "\n")
-				log.NilDebug("split ", val)
-			} else if viper.IsSet(key) {
-				val = viper.GetStringSlice(key)
-				log.NilDebug("slice ", val)
-			} else {
-				v := viper.Get(key)
-				val = strings.Split(fmt.Sprintf("%#v", v), "\n")
+			val := settingValues(settings, key)
+
+			var tags []string
+			if isSecret(key) {
+				tags = []string{mercury.SecretTag}
 			}
 
 			space.List = append(space.List, mercury.Value{
@@ -81,6 +95,7 @@ func (appConfig) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ [
 				Seq:    uint64(i),
 				Name:   key,
 				Values: val,
+				Tags:   tags,
 			})
 		}
 
@@ -113,6 +128,7 @@ func (appConfig) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ [
 			hostname, _ := os.Hostname()
 			wd, _ := os.Getwd()
 			grp, _ := usr.GroupIds()
+			env, secrets := splitEnviron(os.Environ())
 			space.List = []mercury.Value{
 				{
 					Space:  appDotHost,
@@ -172,7 +188,14 @@ func (appConfig) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ [
 					Space:  appDotHost,
 					Seq:    10,
 					Name:   "environ",
-					Values: os.Environ(),
+					Values: env,
+				},
+				{
+					Space:  appDotHost,
+					Seq:    11,
+					Name:   "environ.secret",
+					Values: secrets,
+					Tags:   []string{mercury.SecretTag},
 				},
 			}
 
@@ -180,6 +203,39 @@ func (appConfig) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ [
 		}
 	}
 
+	return lis.Filter(pgm, fields)
+}
+
+// WriteObjects updates settings written to app.settings. Only settings with
+// a registered reload hook can be changed. Other app spaces are read only.
+// The writer is checked by appHandler.
+func (appConfig) WriteObjects(lis mercury.Config) error {
+	var values []mercury.Value
+	for _, s := range lis {
+		if s.Space != appDotSettings {
+			return ReadOnlyError(s.Space)
+		}
+		values = append(values, s.List...)
+	}
+
+	return writeSettings(values)
+}
+
+// settingValues returns a setting as a list of strings.
+func settingValues(settings *viper.Viper, key string) (val []string) {
+	s := settings.GetString(key)
+
+	if s != "" {
+		val = strings.Split(s, "\n")
+		log.NilDebug("split ", val)
+	} else if settings.IsSet(key) {
+		val = settings.GetStringSlice(key)
+		log.NilDebug("slice ", val)
+	} else {
+		v := settings.Get(key)
+		val = strings.Split(fmt.Sprintf("%#v", v), "\n")
+	}
+
 	return
 }
 
@@ -206,5 +262,35 @@ func (appConfig) GetRules(u ident.Ident) (lis mercury.Rules) {
 		)
 	}
 
+	if u.HasRole(SettingsAdminRole) {
+		lis = append(lis,
+			mercury.Rule{
+				Role:  "read",
+				Type:  "NS",
+				Match: appDotSettings,
+			},
+			mercury.Rule{
+				Role:  "write",
+				Type:  "NS",
+				Match: appDotSettings,
+			},
+		)
+	}
+
+	if u.HasRole(SecretAdminRole) {
+		lis = append(lis,
+			mercury.Rule{
+				Role:  mercury.SecretRole,
+				Type:  "NS",
+				Match: appDotSettings,
+			},
+			mercury.Rule{
+				Role:  mercury.SecretRole,
+				Type:  "NS",
+				Match: appDotHost,
+			},
+		)
+	}
+
 	return lis
 }
@@ -0,0 +1,178 @@
+package mercury
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Archive formats for dumps.
+const (
+	// FormatJSON is a single JSON document.
+	FormatJSON = "json"
+	// FormatTar is a gzipped tarball with a dump.json manifest and a file
+	// per space under spaces/ and rules/.
+	FormatTar = "tar"
+)
+
+const manifestFile = "dump.json"
+
+// MaxDumpSize limits the bytes read from a dump after it is decompressed.
+// postImport also limits the request body to it.
+var MaxDumpSize int64 = 64 << 20
+
+// ErrDumpTooLarge is returned when a dump is larger than MaxDumpSize.
+var ErrDumpTooLarge = errors.New("dump is too large")
+
+// WriteDump encodes the dump in the format.
+func WriteDump(w io.Writer, dump *Dump, format string) error {
+	switch format {
+	case FormatJSON, "":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dump)
+	case FormatTar:
+		return writeTar(w, dump)
+	}
+
+	return fmt.Errorf("unknown dump format: %s", format)
+}
+
+// ReadDump decodes a dump in either format. Gzipped input is read as a tarball.
+// It fails with ErrDumpTooLarge if more than MaxDumpSize bytes are decoded.
+func ReadDump(r io.Reader) (*Dump, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return readTar(br)
+	}
+
+	dump := &Dump{}
+	if err := json.NewDecoder(&limitReader{br, MaxDumpSize}).Decode(dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+func writeTar(w io.Writer, dump *Dump) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := *dump
+	manifest.Spaces, manifest.Rules = nil, nil
+	if err := writeTarFile(tw, manifestFile, manifest); err != nil {
+		return err
+	}
+	for _, s := range dump.Spaces {
+		if err := writeTarFile(tw, path.Join("spaces", s.Space+".json"), s); err != nil {
+			return err
+		}
+	}
+	for _, s := range dump.Rules {
+		if err := writeTarFile(tw, path.Join("rules", s.Space+".json"), s); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b))}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+func readTar(r io.Reader) (*Dump, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var dump *Dump
+	var spaces, rules []DumpSpace
+
+	tr := tar.NewReader(&limitReader{gz, MaxDumpSize})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch dir := path.Dir(hdr.Name); {
+		case hdr.Name == manifestFile:
+			dump = &Dump{}
+			if err = json.NewDecoder(tr).Decode(dump); err != nil {
+				return nil, err
+			}
+
+		case dir == "spaces" || dir == "rules":
+			var s DumpSpace
+			if err = json.NewDecoder(tr).Decode(&s); err != nil {
+				return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if s.Space == "" {
+				s.Space = strings.TrimSuffix(path.Base(hdr.Name), ".json")
+			}
+
+			if dir == "spaces" {
+				spaces = append(spaces, s)
+			} else {
+				rules = append(rules, s)
+			}
+		}
+	}
+
+	if dump == nil {
+		return nil, fmt.Errorf("archive has no %s", manifestFile)
+	}
+	dump.Spaces, dump.Rules = spaces, rules
+
+	return dump, nil
+}
+
+// limitReader fails with ErrDumpTooLarge once more than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrDumpTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return 0, ErrDumpTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,352 @@
+package cache // import "sour.is/x/toolbox/mercury/cache"
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/mercury"
+)
+
+// Handler is a read-through cache for a mercury handler. Index, object and
+// rule reads are memoised until the TTL expires or a write or change
+// notification touches a space the cached search covers.
+type Handler struct {
+	mercury.HandlerV2
+
+	// Name is used to tag stats.
+	Name string
+
+	// RuleSpaces are patterns for the spaces rules are built from. Writes to
+	// matching spaces flush cached rules. If empty any write flushes rules.
+	RuleSpaces []string
+
+	store *gocache.Cache
+	calls flight
+
+	gen     uint64
+	hits    uint64
+	misses  uint64
+	flushes uint64
+}
+
+type entry struct {
+	search mercury.NamespaceSearch
+	rules  bool
+	value  interface{}
+}
+
+var handlers struct {
+	sync.Mutex
+	lis []*Handler
+}
+
+// New returns a handler that caches reads from h for ttl.
+func New(name string, h mercury.HandlerV2, ttl time.Duration) *Handler {
+	c := &Handler{
+		HandlerV2: h,
+		Name:      name,
+		store:     gocache.New(ttl, ttl),
+	}
+
+	handlers.Lock()
+	handlers.lis = append(handlers.lis, c)
+	handlers.Unlock()
+
+	return c
+}
+
+// Wrap replaces the handlers in the mercury registry registered with match
+// by cached handlers and returns them. The registered handlers keep the
+// optional interfaces, such as mercury.Patcher, of the handlers they cache.
+func Wrap(match string, ttl time.Duration) (lis []*Handler) {
+	for i, h := range mercury.Registry {
+		if h.Match != match {
+			continue
+		}
+
+		c := New(match, h.HandlerV2, ttl)
+		mercury.Registry[i].HandlerV2 = c
+		lis = append(lis, c)
+
+		log.Infos("mercury cache", "match", match, "ttl", ttl)
+	}
+
+	return
+}
+
+// GetIndex implements mercury.HandlerV2
+func (h *Handler) GetIndex(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program) (mercury.Config, error) {
+	key := fmt.Sprintf("index:%s?%s", search, programString(pgm))
+	v, err := h.get(key, entry{search: search}, func() (interface{}, error) {
+		return h.HandlerV2.GetIndex(ctx, search, pgm)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cloneConfig(v.(mercury.Config)), nil
+}
+
+// GetIndexPage implements mercury.IndexPagerV2
+func (h *Handler) GetIndexPage(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, page mercury.Page) (mercury.Config, error) {
+	pager, ok := h.HandlerV2.(mercury.IndexPagerV2)
+	if !ok {
+		return h.GetIndex(ctx, search, pgm)
+	}
+
+	key := fmt.Sprintf("page:%s?%s&%d,%d,%s,%t", search, programString(pgm), page.Limit, page.Offset, page.After, page.Desc)
+	v, err := h.get(key, entry{search: search}, func() (interface{}, error) {
+		return pager.GetIndexPage(ctx, search, pgm, page)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cloneConfig(v.(mercury.Config)), nil
+}
+
+// GetObjects implements mercury.HandlerV2
+func (h *Handler) GetObjects(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (mercury.Config, error) {
+	key := fmt.Sprintf("objects:%s?%s&%s", search, programString(pgm), strings.Join(fields, ","))
+	v, err := h.get(key, entry{search: search}, func() (interface{}, error) {
+		return h.HandlerV2.GetObjects(ctx, search, pgm, fields)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cloneConfig(v.(mercury.Config)), nil
+}
+
+// GetRules implements mercury.HandlerV2
+func (h *Handler) GetRules(ctx context.Context, user ident.Ident) (mercury.Rules, error) {
+	if user == nil {
+		return h.HandlerV2.GetRules(ctx, user)
+	}
+
+	key := fmt.Sprintf("rules:%s:%s|%s|%s",
+		user.GetAspect(),
+		user.GetIdentity(),
+		strings.Join(user.GetGroups(), ","),
+		strings.Join(user.GetRoles(), ","),
+	)
+	v, err := h.get(key, entry{rules: true}, func() (interface{}, error) {
+		return h.HandlerV2.GetRules(ctx, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rules := v.(mercury.Rules)
+	return append(mercury.Rules(nil), rules...), nil
+}
+
+// WriteObjects implements mercury.HandlerV2
+// Cached reads that cover any of the written spaces are dropped.
+func (h *Handler) WriteObjects(ctx context.Context, lis mercury.Config) error {
+	err := h.HandlerV2.WriteObjects(ctx, lis)
+
+	// Invalidate even on error as the backend may have partly applied the write.
+	spaces := make([]string, 0, len(lis))
+	for _, s := range lis {
+		spaces = append(spaces, s.Space)
+	}
+	h.Invalidate(spaces...)
+
+	return err
+}
+
+// Invalidate drops cached reads that cover any of the spaces.
+func (h *Handler) Invalidate(spaces ...string) {
+	h.invalidate(func(s mercury.NamespaceSpec) bool {
+		for _, space := range spaces {
+			if covers(s, space) {
+				return true
+			}
+		}
+		return false
+	}, func() bool {
+		return h.isRuleSpace(func(pattern string) bool {
+			for _, space := range spaces {
+				if ok, _ := filepath.Match(pattern, space); ok {
+					return true
+				}
+			}
+			return false
+		})
+	})
+}
+
+// InvalidateMatch drops cached reads that may cover spaces matching the
+// pattern, such as the match of a mercury notify.
+func (h *Handler) InvalidateMatch(pattern string) {
+	h.invalidate(func(s mercury.NamespaceSpec) bool {
+		return mercury.MatchOverlaps(s.Raw(), pattern)
+	}, func() bool {
+		return h.isRuleSpace(func(rule string) bool {
+			return mercury.MatchOverlaps(rule, pattern)
+		})
+	})
+}
+
+// Flush drops all cached reads.
+func (h *Handler) Flush() {
+	atomic.AddUint64(&h.gen, 1)
+	atomic.AddUint64(&h.flushes, uint64(h.store.ItemCount()))
+	h.store.Flush()
+}
+
+func (h *Handler) invalidate(spec func(mercury.NamespaceSpec) bool, rules func() bool) {
+	atomic.AddUint64(&h.gen, 1)
+
+	flushRules := rules()
+	for key, item := range h.store.Items() {
+		e, ok := item.Object.(entry)
+		if !ok {
+			continue
+		}
+
+		drop := e.rules && flushRules
+		for _, s := range e.search {
+			if drop {
+				break
+			}
+			drop = spec(s)
+		}
+
+		if drop {
+			log.Debug("CACHE DROP ", key)
+			atomic.AddUint64(&h.flushes, 1)
+			h.store.Delete(key)
+		}
+	}
+}
+
+func (h *Handler) isRuleSpace(fn func(string) bool) bool {
+	if len(h.RuleSpaces) == 0 {
+		return true
+	}
+	for _, pattern := range h.RuleSpaces {
+		if fn(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the cached value for key or loads it with fn. Concurrent
+// misses for the same key share a single load.
+func (h *Handler) get(key string, e entry, fn func() (interface{}, error)) (interface{}, error) {
+	if item, ok := h.store.Get(key); ok {
+		atomic.AddUint64(&h.hits, 1)
+		return item.(entry).value, nil
+	}
+	atomic.AddUint64(&h.misses, 1)
+
+	gen := atomic.LoadUint64(&h.gen)
+	v, err := h.calls.do(key, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip storing values that may have been loaded before an invalidation.
+	if atomic.LoadUint64(&h.gen) == gen {
+		e.value = v
+		h.store.SetDefault(key, e)
+	}
+
+	return v, nil
+}
+
+// covers returns true if the spec would return the space.
+// Trace searches match each of the ancestors of the search.
+func covers(s mercury.NamespaceSpec, space string) bool {
+	return s.Match(space)
+}
+
+func programString(pgm *rsql.Program) string {
+	if pgm == nil {
+		return ""
+	}
+	return pgm.String()
+}
+
+// cloneConfig copies the spaces so callers can not modify cached values.
+func cloneConfig(lis mercury.Config) mercury.Config {
+	if lis == nil {
+		return nil
+	}
+
+	out := make(mercury.Config, len(lis))
+	for i, s := range lis {
+		c := *s
+		c.Tags = cloneStrings(s.Tags)
+		c.Notes = cloneStrings(s.Notes)
+		if s.List != nil {
+			c.List = make([]mercury.Value, len(s.List))
+			for j, v := range s.List {
+				v.Values = cloneStrings(v.Values)
+				v.Tags = cloneStrings(v.Tags)
+				v.Notes = cloneStrings(v.Notes)
+				c.List[j] = v
+			}
+		}
+		out[i] = &c
+	}
+
+	return out
+}
+
+func cloneStrings(lis []string) []string {
+	if lis == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(lis)), lis...)
+}
+
+// flight shares the result of concurrent calls for the same key.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (f *flight) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := new(call)
+	c.wg.Add(1)
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+
+	return c.val, c.err
+}
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
+	"sour.is/x/toolbox/mercury"
+)
+
+type countHandler struct {
+	reads  int
+	rules  int
+	writes int
+	spaces mercury.Config
+	err    error
+}
+
+func (h *countHandler) GetIndex(_ context.Context, search mercury.NamespaceSearch, _ *rsql.Program) (mercury.Config, error) {
+	h.reads++
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	var lis mercury.Config
+	for _, s := range h.spaces {
+		if search.Match(s.Space) {
+			lis = append(lis, s)
+		}
+	}
+	return lis, nil
+}
+func (h *countHandler) GetObjects(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, _ []string) (mercury.Config, error) {
+	return h.GetIndex(ctx, search, pgm)
+}
+func (h *countHandler) WriteObjects(context.Context, mercury.Config) error { h.writes++; return nil }
+func (h *countHandler) GetRules(context.Context, ident.Ident) (mercury.Rules, error) {
+	h.rules++
+	return mercury.Rules{{Role: "read", Type: "NS", Match: "*"}}, nil
+}
+func (h *countHandler) GetNotify(context.Context, string) (mercury.ListNotify, error) {
+	return nil, nil
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("Given a cached handler", t, func() {
+		h := &countHandler{spaces: mercury.Config{
+			mercury.NewSpace("svc.api"),
+			mercury.NewSpace("svc.web"),
+			mercury.NewSpace("config.policy"),
+		}}
+		c := New("test", h, time.Minute)
+		c.RuleSpaces = []string{"config.policy"}
+
+		api := mercury.ParseNamespace("svc.api")
+		web := mercury.ParseNamespace("svc.web")
+		user := ident.NewNullUser("user", "test", "Test User", true)
+
+		Convey("reads are memoised", func() {
+			c.GetObjects(ctx, api, nil, nil)
+			lis, err := c.GetObjects(ctx, api, nil, nil)
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "svc.api\n")
+			So(h.reads, ShouldEqual, 1)
+			So(c.Stats().Hits, ShouldEqual, 1)
+			So(c.Stats().Misses, ShouldEqual, 1)
+		})
+
+		Convey("cached values are copied", func() {
+			lis, _ := c.GetObjects(ctx, api, nil, nil)
+			lis[0].Space = "changed"
+			lis, _ = c.GetObjects(ctx, api, nil, nil)
+			So(lis[0].Space, ShouldEqual, "svc.api")
+		})
+
+		Convey("errors are not cached", func() {
+			h.err = fmt.Errorf("broken")
+			_, err := c.GetIndex(ctx, api, nil)
+			So(err, ShouldNotBeNil)
+
+			h.err = nil
+			_, err = c.GetIndex(ctx, api, nil)
+			So(err, ShouldBeNil)
+			So(h.reads, ShouldEqual, 2)
+		})
+
+		Convey("writes only invalidate searches that cover the space", func() {
+			c.GetObjects(ctx, api, nil, nil)
+			c.GetObjects(ctx, web, nil, nil)
+			c.GetObjects(ctx, mercury.ParseNamespace("svc.*"), nil, nil)
+			c.GetObjects(ctx, mercury.ParseNamespace("trace:svc.api.prod"), nil, nil)
+			c.GetRules(ctx, user)
+			So(h.reads, ShouldEqual, 4)
+
+			So(c.WriteObjects(ctx, mercury.Config{mercury.NewSpace("svc.api")}), ShouldBeNil)
+			So(c.Stats().Items, ShouldEqual, 2)
+
+			c.GetObjects(ctx, web, nil, nil)
+			c.GetRules(ctx, user)
+			So(h.reads, ShouldEqual, 4)
+			So(h.rules, ShouldEqual, 1)
+		})
+
+		Convey("writes to rule spaces flush rules", func() {
+			c.GetRules(ctx, user)
+			c.Invalidate("config.policy")
+			c.GetRules(ctx, user)
+			So(h.rules, ShouldEqual, 2)
+		})
+
+		Convey("notify matches invalidate overlapping searches", func() {
+			c.GetObjects(ctx, api, nil, nil)
+			c.GetObjects(ctx, mercury.ParseNamespace("svc.*"), nil, nil)
+			c.GetObjects(ctx, mercury.ParseNamespace("config.*"), nil, nil)
+
+			c.InvalidateMatch("svc.a*")
+			So(c.Stats().Items, ShouldEqual, 1)
+		})
+	})
+}
+
+type patchHandler struct {
+	countHandler
+	commits int
+}
+
+func (h *patchHandler) PreparePatch(context.Context, mercury.Patch) (mercury.WriteTx, error) {
+	return h, nil
+}
+func (h *patchHandler) Search(context.Context, mercury.NamespaceSearch, mercury.Query) (mercury.Config, error) {
+	return h.spaces, nil
+}
+func (h *patchHandler) Commit() error   { h.commits++; return nil }
+func (h *patchHandler) Rollback() error { return nil }
+
+func TestWrap(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("Given a wrapped handler", t, func() {
+		h := &patchHandler{countHandler: countHandler{spaces: mercury.Config{mercury.NewSpace("svc.api")}}}
+		c := New("test", h, time.Minute)
+
+		old := mercury.Registry
+		mercury.Registry = mercury.HandlerList{{Match: "*", Priority: 1, HandlerV2: h}}
+		Reset(func() { mercury.Registry = old })
+		So(Wrap("*", time.Minute), ShouldHaveLength, 1)
+		w := mercury.Registry[0].HandlerV2
+
+		Convey("every optional interface is passed through", func() {
+			_, ok := w.(mercury.WritePreparer)
+			So(ok, ShouldBeTrue)
+			_, ok = w.(mercury.Patcher)
+			So(ok, ShouldBeTrue)
+			_, ok = w.(mercury.Searcher)
+			So(ok, ShouldBeTrue)
+			_, ok = w.(mercury.IndexPagerV2)
+			So(ok, ShouldBeTrue)
+			_, ok = w.(mercury.WriteObserver)
+			So(ok, ShouldBeTrue)
+
+			lis, err := w.(mercury.Searcher).Search(ctx, mercury.ParseNamespace("svc.*"), mercury.Query{})
+			So(err, ShouldBeNil)
+			So(lis, ShouldResemble, h.spaces)
+
+			_, err = w.(mercury.WritePreparer).PrepareWrite(ctx, nil)
+			So(err, ShouldEqual, mercury.ErrNotSupported)
+		})
+
+		Convey("committed patches invalidate the spaces", func() {
+			api := mercury.ParseNamespace("svc.api")
+			c.GetObjects(ctx, api, nil, nil)
+			So(c.Stats().Items, ShouldEqual, 1)
+
+			tx, err := c.PreparePatch(ctx, mercury.Patch{{Op: mercury.PatchSet, Space: "svc.api", Name: "key"}})
+			So(err, ShouldBeNil)
+			So(c.Stats().Items, ShouldEqual, 1)
+
+			So(tx.Commit(), ShouldBeNil)
+			So(h.commits, ShouldEqual, 1)
+			So(c.Stats().Items, ShouldEqual, 0)
+		})
+
+		Convey("writes fall back for interfaces the handler does not have", func() {
+			err := mercury.Registry.WriteObjectsContext(ctx, mercury.Config{mercury.NewSpace("svc.web")})
+			So(err, ShouldBeNil)
+			So(h.writes, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestPostCache(t *testing.T) {
+	Convey("Given a cache flush request", t, func() {
+		tests := []struct {
+			name   string
+			id     ident.Ident
+			status int
+		}{
+			{"anonymous", mock.NewMock("", "", "", nil, nil, nil, false), 401},
+			{"user", mock.NewMock("user", "test", "User", nil, []string{"write"}, nil, true), 403},
+			{"admin", mock.NewMock("admin", "test", "Admin", nil, []string{"admin"}, nil, true), 202},
+		}
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				rec := httptest.NewRecorder()
+				postCache(httpsrv.WrapResponseWriter(rec), httptest.NewRequest("POST", "/v1/mercury-cache", nil), tt.id)
+				So(rec.Code, ShouldEqual, tt.status)
+			})
+		}
+	})
+}
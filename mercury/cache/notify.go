@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"net/http"
+
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/mercury"
+	"sour.is/x/toolbox/mqtt"
+)
+
+func init() {
+	httpsrv.IdentRegister("mercury-cache", httpsrv.IdentRoutes{
+		{Name: "post-mercury-cache", Method: "POST", Pattern: "/v1/mercury-cache", HandlerFunc: postCache},
+	})
+}
+
+// InvalidateMatch drops cached reads in every cache that may cover spaces
+// matching the pattern. An empty pattern flushes all caches.
+func InvalidateMatch(pattern string) {
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	for _, h := range handlers.lis {
+		if pattern == "" {
+			h.Flush()
+			continue
+		}
+		h.InvalidateMatch(pattern)
+	}
+}
+
+// Subscribe listens for mercury notify messages on the mqtt topic and
+// invalidates the spaces that match the notify.
+func Subscribe(topic string) (unsubscribe func(), err error) {
+	ch, unsubscribe, err := mqtt.Subscribe(topic, 0)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for m := range ch {
+			var n mercury.Notify
+			if err := m.JSON(&n); err != nil {
+				log.Error(err)
+				continue
+			}
+
+			log.Debug("CACHE NOTIFY ", n.Match)
+			InvalidateMatch(n.Match)
+		}
+	}()
+
+	return
+}
+
+// swagger:operation POST /v1/mercury-cache mercury post-mercury-cache
+//
+// Invalidate Mercury Cache
+//
+// Requires the admin role.
+//
+// ---
+// parameters:
+//   - name: space
+//     in: query
+//     description: Space pattern to invalidate. All are flushed if empty.
+//     required: false
+//     type: string
+//     format: string
+// produces:
+//   - "text/plain"
+// responses:
+//   "202":
+//     description: Success
+//     schema:
+//       type: string
+//   "4xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func postCache(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+	if !id.HasRole("admin") {
+		w.WriteError(403, "NO_ADMIN")
+		return
+	}
+
+	InvalidateMatch(r.URL.Query().Get("space"))
+
+	w.WriteText(202, "OK")
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	"sour.is/x/toolbox/stats"
+	"sour.is/x/toolbox/stats/exposition"
+)
+
+func init() {
+	stats.Register("mercury.cache", getStats)
+}
+
+// Stats are the counters for a cache.
+type Stats struct {
+	Name    string `json:"name"`
+	Items   int    `json:"items"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Flushes uint64 `json:"flushes"`
+}
+
+type listStats []Stats
+
+func getStats() exposition.Expositioner {
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	lis := make(listStats, 0, len(handlers.lis))
+	for _, h := range handlers.lis {
+		lis = append(lis, h.Stats())
+	}
+
+	return lis
+}
+
+// Stats returns the current counters for the cache.
+func (h *Handler) Stats() Stats {
+	return Stats{
+		Name:    h.Name,
+		Items:   h.store.ItemCount(),
+		Hits:    atomic.LoadUint64(&h.hits),
+		Misses:  atomic.LoadUint64(&h.misses),
+		Flushes: atomic.LoadUint64(&h.flushes),
+	}
+}
+
+func (lis listStats) Exposition() (out exposition.Expositions) {
+	items := exposition.New("mercury_cache_items", exposition.Gauge)
+	hits := exposition.New("mercury_cache_hits", exposition.Counter)
+	misses := exposition.New("mercury_cache_misses", exposition.Counter)
+	flushes := exposition.New("mercury_cache_flushes", exposition.Counter)
+
+	for _, s := range lis {
+		items.AddRow(float64(s.Items)).AddTag("name", s.Name)
+		hits.AddRow(float64(s.Hits)).AddTag("name", s.Name)
+		misses.AddRow(float64(s.Misses)).AddTag("name", s.Name)
+		flushes.AddRow(float64(s.Flushes)).AddTag("name", s.Name)
+	}
+
+	return exposition.Expositions{items, hits, misses, flushes}
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+
+	"sour.is/x/toolbox/mercury"
+)
+
+// The registry finds optional handler features by type assertion. Handler has
+// each of them and passes it to the handler it caches, returning
+// mercury.ErrNotSupported if that handler does not have it so the registry
+// falls back as it would for the cached handler.
+
+// PrepareWrite implements mercury.WritePreparer
+// Cached reads that cover the written spaces are dropped on commit.
+func (h *Handler) PrepareWrite(ctx context.Context, lis mercury.Config) (mercury.WriteTx, error) {
+	p, ok := h.HandlerV2.(mercury.WritePreparer)
+	if !ok {
+		return nil, mercury.ErrNotSupported
+	}
+
+	tx, err := p.PrepareWrite(ctx, lis)
+	if err != nil {
+		return nil, err
+	}
+
+	spaces := make([]string, 0, len(lis))
+	for _, s := range lis {
+		spaces = append(spaces, s.Space)
+	}
+	return invalidateTx{tx, h, spaces}, nil
+}
+
+// PreparePatch implements mercury.Patcher
+// Cached reads that cover the patched spaces are dropped on commit.
+func (h *Handler) PreparePatch(ctx context.Context, patch mercury.Patch) (mercury.WriteTx, error) {
+	p, ok := h.HandlerV2.(mercury.Patcher)
+	if !ok {
+		return nil, mercury.ErrNotSupported
+	}
+
+	tx, err := p.PreparePatch(ctx, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	spaces := make([]string, 0, len(patch))
+	for _, op := range patch {
+		spaces = append(spaces, op.Space)
+	}
+	return invalidateTx{tx, h, spaces}, nil
+}
+
+// Search implements mercury.Searcher
+// Searches are not cached.
+func (h *Handler) Search(ctx context.Context, search mercury.NamespaceSearch, q mercury.Query) (mercury.Config, error) {
+	s, ok := h.HandlerV2.(mercury.Searcher)
+	if !ok {
+		return nil, mercury.ErrNotSupported
+	}
+	return s.Search(ctx, search, q)
+}
+
+// Written implements mercury.WriteObserver
+func (h *Handler) Written(ctx context.Context, lis mercury.Config) {
+	if o, ok := h.HandlerV2.(mercury.WriteObserver); ok {
+		o.Written(ctx, lis)
+	}
+}
+
+// invalidateTx drops cached reads for the spaces once the write is committed.
+type invalidateTx struct {
+	mercury.WriteTx
+	h      *Handler
+	spaces []string
+}
+
+func (tx invalidateTx) Commit() error {
+	err := tx.WriteTx.Commit()
+
+	// Invalidate even on error as the backend may have partly applied the write.
+	tx.h.Invalidate(tx.spaces...)
+
+	return err
+}
@@ -0,0 +1,411 @@
+package mercury
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"sour.is/x/toolbox/ident"
+)
+
+// DumpVersion is the version of the export format.
+const DumpVersion = 1
+
+// ruleSpaces hold the rules and notifies. The value is the field of each
+// line that holds the space match.
+var ruleSpaces = map[string]int{
+	"config.policy": 2,
+	"config.notify": 0,
+}
+
+// Dump is an export of the spaces under a namespace.
+type Dump struct {
+	Version   int         `json:"version"`
+	Namespace string      `json:"namespace"`
+	Exported  time.Time   `json:"exported"`
+	Spaces    []DumpSpace `json:"spaces"`
+
+	// Rules are the rule and notify lines that match the namespace.
+	// They are only exported for admins.
+	Rules []DumpSpace `json:"rules,omitempty"`
+}
+
+// DumpSpace is an exported space.
+type DumpSpace struct {
+	Space string      `json:"space"`
+	Tags  []string    `json:"tags,omitempty"`
+	Notes []string    `json:"notes,omitempty"`
+	List  []DumpValue `json:"list"`
+}
+
+// DumpValue is an exported value. Secret values the exporter could not read
+// are marked redacted and are not imported.
+type DumpValue struct {
+	Seq      uint64   `json:"seq"`
+	Name     string   `json:"name"`
+	Values   []string `json:"values"`
+	Tags     []string `json:"tags,omitempty"`
+	Notes    []string `json:"notes,omitempty"`
+	Redacted bool     `json:"redacted,omitempty"`
+}
+
+// ImportMode selects how imported spaces are combined with existing spaces.
+type ImportMode string
+
+const (
+	// ImportMerge adds and updates values by name and keeps the others.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace replaces spaces and removes spaces under the namespace
+	// that are not in the dump.
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportOptions control an import.
+type ImportOptions struct {
+	Mode ImportMode
+
+	// From and To rewrite a space prefix such as svc.staging.* to svc.prod.*
+	From string
+	To   string
+}
+
+// ParseRewrite reads a rewrite in the form from:to.
+func ParseRewrite(s string) (from, to string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+
+	sp := strings.SplitN(s, ":", 2)
+	if len(sp) != 2 || sp[0] == "" || sp[1] == "" {
+		return "", "", fmt.Errorf("rewrite must be from:to: %s", s)
+	}
+
+	return sp[0], sp[1], nil
+}
+
+// rewrite replaces the From prefix of a space or pattern with To.
+func (o ImportOptions) rewrite(space string) string {
+	from := strings.TrimSuffix(o.From, "*")
+	if from == "" || !strings.HasPrefix(space, from) {
+		return space
+	}
+	return strings.TrimSuffix(o.To, "*") + strings.TrimPrefix(space, from)
+}
+
+// ImportResult lists the spaces changed by an import.
+type ImportResult struct {
+	Written []string `json:"written"`
+	Removed []string `json:"removed"`
+	Skipped []string `json:"skipped"`
+}
+
+// Export dumps the spaces under the namespace the user can read. Secret
+// values are redacted as for reads. Rules and notifies are included for
+// users with the admin role on the spaces that hold them.
+func Export(ctx context.Context, user ident.Ident, namespace string) (*Dump, error) {
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := rules.ReduceSearch(ParseNamespace(namespace))
+	lis, err := Registry.GetObjectsContext(ctx, ns.String(), "", "")
+	if err != nil {
+		return nil, err
+	}
+	lis, err = rules.filterSpace(lis)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(lis)
+	redacted := rules.Redact(lis)
+
+	dump := &Dump{Version: DumpVersion, Namespace: namespace, Exported: time.Now().UTC()}
+	for i, s := range redacted {
+		d := dumpSpace(s)
+		for j := range d.List {
+			d.List[j].Redacted = s.List[j].IsSecret() && !equalStrings(s.List[j].Values, lis[i].List[j].Values)
+		}
+		dump.Spaces = append(dump.Spaces, d)
+	}
+
+	names := make([]string, 0, len(ruleSpaces))
+	for name := range ruleSpaces {
+		if rules.GetRoles("NS", name).HasRole("admin") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return dump, nil
+	}
+	sort.Strings(names)
+
+	rs, err := Registry.GetObjectsContext(ctx, strings.Join(names, ","), "", "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(rs)
+	for _, s := range rs {
+		s = filterRuleLines(s, ruleSpaces[s.Space], func(match string) bool {
+			return MatchOverlaps(match, namespace)
+		})
+		if len(s.List) > 0 {
+			dump.Rules = append(dump.Rules, dumpSpace(s))
+		}
+	}
+
+	return dump, nil
+}
+
+// Import writes the spaces in the dump. Spaces the user can not write are
+// skipped. Rules are merged into the existing rule spaces for admins.
+func Import(ctx context.Context, user ident.Ident, dump *Dump, opts ImportOptions) (result ImportResult, err error) {
+	if dump.Version != DumpVersion {
+		return result, fmt.Errorf("unsupported dump version: %d", dump.Version)
+	}
+	if opts.Mode == "" {
+		opts.Mode = ImportMerge
+	}
+	if opts.Mode != ImportMerge && opts.Mode != ImportReplace {
+		return result, fmt.Errorf("unknown import mode: %s", opts.Mode)
+	}
+
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if err != nil {
+		return result, err
+	}
+
+	namespace := opts.rewrite(dump.Namespace)
+	existing, err := Registry.GetObjectsContext(ctx, rules.ReduceSearch(ParseNamespace(namespace)).String(), "", "")
+	if err != nil {
+		return result, err
+	}
+	current := existing.ToSpaceMap()
+
+	var lis Config
+	seen := make(map[string]struct{})
+	for _, d := range dump.Spaces {
+		space := opts.rewrite(d.Space)
+		seen[space] = struct{}{}
+
+		s := d.toSpace(space, current[space])
+		if cur, ok := current[space]; ok && opts.Mode == ImportMerge {
+			s = mergeSpace(cur, s)
+		}
+		lis = append(lis, s)
+	}
+
+	if opts.Mode == ImportReplace {
+		for _, s := range existing {
+			if _, ok := seen[s.Space]; !ok {
+				lis = append(lis, NewSpace(s.Space))
+			}
+		}
+	}
+
+	for _, d := range dump.Rules {
+		field, ok := ruleSpaces[d.Space]
+		if !ok || !rules.GetRoles("NS", d.Space).HasRole("admin") {
+			result.Skipped = append(result.Skipped, d.Space)
+			continue
+		}
+
+		s := d.toSpace(d.Space, nil)
+		for i, v := range s.List {
+			for j, line := range v.Values {
+				s.List[i].Values[j] = rewriteRuleLine(line, field, opts.rewrite)
+			}
+		}
+
+		cur, err := Registry.GetObjectsContext(ctx, d.Space, "", "")
+		if err != nil {
+			return result, err
+		}
+		if len(cur) > 0 {
+			s = mergeRules(cur[0], s)
+		}
+		lis = append(lis, s)
+	}
+
+	written, err := writeSpaces(ctx, rules, lis)
+	if err != nil {
+		return result, err
+	}
+
+	done := make(map[string]struct{}, len(written))
+	for _, s := range written {
+		done[s.Space] = struct{}{}
+		if len(s.List) == 0 && len(s.Tags) == 0 && len(s.Notes) == 0 {
+			result.Removed = append(result.Removed, s.Space)
+			continue
+		}
+		result.Written = append(result.Written, s.Space)
+	}
+	for _, s := range lis {
+		if _, ok := done[s.Space]; !ok {
+			result.Skipped = append(result.Skipped, s.Space)
+		}
+	}
+
+	return result, nil
+}
+
+func dumpSpace(s *Space) DumpSpace {
+	d := DumpSpace{Space: s.Space, Tags: s.Tags, Notes: s.Notes, List: make([]DumpValue, 0, len(s.List))}
+	for _, v := range s.List {
+		d.List = append(d.List, DumpValue{
+			Seq:    v.Seq,
+			Name:   v.Name,
+			Values: v.Values,
+			Tags:   v.Tags,
+			Notes:  v.Notes,
+		})
+	}
+	return d
+}
+
+// toSpace converts the dump to a space named space with values in Seq order.
+// Redacted values keep the value of the same name in cur or are dropped.
+func (d DumpSpace) toSpace(space string, cur *Space) *Space {
+	list := append([]DumpValue(nil), d.List...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+
+	s := &Space{Space: space, Tags: d.Tags, Notes: d.Notes}
+	for _, v := range list {
+		if v.Redacted {
+			if cur == nil {
+				continue
+			}
+			if old := cur.FirstValue(v.Name); old.Name != "" {
+				v.Values = old.Values
+			} else {
+				continue
+			}
+		}
+
+		s.List = append(s.List, Value{
+			Space:  space,
+			Seq:    uint64(len(s.List)),
+			Name:   v.Name,
+			Values: append([]string(nil), v.Values...),
+			Tags:   v.Tags,
+			Notes:  v.Notes,
+		})
+	}
+
+	return s
+}
+
+// mergeSpace updates cur with the tags, notes and values of s. Values are
+// matched by name. New values are added after the existing ones.
+func mergeSpace(cur, s *Space) *Space {
+	out := &Space{Space: s.Space, Tags: unionStrings(cur.Tags, s.Tags), Notes: cur.Notes}
+	if len(s.Notes) > 0 {
+		out.Notes = s.Notes
+	}
+
+	update := make(map[string]Value, len(s.List))
+	for _, v := range s.List {
+		update[v.Name] = v
+	}
+
+	for _, v := range cur.List {
+		if u, ok := update[v.Name]; ok {
+			v = u
+			delete(update, v.Name)
+		}
+		v.Seq = uint64(len(out.List))
+		out.List = append(out.List, v)
+	}
+	for _, v := range s.List {
+		if _, ok := update[v.Name]; ok {
+			v.Seq = uint64(len(out.List))
+			out.List = append(out.List, v)
+		}
+	}
+
+	return out
+}
+
+// mergeRules adds the lines of each value in s to the value of the same name in cur.
+func mergeRules(cur, s *Space) *Space {
+	out := &Space{Space: cur.Space, Tags: cur.Tags, Notes: cur.Notes}
+	lines := make(map[string][]string, len(s.List))
+	for _, v := range s.List {
+		lines[v.Name] = v.Values
+	}
+
+	for _, v := range cur.List {
+		if add, ok := lines[v.Name]; ok {
+			v.Values = unionStrings(v.Values, add)
+			delete(lines, v.Name)
+		}
+		v.Seq = uint64(len(out.List))
+		out.List = append(out.List, v)
+	}
+	for _, v := range s.List {
+		if _, ok := lines[v.Name]; ok {
+			v.Seq = uint64(len(out.List))
+			out.List = append(out.List, v)
+		}
+	}
+
+	return out
+}
+
+// filterRuleLines keeps the lines of rule values whose match field passes fn.
+func filterRuleLines(s *Space, field int, fn func(string) bool) *Space {
+	out := &Space{Space: s.Space, Tags: s.Tags, Notes: s.Notes}
+	for _, v := range s.List {
+		var lines []string
+		for _, line := range v.Values {
+			f := strings.Fields(line)
+			if len(f) > field && fn(f[field]) {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			v.Values = lines
+			out.List = append(out.List, v)
+		}
+	}
+	return out
+}
+
+func rewriteRuleLine(line string, field int, fn func(string) string) string {
+	f := strings.Fields(line)
+	if len(f) <= field {
+		return line
+	}
+	f[field] = fn(f[field])
+	return strings.Join(f, " ")
+}
+
+func unionStrings(a, b []string) []string {
+	out := append([]string(nil), a...)
+	seen := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		seen[s] = struct{}{}
+	}
+	for _, s := range b {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package mercury
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
+)
+
+type rulesHandler struct {
+	*memHandler
+	rules Rules
+}
+
+func (h rulesHandler) GetRules(context.Context, ident.Ident) (Rules, error) { return h.rules, nil }
+
+func TestExportImport(t *testing.T) {
+	Convey("Given spaces under a namespace", t, func() {
+		mem := newMemHandler()
+		mem.spaces["app.staging.db"] = &Space{Space: "app.staging.db", Tags: []string{"db"}, List: []Value{
+			{Space: "app.staging.db", Seq: 0, Name: "host", Values: []string{"db.staging"}},
+			{Space: "app.staging.db", Seq: 1, Name: "password", Values: []string{"hunter2"}, Tags: []string{SecretTag}},
+		}}
+		mem.spaces["app.staging.web"] = &Space{Space: "app.staging.web", Notes: []string{"web"}}
+		mem.spaces["app.prod.db"] = &Space{Space: "app.prod.db", List: []Value{
+			{Space: "app.prod.db", Seq: 0, Name: "password", Values: []string{"prodpass"}, Tags: []string{SecretTag}},
+			{Space: "app.prod.db", Seq: 1, Name: "pool", Values: []string{"10"}},
+		}}
+		mem.spaces["app.prod.old"] = &Space{Space: "app.prod.old", Notes: []string{"old"}}
+		mem.spaces["config.policy"] = &Space{Space: "config.policy", List: []Value{
+			{Space: "config.policy", Seq: 0, Name: "ops", Values: []string{"read NS app.staging.*", "read NS other.*"}},
+		}}
+
+		rules := Rules{
+			{Role: "read", Type: "NS", Match: "*"},
+			{Role: "write", Type: "NS", Match: "*"},
+			{Role: "admin", Type: "NS", Match: "config.*"},
+		}
+
+		old := Registry
+		Registry = HandlerList{{Match: "*", HandlerV2: rulesHandler{mem, rules}}}
+		Reset(func() { Registry = old })
+
+		user := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+		ctx := context.Background()
+
+		Convey("export redacts secrets and includes matching rules", func() {
+			dump, err := Export(ctx, user, "app.staging.*")
+			So(err, ShouldBeNil)
+			So(dump.Spaces, ShouldHaveLength, 2)
+			So(dump.Spaces[0].Space, ShouldEqual, "app.staging.db")
+			So(dump.Spaces[0].List[1].Values, ShouldResemble, []string{"****"})
+			So(dump.Spaces[0].List[1].Redacted, ShouldBeTrue)
+			So(dump.Spaces[0].List[0].Redacted, ShouldBeFalse)
+			So(dump.Rules, ShouldHaveLength, 1)
+			So(dump.Rules[0].List[0].Values, ShouldResemble, []string{"read NS app.staging.*"})
+
+			Convey("the archive formats round trip", func() {
+				for _, format := range []string{FormatJSON, FormatTar} {
+					var buf bytes.Buffer
+					So(WriteDump(&buf, dump, format), ShouldBeNil)
+
+					got, err := ReadDump(&buf)
+					So(err, ShouldBeNil)
+					So(got.Namespace, ShouldEqual, dump.Namespace)
+					So(got.Spaces, ShouldResemble, dump.Spaces)
+					So(got.Rules, ShouldResemble, dump.Rules)
+				}
+			})
+
+			Convey("dumps larger than the limit are refused", func() {
+				old := MaxDumpSize
+				MaxDumpSize = 64
+				defer func() { MaxDumpSize = old }()
+
+				for _, format := range []string{FormatJSON, FormatTar} {
+					var buf bytes.Buffer
+					So(WriteDump(&buf, dump, format), ShouldBeNil)
+
+					_, err := ReadDump(&buf)
+					So(errors.Is(err, ErrDumpTooLarge), ShouldBeTrue)
+				}
+			})
+
+			Convey("a merge import rewrites spaces and rules", func() {
+				opts := ImportOptions{Mode: ImportMerge, From: "app.staging.*", To: "app.prod.*"}
+				result, err := Import(ctx, user, dump, opts)
+				So(err, ShouldBeNil)
+				So(result.Written, ShouldResemble, []string{"app.prod.db", "app.prod.web", "config.policy"})
+				So(result.Removed, ShouldBeEmpty)
+
+				db := mem.spaces["app.prod.db"]
+				So(db.Tags, ShouldResemble, []string{"db"})
+				So(db.List, ShouldHaveLength, 3)
+				So(db.FirstValue("password").Values, ShouldResemble, []string{"prodpass"})
+				So(db.FirstValue("pool").Values, ShouldResemble, []string{"10"})
+				So(db.FirstValue("host").Values, ShouldResemble, []string{"db.staging"})
+				So(mem.spaces, ShouldContainKey, "app.prod.old")
+
+				policy := mem.spaces["config.policy"]
+				So(policy.List[0].Values, ShouldResemble, []string{"read NS app.staging.*", "read NS other.*", "read NS app.prod.*"})
+			})
+
+			Convey("a replace import removes other spaces", func() {
+				opts := ImportOptions{Mode: ImportReplace, From: "app.staging.*", To: "app.prod.*"}
+				result, err := Import(ctx, user, dump, opts)
+				So(err, ShouldBeNil)
+				So(result.Removed, ShouldResemble, []string{"app.prod.old"})
+
+				db := mem.spaces["app.prod.db"]
+				So(db.List, ShouldHaveLength, 2)
+				So(db.FirstValue("password").Values, ShouldResemble, []string{"prodpass"})
+				So(mem.spaces, ShouldNotContainKey, "app.prod.old")
+			})
+		})
+
+		Convey("rules are not exported or imported without admin", func() {
+			Registry[0].HandlerV2 = rulesHandler{mem, rules[:2]}
+
+			dump, err := Export(ctx, user, "app.staging.*")
+			So(err, ShouldBeNil)
+			So(dump.Rules, ShouldBeEmpty)
+
+			dump.Rules = []DumpSpace{{Space: "config.policy", List: []DumpValue{{Name: "ops", Values: []string{"admin NS *"}}}}}
+			result, err := Import(ctx, user, dump, ImportOptions{})
+			So(err, ShouldBeNil)
+			So(result.Skipped, ShouldResemble, []string{"config.policy"})
+			So(mem.spaces["config.policy"].List[0].Values, ShouldHaveLength, 2)
+		})
+	})
+}
+
+func TestParseRewrite(t *testing.T) {
+	Convey("Rewrites are read as from:to", t, func() {
+		from, to, err := ParseRewrite("svc.staging.*:svc.prod.*")
+		So(err, ShouldBeNil)
+		So(from, ShouldEqual, "svc.staging.*")
+		So(to, ShouldEqual, "svc.prod.*")
+
+		opts := ImportOptions{From: from, To: to}
+		So(opts.rewrite("svc.staging.db"), ShouldEqual, "svc.prod.db")
+		So(opts.rewrite("svc.dev.db"), ShouldEqual, "svc.dev.db")
+
+		_, _, err = ParseRewrite("svc.staging.*")
+		So(err, ShouldNotBeNil)
+	})
+}
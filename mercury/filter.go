@@ -0,0 +1,221 @@
+package mercury
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sour.is/x/toolbox/dbm/rsql"
+)
+
+// Filter returns the spaces with values limited to those matching the search
+// program and the list of fields. A space is dropped when a search is given
+// and none of its values match. Fields may contain glob patterns.
+func (lis Config) Filter(pgm *rsql.Program, fields []string) (out Config) {
+	hasSearch := pgm != nil && len(pgm.Statements) > 0
+	if !hasSearch && len(fields) == 0 {
+		return lis
+	}
+
+	for _, s := range lis {
+		space := *s
+		space.List = nil
+
+		for _, v := range s.List {
+			if !v.MatchFields(fields) || !v.Match(pgm) {
+				continue
+			}
+			space.List = append(space.List, v)
+		}
+
+		if hasSearch && len(space.List) == 0 {
+			continue
+		}
+
+		out = append(out, &space)
+	}
+
+	return
+}
+
+// MatchFields returns true if the value name matches any of the fields.
+// An empty list of fields matches everything.
+func (v Value) MatchFields(fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+
+	for _, f := range fields {
+		if likeMatch(f, v.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns true if the value satisfies the rsql program.
+// Supported identifiers are space, seq, name, value(s), tag(s) and note(s).
+// Identifiers with many values match if any of them satisfy the comparison.
+// A nil or empty program matches everything.
+func (v Value) Match(pgm *rsql.Program) bool {
+	if pgm == nil {
+		return true
+	}
+
+	for _, stmt := range pgm.Statements {
+		var expr rsql.Expression
+		switch s := stmt.(type) {
+		case *rsql.ExpressionStatement:
+			expr = s.Expression
+		case rsql.ExpressionStatement:
+			expr = s.Expression
+		}
+
+		if !v.evalExpression(expr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v Value) evalExpression(in rsql.Expression) bool {
+	e, ok := in.(*rsql.InfixExpression)
+	if !ok {
+		return false
+	}
+
+	switch e.Token.Type {
+	case rsql.TokAND:
+		return v.evalExpression(e.Left) && v.evalExpression(e.Right)
+	case rsql.TokOR:
+		return v.evalExpression(e.Left) || v.evalExpression(e.Right)
+	}
+
+	id, ok := e.Left.(*rsql.Identifier)
+	if !ok {
+		return false
+	}
+	lhs, ok := v.field(id.Value)
+	if !ok {
+		return false
+	}
+	rhs, isNull := decodeValues(e.Right)
+
+	switch e.Token.Type {
+	case rsql.TokEQ:
+		if isNull {
+			return len(lhs) == 0
+		}
+		return anyMatch(lhs, rhs, func(a, b string) bool { return a == b })
+	case rsql.TokNEQ:
+		if isNull {
+			return len(lhs) > 0
+		}
+		return !anyMatch(lhs, rhs, func(a, b string) bool { return a == b })
+	case rsql.TokLIKE:
+		return anyMatch(lhs, rhs, func(a, b string) bool { return likeMatch(b, a) })
+	case rsql.TokNLIKE:
+		return !anyMatch(lhs, rhs, func(a, b string) bool { return likeMatch(b, a) })
+	case rsql.TokLT:
+		return anyMatch(lhs, rhs, func(a, b string) bool { return compare(a, b) < 0 })
+	case rsql.TokLE:
+		return anyMatch(lhs, rhs, func(a, b string) bool { return compare(a, b) <= 0 })
+	case rsql.TokGT:
+		return anyMatch(lhs, rhs, func(a, b string) bool { return compare(a, b) > 0 })
+	case rsql.TokGE:
+		return anyMatch(lhs, rhs, func(a, b string) bool { return compare(a, b) >= 0 })
+	}
+
+	return false
+}
+
+func (v Value) field(name string) ([]string, bool) {
+	switch strings.ToLower(name) {
+	case "space":
+		return []string{v.Space}, true
+	case "seq":
+		return []string{strconv.FormatUint(v.Seq, 10)}, true
+	case "name":
+		return []string{v.Name}, true
+	case "value", "values":
+		return v.Values, true
+	case "tag", "tags":
+		return v.Tags, true
+	case "note", "notes":
+		return v.Notes, true
+	}
+
+	return nil, false
+}
+
+func decodeValues(in rsql.Expression) (lis []string, isNull bool) {
+	switch e := in.(type) {
+	case *rsql.Array:
+		for _, el := range e.Elements {
+			v, _ := decodeValues(el)
+			lis = append(lis, v...)
+		}
+		return lis, false
+	case *rsql.String:
+		return []string{e.Value}, false
+	case *rsql.Identifier:
+		return []string{e.Value}, false
+	case *rsql.Null:
+		return nil, true
+	case nil:
+		return nil, false
+	}
+
+	return []string{in.TokenLiteral()}, false
+}
+
+func anyMatch(lhs, rhs []string, fn func(a, b string) bool) bool {
+	for _, a := range lhs {
+		for _, b := range rhs {
+			if fn(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compare orders numerically when both sides are numbers and lexically otherwise.
+func compare(a, b string) int {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// likeMatch matches s against a pattern where '*' matches any run of characters.
+func likeMatch(pattern, s string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == s
+	}
+
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	re, err := regexp.Compile(fmt.Sprintf("^%s$", strings.Join(parts, ".*")))
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(s)
+}
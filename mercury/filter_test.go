@@ -0,0 +1,101 @@
+package mercury
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+)
+
+func TestValue_Match(t *testing.T) {
+	v := Value{
+		Space:  "svc.api",
+		Seq:    3,
+		Name:   "db_host",
+		Values: []string{"db01.example.com", "db02.example.com"},
+		Tags:   []string{"secret", "env/prod"},
+		Notes:  []string{"primary database"},
+	}
+
+	tests := []struct {
+		search string
+		want   bool
+	}{
+		{"", true},
+		{"name==db_host", true},
+		{"name!=db_host", false},
+		{"name~db_*", true},
+		{"name~web_*", false},
+		{"name~db_*;tag==secret", true},
+		{"name~db_*;tag==public", false},
+		{"name~web_*,tag==secret", true},
+		{"value~'*db02*'", true},
+		{"value==[db03.example.com,db01.example.com]", true},
+		{"tag~env/*", true},
+		{"note==null", false},
+		{"space==svc.api", true},
+		{"seq>2", true},
+		{"seq<=2", false},
+		{"unknown==foo", false},
+	}
+
+	Convey("Given a value", t, func() {
+		for _, tt := range tests {
+			Convey("search "+tt.search, func() {
+				So(v.Match(rsql.DefaultParse(tt.search)), ShouldEqual, tt.want)
+			})
+		}
+	})
+}
+
+func TestConfig_Filter(t *testing.T) {
+	lis := Config{
+		&Space{
+			Space: "svc.api",
+			List: []Value{
+				{Name: "db_host", Values: []string{"db01"}, Tags: []string{"secret"}},
+				{Name: "db_user", Values: []string{"api"}},
+				{Name: "port", Values: []string{"8080"}},
+			},
+		},
+		&Space{
+			Space: "svc.web",
+			List: []Value{
+				{Name: "port", Values: []string{"80"}},
+			},
+		},
+	}
+
+	Convey("Given a config", t, func() {
+		Convey("no search or fields returns all", func() {
+			So(lis.Filter(nil, nil), ShouldResemble, lis)
+		})
+
+		Convey("search drops spaces without matches", func() {
+			out := lis.Filter(rsql.DefaultParse("name~db_*;tag==secret"), nil)
+			So(out, ShouldHaveLength, 1)
+			So(out[0].Space, ShouldEqual, "svc.api")
+			So(out[0].List, ShouldHaveLength, 1)
+			So(out[0].List[0].Name, ShouldEqual, "db_host")
+		})
+
+		Convey("fields project requested keys", func() {
+			out := lis.Filter(nil, []string{"port"})
+			So(out, ShouldHaveLength, 2)
+			So(out[0].List, ShouldHaveLength, 1)
+			So(out[0].List[0].Name, ShouldEqual, "port")
+			So(out[1].List, ShouldHaveLength, 1)
+		})
+
+		Convey("fields accept globs", func() {
+			out := lis.Filter(nil, []string{"db_*"})
+			So(out[0].List, ShouldHaveLength, 2)
+			So(out[1].List, ShouldHaveLength, 0)
+		})
+
+		Convey("source is not modified", func() {
+			lis.Filter(rsql.DefaultParse("name==port"), nil)
+			So(lis[0].List, ShouldHaveLength, 3)
+		})
+	})
+}
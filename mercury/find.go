@@ -0,0 +1,205 @@
+package mercury
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+)
+
+// Query finds values across spaces. Empty criteria match anything and the
+// others must all match the same value.
+type Query struct {
+	// Name is the key name. It may use * wildcards.
+	Name string `json:"name,omitempty"`
+	// Value is a substring of any of the values.
+	Value string `json:"value,omitempty"`
+	// Regex is a regular expression matched against each of the values.
+	Regex string `json:"regex,omitempty"`
+	// Tag is a tag on the value or its space.
+	Tag string `json:"tag,omitempty"`
+}
+
+// Searcher is implemented by handlers that can find values without reading
+// every space. Results may include extra values. They are checked again
+// with Query.Filter.
+type Searcher interface {
+	Search(context.Context, NamespaceSearch, Query) (Config, error)
+}
+
+// IsEmpty returns true if the query has no criteria.
+func (q Query) IsEmpty() bool {
+	return q.Name == "" && q.Value == "" && q.Regex == "" && q.Tag == ""
+}
+
+// Validate checks the query has criteria and the regex compiles.
+func (q Query) Validate() error {
+	if q.IsEmpty() {
+		return fmt.Errorf("search requires name, value, regex or tag")
+	}
+	if q.Regex != "" {
+		if _, err := regexp.Compile(q.Regex); err != nil {
+			return fmt.Errorf("search regex: %v", err)
+		}
+	}
+	return nil
+}
+
+func (q Query) String() string {
+	var lis []string
+	for _, f := range [][2]string{{"name", q.Name}, {"value", q.Value}, {"regex", q.Regex}, {"tag", q.Tag}} {
+		if f[1] != "" {
+			lis = append(lis, f[0]+"="+f[1])
+		}
+	}
+	return strings.Join(lis, ";")
+}
+
+// Filter returns the spaces with only the values that match. Spaces without
+// a match are dropped.
+func (q Query) Filter(lis Config) (Config, error) {
+	var re *regexp.Regexp
+	if q.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(q.Regex); err != nil {
+			return nil, fmt.Errorf("search regex: %v", err)
+		}
+	}
+
+	var out Config
+	for _, s := range lis {
+		space := *s
+		space.List = nil
+
+		spaceTag := q.Tag != "" && hasString(s.Tags, q.Tag)
+		for _, v := range s.List {
+			if q.match(v, re, spaceTag) {
+				space.List = append(space.List, v)
+			}
+		}
+
+		if len(space.List) > 0 {
+			out = append(out, &space)
+		}
+	}
+
+	return out, nil
+}
+
+func (q Query) match(v Value, re *regexp.Regexp, spaceTag bool) bool {
+	if q.Name != "" && !likeMatch(q.Name, v.Name) {
+		return false
+	}
+	if q.Tag != "" && !spaceTag && !hasString(v.Tags, q.Tag) {
+		return false
+	}
+	if q.Value != "" && !anyMatch(v.Values, []string{q.Value}, strings.Contains) {
+		return false
+	}
+	if re == nil {
+		return true
+	}
+	for _, a := range v.Values {
+		if re.MatchString(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(lis []string, s string) bool {
+	for _, v := range lis {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchContext finds the values that match the query in each handler that
+// matches the namespace. Handlers that implement Searcher are asked to find
+// them and the others are read and scanned.
+func (hl HandlerList) SearchContext(ctx context.Context, match string, q Query) (out Config, err error) {
+	spec := ParseNamespace(match)
+	matches := hl.matchSearch(spec)
+
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		if len(matches[i]) == 0 {
+			return nil, nil
+		}
+
+		log.Debug("SEARCH ", hldr.Match, " ", q)
+		lis, err := Config(nil), ErrNotSupported
+		if s, ok := hldr.HandlerV2.(Searcher); ok {
+			lis, err = s.Search(ctx, matches[i], q)
+		}
+		if errors.Is(err, ErrNotSupported) {
+			lis, err = hldr.GetObjects(ctx, matches[i], nil, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return q.Filter(lis)
+	})
+
+	for _, r := range results {
+		if arr, ok := r.(Config); ok {
+			out = append(out, arr...)
+		}
+	}
+
+	return
+}
+
+// Find returns the values that match the query in the spaces the user can
+// read. Secret values are redacted before matching so a search can not be
+// used to probe them.
+func Find(ctx context.Context, user ident.Ident, space string, q Query) (Config, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if space == "" {
+		space = "*"
+	}
+
+	// Handler failures are returned with the results of the others.
+	var partial HandlerErrors
+
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	ns := rules.ReduceSearch(ParseNamespace(space))
+	if len(ns) == 0 {
+		return nil, nil
+	}
+
+	lis, err := Registry.SearchContext(ctx, ns.String(), q)
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if lis, err = rules.filterSpace(lis); err != nil {
+		return nil, err
+	}
+	if lis, err = q.Filter(rules.Redact(lis)); err != nil {
+		return nil, err
+	}
+	sort.Sort(lis)
+
+	if len(partial) > 0 {
+		return lis, partial
+	}
+	return lis, nil
+}
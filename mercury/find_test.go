@@ -0,0 +1,114 @@
+package mercury
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident/mock"
+)
+
+// searchHandler records the queries it is asked and returns every space.
+type searchHandler struct {
+	*memHandler
+	queries []Query
+}
+
+func (h *searchHandler) Search(ctx context.Context, search NamespaceSearch, q Query) (Config, error) {
+	h.queries = append(h.queries, q)
+	return h.GetObjects(ctx, search, nil, nil)
+}
+
+func TestQuery_Filter(t *testing.T) {
+	lis := Config{
+		{Space: "app.db", Tags: []string{"prod"}, List: []Value{
+			{Name: "host", Values: []string{"db01.example.com"}},
+			{Name: "port", Values: []string{"5432"}, Tags: []string{"net"}},
+		}},
+		{Space: "app.web", List: []Value{
+			{Name: "upstream", Values: []string{"web01", "db01"}, Tags: []string{"net"}},
+		}},
+	}
+
+	tests := []struct {
+		query Query
+		want  string
+	}{
+		{Query{Value: "db01"}, "app.db host\napp.web upstream\n"},
+		{Query{Name: "ho*"}, "app.db host\n"},
+		{Query{Regex: "^db\\d+$"}, "app.web upstream\n"},
+		{Query{Tag: "net"}, "app.db port\napp.web upstream\n"},
+		{Query{Tag: "prod"}, "app.db host\napp.db port\n"},
+		{Query{Tag: "net", Value: "db01"}, "app.web upstream\n"},
+		{Query{Value: "none"}, ""},
+	}
+
+	Convey("Given spaces to search", t, func() {
+		for _, tt := range tests {
+			Convey(tt.query.String(), func() {
+				out, err := tt.query.Filter(lis)
+				So(err, ShouldBeNil)
+
+				got := ""
+				for _, s := range out {
+					for _, v := range s.List {
+						got += s.Space + " " + v.Name + "\n"
+					}
+				}
+				So(got, ShouldEqual, tt.want)
+			})
+		}
+
+		Convey("an invalid regex fails", func() {
+			So(Query{Regex: "("}.Validate(), ShouldNotBeNil)
+			So(Query{}.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFind(t *testing.T) {
+	Convey("Given handlers with and without search", t, func() {
+		mem := newMemHandler()
+		mem.spaces["app.db"] = &Space{Space: "app.db", List: []Value{
+			{Space: "app.db", Name: "host", Values: []string{"db01"}},
+			{Space: "app.db", Name: "password", Values: []string{"db01pass"}, Tags: []string{SecretTag}},
+		}}
+		mem.spaces["hidden.db"] = &Space{Space: "hidden.db", List: []Value{
+			{Space: "hidden.db", Name: "host", Values: []string{"db01"}},
+		}}
+
+		searcher := &searchHandler{memHandler: newMemHandler()}
+		searcher.spaces["svc.web"] = &Space{Space: "svc.web", List: []Value{
+			{Space: "svc.web", Name: "upstream", Values: []string{"db01", "web01"}},
+			{Space: "svc.web", Name: "port", Values: []string{"80"}},
+		}}
+
+		rules := Rules{{Role: "read", Type: "NS", Match: "app.*"}, {Role: "read", Type: "NS", Match: "svc.*"}}
+
+		old := Registry
+		Registry = HandlerList{
+			{Match: "svc.*", Priority: 2, HandlerV2: searcher},
+			{Match: "*", Priority: 1, HandlerV2: rulesHandler{mem, rules}},
+		}
+		Reset(func() { Registry = old })
+
+		user := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+
+		Convey("values are found in the readable spaces", func() {
+			lis, err := Find(context.Background(), user, "", Query{Value: "db01"})
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "app.db\nsvc.web\n")
+			So(lis[0].List, ShouldHaveLength, 1)
+			So(lis[0].List[0].Name, ShouldEqual, "host")
+			So(lis[1].List, ShouldHaveLength, 1)
+			So(lis[1].List[0].Name, ShouldEqual, "upstream")
+			So(searcher.queries, ShouldResemble, []Query{{Value: "db01"}})
+		})
+
+		Convey("secrets can not be probed", func() {
+			lis, err := Find(context.Background(), user, "app.*", Query{Value: "pass"})
+			So(err, ShouldBeNil)
+			So(lis, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,378 @@
+package git // import "sour.is/x/toolbox/mercury/git"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/mercury"
+)
+
+// Ext is the file extension for space files.
+const Ext = ".mercury"
+
+// Handler stores each space as a file in the working tree of a git
+// repository. Every write is a commit authored by the writer.
+type Handler struct {
+	// Dir is the working tree.
+	Dir string
+
+	// Remote is an optional repository, such as a local bare repo, that the
+	// working tree is synced with before each write and pushed to after.
+	Remote string
+
+	// Name and Email are used as the committer and as the author when the
+	// writer is not known.
+	Name  string
+	Email string
+
+	match string
+	mu    sync.RWMutex
+}
+
+var handlers struct {
+	sync.Mutex
+	lis []*Handler
+}
+
+// New opens the repository in dir. If there is none it is cloned from
+// remote, or created when remote is empty.
+func New(dir, remote string) (*Handler, error) {
+	h := &Handler{Dir: dir, Remote: remote, Name: "mercury", Email: "mercury@localhost"}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return h, nil
+	}
+
+	ctx := context.Background()
+	if remote != "" {
+		if _, err := run(ctx, "", nil, "clone", "-q", remote, dir); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	if _, err := run(ctx, "", nil, "init", "-q", dir); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Config registers a handler from the mercury.git settings dir, remote,
+// match and priority. Nothing is registered if dir is not set.
+func Config() error {
+	dir := viper.GetString("mercury.git.dir")
+	if dir == "" {
+		return nil
+	}
+
+	h, err := New(dir, viper.GetString("mercury.git.remote"))
+	if err != nil {
+		return err
+	}
+
+	match := viper.GetString("mercury.git.match")
+	if match == "" {
+		match = "*"
+	}
+
+	Register(match, viper.GetInt("mercury.git.priority"), h)
+	return nil
+}
+
+// Register adds the handler to the mercury registry.
+func Register(match string, priority int, h *Handler) {
+	h.match = match
+
+	handlers.Lock()
+	handlers.lis = append(handlers.lis, h)
+	handlers.Unlock()
+
+	mercury.RegisterV2(match, priority, h)
+}
+
+// GetIndex implements mercury.HandlerV2
+func (h *Handler) GetIndex(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program) (lis mercury.Config, err error) {
+	lis, err = h.read(ctx, search)
+	for _, s := range lis {
+		s.List = nil
+	}
+	return
+}
+
+// GetObjects implements mercury.HandlerV2
+func (h *Handler) GetObjects(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (mercury.Config, error) {
+	lis, err := h.read(ctx, search)
+	if err != nil {
+		return nil, err
+	}
+	return lis.Filter(pgm, fields), nil
+}
+
+// GetRules implements mercury.HandlerV2
+func (*Handler) GetRules(context.Context, ident.Ident) (mercury.Rules, error) {
+	return nil, nil
+}
+
+// GetNotify implements mercury.HandlerV2
+func (*Handler) GetNotify(context.Context, string) (mercury.ListNotify, error) {
+	return nil, nil
+}
+
+// WriteObjects implements mercury.HandlerV2
+// The spaces are written and committed as the ident in the context. Empty
+// spaces are removed. If a remote is set the commit is pushed to it.
+func (h *Handler) WriteObjects(ctx context.Context, lis mercury.Config) error {
+	if len(lis) == 0 {
+		return nil
+	}
+
+	for _, s := range lis {
+		if !validSpace(s.Space) {
+			return fmt.Errorf("invalid space name: %q", s.Space)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.pull(ctx); err != nil {
+		return err
+	}
+
+	prev, _ := h.git(ctx, "rev-parse", "-q", "--verify", "HEAD")
+	prev = strings.TrimSpace(prev)
+
+	err := h.commit(ctx, lis)
+	if err != nil {
+		h.reset(prev)
+	}
+
+	return err
+}
+
+func (h *Handler) commit(ctx context.Context, lis mercury.Config) error {
+	names := make([]string, 0, len(lis))
+	for _, s := range lis {
+		file := s.Space + Ext
+		names = append(names, s.Space)
+
+		if len(s.List) == 0 && len(s.Tags) == 0 && len(s.Notes) == 0 {
+			if _, err := h.git(ctx, "rm", "-q", "--ignore-unmatch", "--", file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := ioutil.WriteFile(filepath.Join(h.Dir, file), []byte(mercury.Config{s}.String()), 0644)
+		if err != nil {
+			return err
+		}
+		if _, err = h.git(ctx, "add", "--", file); err != nil {
+			return err
+		}
+	}
+
+	// Nothing to commit if the files did not change.
+	if _, err := h.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+
+	msg := "Update " + strings.Join(names, ", ")
+	if _, err := h.git(ctx, "commit", "-q", "-m", msg, "--author", h.author(ctx)); err != nil {
+		return err
+	}
+
+	if h.Remote == "" {
+		return nil
+	}
+
+	_, err := h.git(ctx, "push", "-q", "origin", "HEAD")
+	return err
+}
+
+// Pull fast forwards the working tree to the remote so reads see changes
+// made by others.
+func (h *Handler) Pull(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.pull(ctx)
+}
+
+func (h *Handler) pull(ctx context.Context) error {
+	if h.Remote == "" {
+		return nil
+	}
+
+	if _, err := h.git(ctx, "fetch", "-q", "origin"); err != nil {
+		return err
+	}
+
+	branch, err := h.git(ctx, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return err
+	}
+	upstream := "origin/" + strings.TrimSpace(branch)
+
+	// The remote may have no commits yet.
+	if _, err := h.git(ctx, "rev-parse", "-q", "--verify", upstream); err != nil {
+		return nil
+	}
+
+	_, err = h.git(ctx, "merge", "-q", "--ff-only", upstream)
+	return err
+}
+
+// reset drops a failed write from the working tree and index.
+func (h *Handler) reset(prev string) {
+	ctx := context.Background()
+
+	var err error
+	if prev == "" {
+		// There was no commit to go back to. The branch may not exist yet.
+		h.git(ctx, "update-ref", "-d", "HEAD")
+		_, err = h.git(ctx, "rm", "-q", "-r", "--cached", "--ignore-unmatch", ".")
+	} else {
+		_, err = h.git(ctx, "reset", "-q", "--hard", prev)
+	}
+	if err == nil {
+		_, err = h.git(ctx, "clean", "-q", "-f", "--", "*"+Ext)
+	}
+	if err != nil {
+		log.Errors("mercury git reset failed", "dir", h.Dir, "err", err)
+	}
+}
+
+// author returns the commit author for the identity in ctx. Characters that
+// would end the name or email early are replaced.
+func (h *Handler) author(ctx context.Context) string {
+	id := ident.GetContextIdent(ctx)
+	if id == nil || id.GetIdentity() == "" {
+		return fmt.Sprintf("%s <%s>", h.Name, h.Email)
+	}
+
+	name := cleanAuthor(id.GetDisplay())
+	if name == "" {
+		name = cleanAuthor(id.GetIdentity())
+	}
+
+	email := cleanAuthor(id.GetIdentity())
+	if !strings.Contains(email, "@") {
+		email += "@" + cleanAuthor(id.GetAspect())
+	}
+
+	if name == "" || email == "" {
+		return fmt.Sprintf("%s <%s>", h.Name, h.Email)
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+var authorReplacer = strings.NewReplacer("<", "", ">", "", "\n", " ", "\r", " ", "\x00", "")
+
+func cleanAuthor(s string) string {
+	return strings.TrimSpace(authorReplacer.Replace(s))
+}
+
+// read parses the space files that match the search.
+func (h *Handler) read(ctx context.Context, search mercury.NamespaceSearch) (lis mercury.Config, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	files, err := filepath.Glob(filepath.Join(h.Dir, "*"+Ext))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		space := strings.TrimSuffix(filepath.Base(file), Ext)
+		if !search.Match(space) {
+			continue
+		}
+
+		s, err := readSpace(file, space)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			lis = append(lis, s)
+		}
+	}
+
+	sort.Sort(lis)
+	return
+}
+
+func readSpace(file, space string) (*mercury.Space, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseSpace(f, space)
+}
+
+func parseSpace(r io.Reader, space string) (*mercury.Space, error) {
+	m, err := mercury.ParseText(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := m[space]
+	if !ok {
+		return nil, nil
+	}
+
+	for i := range s.List {
+		s.List[i].Space = space
+		s.List[i].Seq = uint64(i)
+	}
+
+	return s, nil
+}
+
+func validSpace(space string) bool {
+	return space != "" &&
+		!strings.HasPrefix(space, ".") &&
+		!strings.ContainsAny(space, "/\\\x00")
+}
+
+func (h *Handler) git(ctx context.Context, args ...string) (string, error) {
+	return run(ctx, h.Dir, []string{
+		"GIT_COMMITTER_NAME=" + h.Name,
+		"GIT_COMMITTER_EMAIL=" + h.Email,
+	}, args...)
+}
+
+func run(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
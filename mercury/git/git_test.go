@@ -0,0 +1,141 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
+	"sour.is/x/toolbox/mercury"
+)
+
+func TestHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "mercury-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote.git")
+	if _, err = run(context.Background(), "", nil, "init", "-q", "--bare", remote); err != nil {
+		t.Fatal(err)
+	}
+
+	user := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+	ctx := ident.WithContext(context.Background(), user)
+
+	Convey("Given a handler cloned from a bare repo", t, func() {
+		h, err := New(filepath.Join(dir, "one"), remote)
+		So(err, ShouldBeNil)
+
+		Convey("writes are committed and pushed", func() {
+			space := mercury.NewSpace("app.one").SetTags("prod").SetNotes("the first")
+			space.AddKeys(
+				&mercury.Value{Name: "key", Values: []string{"value"}},
+				&mercury.Value{Name: "list", Values: []string{"a", "b"}, Tags: []string{"secret"}},
+			)
+
+			err := h.WriteObjects(ctx, mercury.Config{space, mercury.NewSpace("app.two").SetNotes("two")})
+			So(err, ShouldBeNil)
+
+			lis, err := h.GetObjects(ctx, mercury.ParseNamespace("app.*"), nil, nil)
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "app.one\napp.two\n")
+			So(lis[0].Tags, ShouldResemble, []string{"prod"})
+			So(lis[0].Notes, ShouldResemble, []string{"the first"})
+			So(lis[0].List, ShouldHaveLength, 2)
+			So(lis[0].List[1].Values, ShouldResemble, []string{"a", "b"})
+			So(lis[0].List[1].Tags, ShouldResemble, []string{"secret"})
+
+			revs, err := h.Revisions(ctx, "app.one", 0)
+			So(err, ShouldBeNil)
+			So(revs, ShouldHaveLength, 1)
+			So(revs[0].Author, ShouldEqual, "Jon")
+			So(revs[0].Email, ShouldEqual, "jon@test")
+
+			Convey("and seen by other clones", func() {
+				other, err := New(filepath.Join(dir, "two"), remote)
+				So(err, ShouldBeNil)
+
+				lis, err := other.GetIndex(ctx, mercury.ParseNamespace("app.one"), nil)
+				So(err, ShouldBeNil)
+				So(lis.StringList(), ShouldEqual, "app.one\n")
+
+				Convey("which pull before they write", func() {
+					err := other.WriteObjects(context.Background(), mercury.Config{mercury.NewSpace("app.two")})
+					So(err, ShouldBeNil)
+
+					So(h.Pull(ctx), ShouldBeNil)
+					lis, err := h.GetIndex(ctx, mercury.ParseNamespace("app.*"), nil)
+					So(err, ShouldBeNil)
+					So(lis.StringList(), ShouldEqual, "app.one\n")
+
+					revs, err := h.Revisions(ctx, "", 0)
+					So(err, ShouldBeNil)
+					So(revs, ShouldHaveLength, 2)
+					So(revs[0].Author, ShouldEqual, "mercury")
+
+					old, err := h.GetSpaceAt(ctx, "app.two", revs[1].ID)
+					So(err, ShouldBeNil)
+					So(old.Notes, ShouldResemble, []string{"two"})
+				})
+			})
+		})
+
+		Convey("unchanged writes do not commit", func() {
+			err := h.WriteObjects(ctx, mercury.Config{mercury.NewSpace("app.none")})
+			So(err, ShouldBeNil)
+
+			revs, err := h.Revisions(ctx, "app.none", 0)
+			So(err, ShouldBeNil)
+			So(revs, ShouldBeEmpty)
+		})
+
+		Convey("invalid space names are rejected", func() {
+			err := h.WriteObjects(ctx, mercury.Config{mercury.NewSpace("../app").SetNotes("x")})
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			os.RemoveAll(filepath.Join(dir, "one"))
+			os.RemoveAll(filepath.Join(dir, "two"))
+			os.RemoveAll(remote)
+			run(context.Background(), "", nil, "init", "-q", "--bare", remote)
+		})
+	})
+}
+
+func TestHandler_author(t *testing.T) {
+	h := &Handler{Name: "mercury", Email: "mercury@localhost"}
+
+	tests := []struct {
+		name string
+		id   ident.Ident
+		want string
+	}{
+		{"anonymous", nil, "mercury <mercury@localhost>"},
+		{"user", mock.NewMock("jon", "test", "Jon", nil, nil, nil, true), "Jon <jon@test>"},
+		{"brackets", mock.NewMock("eve>", "test", "Eve <root@localhost>", nil, nil, nil, true), "Eve root@localhost <eve@test>"},
+		{"newlines", mock.NewMock("eve@x\nSigned-off-by: root", "test", "Eve\r\n", nil, nil, nil, true), "Eve <eve@x Signed-off-by: root>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.id != nil {
+				ctx = ident.WithContext(ctx, tt.id)
+			}
+			if got := h.author(ctx); got != tt.want {
+				t.Errorf("author() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package git
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sour.is/x/toolbox/httpsrv"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/mercury"
+)
+
+func init() {
+	httpsrv.IdentRegister("mercury-git", httpsrv.IdentRoutes{
+		{Name: "get-mercury-revisions", Method: "GET", Pattern: "/v1/mercury-revisions", HandlerFunc: getRevisions},
+	})
+}
+
+// Revision is a commit that changed a space.
+type Revision struct {
+	ID      string    `json:"id"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+}
+
+// Revisions lists the commits that changed the space, newest first. All
+// commits are listed if space is empty. A limit of 0 lists all.
+func (h *Handler) Revisions(ctx context.Context, space string, limit int) (lis []Revision, err error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// git log fails on a repository without commits.
+	if _, err = h.git(ctx, "rev-parse", "-q", "--verify", "HEAD"); err != nil {
+		return nil, nil
+	}
+
+	args := []string{"log", "--format=%H%x1f%an%x1f%ae%x1f%aI%x1f%s"}
+	if limit > 0 {
+		args = append(args, "-n", strconv.Itoa(limit))
+	}
+	if space != "" {
+		args = append(args, "--", space+Ext)
+	}
+
+	out, err := h.git(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) != 5 {
+			continue
+		}
+
+		date, _ := time.Parse(time.RFC3339, f[3])
+		lis = append(lis, Revision{ID: f[0], Author: f[1], Email: f[2], Date: date, Message: f[4]})
+	}
+
+	return
+}
+
+// GetSpaceAt returns the space as it was at a revision.
+// Nil is returned if the space did not exist.
+func (h *Handler) GetSpaceAt(ctx context.Context, space, rev string) (*mercury.Space, error) {
+	if !validSpace(space) || strings.HasPrefix(rev, "-") {
+		return nil, nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, err := h.git(ctx, "cat-file", "-e", rev+":"+space+Ext); err != nil {
+		return nil, nil
+	}
+
+	out, err := h.git(ctx, "show", rev+":"+space+Ext)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSpace(strings.NewReader(out), space)
+}
+
+// swagger:operation GET /v1/mercury-revisions mercury get-mercury-revisions
+//
+// Get Mercury Space Revisions
+//
+// ---
+// parameters:
+//   - name: space
+//     in: query
+//     description: Space
+//     required: true
+//     type: string
+//     format: string
+//   - name: limit
+//     in: query
+//     description: Maximum number of revisions
+//     required: false
+//     type: integer
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: array
+//   "4xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getRevisions(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	space := r.URL.Query().Get("space")
+	if !validSpace(space) {
+		w.WriteError(400, "ERR: space required")
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	ctx := r.Context()
+	rules, err := mercury.Registry.GetRulesContext(ctx, id)
+	if err != nil && len(rules) == 0 {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
+	if !rules.GetRoles("NS", space).HasRole("read", "write") {
+		w.WriteError(403, "NO_ACCESS")
+		return
+	}
+
+	lis := []Revision{}
+
+	handlers.Lock()
+	hdlrs := append([]*Handler(nil), handlers.lis...)
+	handlers.Unlock()
+
+	for _, h := range hdlrs {
+		if ok, _ := filepath.Match(h.match, space); !ok {
+			continue
+		}
+
+		revs, err := h.Revisions(ctx, space, limit)
+		if err != nil {
+			w.WriteError(500, "ERR: "+err.Error())
+			return
+		}
+		lis = append(lis, revs...)
+	}
+
+	w.WriteObject(200, lis)
+}
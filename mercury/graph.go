@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/99designs/gqlgen/graphql"
+	"sour.is/x/toolbox/dbm/rsql"
 	"sour.is/x/toolbox/gql"
 	"sour.is/x/toolbox/ident"
 	"sour.is/x/toolbox/log"
@@ -13,18 +15,92 @@ import (
 // GraphMercury implements the resolvers for gqlgen
 type GraphMercury struct{}
 
-func doConfig(user ident.Ident, space string) ([]*Space, error) {
-	rules := Registry.GetRules(user)
+func doConfig(ctx context.Context, user ident.Ident, space, search string, fields []string, page Page) ([]*Space, error) {
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if err = addPartial(ctx, err); err != nil {
+		return nil, err
+	}
 
 	ns := ParseNamespace(space)
 	ns = rules.ReduceSearch(ns)
 
-	cfg := Registry.GetObjects(ns.String(), "", "")
-	return cfg, nil
+	flds := strings.Join(fields, ",")
+
+	// A value search can drop spaces so the window is taken after filtering.
+	if search != "" || page.Size() == 0 && page.After == "" {
+		cfg, err := Registry.GetObjectsContext(ctx, ns.String(), "", flds)
+		if err = addPartial(ctx, err); err != nil {
+			return nil, err
+		}
+		if cfg, err = rules.filterSpace(cfg); err != nil {
+			return nil, err
+		}
+		cfg = rules.Redact(cfg).Filter(rsql.DefaultParse(search), fields)
+		return page.Apply(cfg), nil
+	}
+
+	idx, err := readableIndex(ctx, rules, ns.String(), page)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx) == 0 {
+		return nil, nil
+	}
+
+	cfg, err := Registry.GetObjectsContext(ctx, strings.Join(idx.stringArray(), ","), "", flds)
+	if err = addPartial(ctx, err); err != nil {
+		return nil, err
+	}
+	return Page{Desc: page.Desc}.Apply(rules.Redact(cfg)), nil
+}
+
+// readableIndex returns the window of the index the rules can read. Pages
+// are read after the cursor until the window is full as spaces the rules
+// can not read are dropped from each.
+func readableIndex(ctx context.Context, rules Rules, match string, page Page) (Config, error) {
+	next := Page{Limit: page.Size(), After: page.After, Desc: page.Desc}
+
+	var lis Config
+	for {
+		idx, err := Registry.GetIndexPageContext(ctx, match, "", next)
+		if err = addPartial(ctx, err); err != nil {
+			return nil, err
+		}
+
+		readable, err := rules.filterSpace(idx)
+		if err != nil {
+			return nil, err
+		}
+		lis = append(lis, readable...)
+
+		if uint64(len(idx)) < next.Limit || uint64(len(lis)) >= page.Size() {
+			break
+		}
+		next.After = idx[len(idx)-1].Space
+	}
+
+	return Page{Limit: page.Limit, Offset: page.Offset, Desc: page.Desc}.Apply(lis), nil
+}
+
+// addPartial reports handler failures on the graphql response so the results
+// of the handlers that succeeded can still be returned.
+func addPartial(ctx context.Context, err error) error {
+	herrs, ok := err.(HandlerErrors)
+	if !ok {
+		return err
+	}
+
+	if graphql.GetRequestContext(ctx) != nil {
+		graphql.AddError(ctx, herrs)
+	}
+
+	return nil
 }
 
 // Config returns a list of config items
-func (GraphMercury) Config(ctx context.Context, search *string, query *gql.QueryInput) (lis []*Space, err error) {
+// The query search is a rsql filter on values and fields limits the value names returned.
+// The query limit, offset, after and sort select a window of spaces.
+func (GraphMercury) Config(ctx context.Context, search *string, query *gql.QueryInput, fields []string) (lis []*Space, err error) {
 	user := ident.GetContextIdent(ctx)
 
 	space := ""
@@ -35,13 +111,46 @@ func (GraphMercury) Config(ctx context.Context, search *string, query *gql.Query
 		space = "*"
 	}
 
-	return doConfig(user, space)
+	filter := ""
+	if query != nil && query.Search != nil {
+		filter = *query.Search
+	}
+
+	return doConfig(ctx, user, space, filter, fields, NewPage(query))
+}
+
+// ConfigSearch finds values by key name, value content or tag across the
+// spaces the user can read.
+func (GraphMercury) ConfigSearch(ctx context.Context, space *string, query Query) ([]*Space, error) {
+	user := ident.GetContextIdent(ctx)
+
+	ns := ""
+	if space != nil {
+		ns = *space
+	}
+
+	lis, err := Find(ctx, user, ns, query)
+	if err = addPartial(ctx, err); err != nil {
+		return nil, err
+	}
+	return lis, nil
+}
+
+// ConfigAncestors returns the ancestors of a space and the merged view of them.
+func (GraphMercury) ConfigAncestors(ctx context.Context, space string) (*Ancestry, error) {
+	user := ident.GetContextIdent(ctx)
+
+	a, err := Resolve(ctx, user, space)
+	if err = addPartial(ctx, err); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
 // WriteConfigText saves a config set formated in text
 func (g GraphMercury) WriteConfigText(ctx context.Context, config string) (result string, err error) {
 	r := strings.NewReader(config)
-	c, err := parseText(r)
+	c, err := ParseText(r)
 	if err != nil {
 		return "ERR", err
 	}
@@ -56,47 +165,38 @@ func (g GraphMercury) WriteConfigText(ctx context.Context, config string) (resul
 // WriteConfig saves a space and attributes to database
 func (GraphMercury) WriteConfig(ctx context.Context, config []*Space) (result string, err error) {
 	user := ident.GetContextIdent(ctx)
-	rules := Registry.GetRules(user)
-
-	notify, err := Registry.GetNotify("updated")
+	rules, err := Registry.GetRulesContext(ctx, user)
 	if err != nil {
 		log.Error(err)
 	}
 
-	var notifyActive = make(map[string]struct{})
-	var filteredConfigs Config
-	for _, c := range config {
-		log.Debug("CHECK ", c.Space, rules)
-		if !rules.GetRoles("NS", c.Space).HasRole("write") {
-			log.Debug("SKIP ", c.Space)
-			continue
-		}
-
-		log.Debug("SAVE", c.Space)
-		for _, n := range notify.Find(c.Space) {
-			notifyActive[n.Name] = struct{}{}
-		}
-		filteredConfigs = append(filteredConfigs, c)
+	_, err = writeSpaces(ctx, rules, config)
+	if err != nil {
+		return
 	}
 
-	err = Registry.WriteObjects(filteredConfigs)
+	return "OK", nil
+}
+
+// PatchConfig applies key level changes to spaces
+func (GraphMercury) PatchConfig(ctx context.Context, patch []*PatchOp) (result string, err error) {
+	user := ident.GetContextIdent(ctx)
+	rules, err := Registry.GetRulesContext(ctx, user)
 	if err != nil {
 		log.Error(err)
-		return
 	}
 
-	log.Debug("SEND NOTIFYS ", notifyActive)
-
-	for _, n := range notify {
-		if _, ok := notifyActive[n.Name]; ok {
-			err = n.sendNotify()
-			if err != nil {
-				log.Debug(err)
-			}
+	lis := make(Patch, 0, len(patch))
+	for _, op := range patch {
+		if op != nil {
+			lis = append(lis, *op)
 		}
 	}
 
-	log.Debug("DONE!")
+	_, err = patchSpaces(ctx, rules, lis)
+	if err != nil {
+		return
+	}
 
 	return "OK", nil
 }
@@ -117,7 +217,7 @@ func NodeMercury(ctx context.Context, id []string) (gql.Node, error) {
 		}
 
 		user := ident.GetContextIdent(ctx)
-		c, err := doConfig(user, id[1])
+		c, err := doConfig(ctx, user, id[1], "", nil, Page{})
 		if err != nil {
 			return nil, err
 		}
@@ -1,10 +1,14 @@
 package mercury
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"sour.is/x/toolbox/dbm/rsql"
 	"sour.is/x/toolbox/ident"
@@ -20,14 +24,41 @@ type Handler interface {
 	GetNotify(string) ListNotify
 }
 
+// HandlerV2 interface for backends that can be cancelled and report errors.
+// Existing handlers are converted with AdaptHandler.
+type HandlerV2 interface {
+	GetIndex(context.Context, NamespaceSearch, *rsql.Program) (Config, error)
+	GetObjects(context.Context, NamespaceSearch, *rsql.Program, []string) (Config, error)
+	WriteObjects(context.Context, Config) error
+	GetRules(context.Context, ident.Ident) (Rules, error)
+	GetNotify(context.Context, string) (ListNotify, error)
+}
+
+// IndexPager is implemented by handlers that can sort and limit their index
+// in the backend. Handlers return at most page.Size() spaces that sort after
+// the page cursor.
+type IndexPager interface {
+	GetIndexPage(NamespaceSearch, *rsql.Program, Page) Config
+}
+
+// IndexPagerV2 is the context aware version of IndexPager.
+type IndexPagerV2 interface {
+	GetIndexPage(context.Context, NamespaceSearch, *rsql.Program, Page) (Config, error)
+}
+
+// DefaultTimeout is used for handlers registered without a timeout.
+var DefaultTimeout = 30 * time.Second
+
 // HandlerItem a single handler matching
 type HandlerItem struct {
-	Handler
+	HandlerV2
 	Match    string
 	Priority int
+	Timeout  time.Duration
 }
 
-// HandlerList a list of handlers
+// HandlerList a list of handlers. Queries that ask several handlers return
+// the results of those that succeeded with HandlerErrors for those that failed.
 type HandlerList []HandlerItem
 
 func (h HandlerItem) String() string {
@@ -49,8 +80,13 @@ func (hl HandlerList) String() string {
 
 // Register add a handler to registry
 func Register(match string, priority int, hdlr Handler) {
+	RegisterV2(match, priority, AdaptHandler(hdlr))
+}
+
+// RegisterV2 add a context aware handler to registry
+func RegisterV2(match string, priority int, hdlr HandlerV2) {
 	log.Infos("mercury regster", "match", match, "pri", priority)
-	Registry = append(Registry, HandlerItem{Match: match, Priority: priority, Handler: hdlr})
+	Registry = append(Registry, HandlerItem{Match: match, Priority: priority, HandlerV2: hdlr})
 	sort.Sort(Registry)
 }
 
@@ -67,27 +103,146 @@ func (hl HandlerList) Less(i, j int) bool {
 // Swap implements Swap for sort.interface
 func (hl HandlerList) Swap(i, j int) { hl[i], hl[j] = hl[j], hl[i] }
 
-// GetIndex query each handler that match namespace.
-func (hl HandlerList) GetIndex(match, search string) (lis Config) {
-	spec := ParseNamespace(match)
-	pgm := rsql.DefaultParse(search)
+// ErrNotSupported is returned from an optional handler method by handlers
+// that wrap another, such as caches, when the wrapped handler does not have
+// it. The registry then falls back as if the method was not implemented.
+var ErrNotSupported = errors.New("not supported by handler")
+
+// HandlerError is the failure of a single handler.
+type HandlerError struct {
+	Match string
+	Err   error
+}
+
+// Error format message as string
+func (e HandlerError) Error() string {
+	return fmt.Sprintf("handler %s: %v", e.Match, e.Err)
+}
+
+// HandlerErrors lists the handlers that failed. Results from the
+// handlers that succeeded are still returned alongside it.
+type HandlerErrors []HandlerError
+
+// Error format message as string
+func (e HandlerErrors) Error() string {
+	lis := make([]string, 0, len(e))
+	for _, err := range e {
+		lis = append(lis, err.Error())
+	}
+	return strings.Join(lis, "; ")
+}
+
+func (h HandlerItem) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultTimeout
+}
+
+// call runs fn bounded by the handler timeout. A handler that does not
+// honour the context is abandoned when the timeout is reached.
+func (h HandlerItem) call(ctx context.Context, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn(ctx)
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// each runs fn for every handler concurrently. Results are returned in
+// handler priority order along with any handler failures.
+func (hl HandlerList) each(ctx context.Context, fn func(ctx context.Context, i int, h HandlerItem) (interface{}, error)) ([]interface{}, error) {
+	results := make([]interface{}, len(hl))
+	errs := make([]error, len(hl))
+
+	var wg sync.WaitGroup
+	for i, hldr := range hl {
+		wg.Add(1)
+		go func(i int, h HandlerItem) {
+			defer wg.Done()
+			results[i], errs[i] = h.call(ctx, func(ctx context.Context) (interface{}, error) {
+				return fn(ctx, i, h)
+			})
+		}(i, hldr)
+	}
+	wg.Wait()
+
+	var herrs HandlerErrors
+	for i, err := range errs {
+		if err != nil {
+			log.Errors("mercury handler failed", "match", hl[i].Match, "err", err)
+			herrs = append(herrs, HandlerError{Match: hl[i].Match, Err: err})
+		}
+	}
+	if len(herrs) > 0 {
+		return results, herrs
+	}
+
+	return results, nil
+}
+
+func (hl HandlerList) matchSearch(spec NamespaceSearch) []NamespaceSearch {
 	matches := make([]NamespaceSearch, len(hl))
 
 	for _, c := range spec {
-		for i, hldr := range hl {
+		// A trace is sent to each handler that holds any of the ancestors.
+		names := []string{c.Value()}
+		if c.Type() == TypeNamespaceTrace {
+			names = Ancestors(c.Raw())
+		}
 
-			ok, err := filepath.Match(hldr.Match, c.Value())
-			if !ok || err != nil {
-				continue
+		for i, hldr := range hl {
+			for _, name := range names {
+				if ok, err := filepath.Match(hldr.Match, name); ok && err == nil {
+					matches[i] = append(matches[i], c)
+					break
+				}
 			}
-			matches[i] = append(matches[i], c)
 		}
 	}
 
-	for i, hldr := range hl {
+	return matches
+}
+
+// GetIndex query each handler that match namespace.
+func (hl HandlerList) GetIndex(match, search string) (lis Config) {
+	lis, err := hl.GetIndexContext(context.Background(), match, search)
+	if err != nil {
+		log.Error(err)
+	}
+	return
+}
+
+// GetIndexContext query each handler that match namespace.
+func (hl HandlerList) GetIndexContext(ctx context.Context, match, search string) (lis Config, err error) {
+	spec := ParseNamespace(match)
+	pgm := rsql.DefaultParse(search)
+	matches := hl.matchSearch(spec)
+
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		if len(matches[i]) == 0 {
+			return nil, nil
+		}
 		log.Debug("INDEX ", hldr.Match)
-		arr := hldr.GetIndex(matches[i], pgm)
-		if arr != nil {
+		return hldr.GetIndex(ctx, matches[i], pgm)
+	})
+
+	for _, r := range results {
+		if arr, ok := r.(Config); ok {
 			lis = append(lis, arr...)
 		}
 	}
@@ -95,30 +250,82 @@ func (hl HandlerList) GetIndex(match, search string) (lis Config) {
 	return
 }
 
-// Search query each handler with a key=value search
+// GetIndexPage query each handler that match namespace for a window of spaces.
+// Handlers that implement IndexPager are asked for no more than the page needs.
+func (hl HandlerList) GetIndexPage(match, search string, page Page) Config {
+	lis, err := hl.GetIndexPageContext(context.Background(), match, search, page)
+	if err != nil {
+		log.Error(err)
+	}
+	return lis
+}
 
-// GetObjects query each handler that match for fully qualified namespaces.
-func (hl HandlerList) GetObjects(match, search, fields string) (out Config) {
+// GetIndexPageContext query each handler that match namespace for a window of spaces.
+func (hl HandlerList) GetIndexPageContext(ctx context.Context, match, search string, page Page) (Config, error) {
 	spec := ParseNamespace(match)
 	pgm := rsql.DefaultParse(search)
-	flds := strings.Split(fields, ",")
-
-	matches := make([]NamespaceSearch, len(hl))
+	matches := hl.matchSearch(spec)
 
-	for _, c := range spec {
-		for i, hldr := range hl {
-			ok, err := filepath.Match(hldr.Match, c.Value())
-			if !ok || err != nil {
-				continue
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		if len(matches[i]) == 0 {
+			return nil, nil
+		}
+		log.Debug("INDEX PAGE ", hldr.Match)
+		if pager, ok := hldr.HandlerV2.(IndexPagerV2); ok {
+			lis, err := pager.GetIndexPage(ctx, matches[i], pgm, page)
+			if !errors.Is(err, ErrNotSupported) {
+				return lis, err
 			}
-			matches[i] = append(matches[i], c)
+		}
+		return hldr.GetIndex(ctx, matches[i], pgm)
+	})
+
+	var lis Config
+	for _, r := range results {
+		if arr, ok := r.(Config); ok {
+			lis = append(lis, arr...)
 		}
 	}
 
-	for i, hldr := range hl {
+	return page.Apply(lis), err
+}
+
+// GetIndexWindowContext query each handler that match namespace for all spaces
+// and returns the window of them with the number of spaces in every window.
+func (hl HandlerList) GetIndexWindowContext(ctx context.Context, match, search string, page Page) (Config, uint64, error) {
+	lis, err := hl.GetIndexContext(ctx, match, search)
+	out, total := page.Window(lis)
+	return out, total, err
+}
+
+// Search query each handler with a key=value search
+
+// GetObjects query each handler that match for fully qualified namespaces.
+func (hl HandlerList) GetObjects(match, search, fields string) (out Config) {
+	out, err := hl.GetObjectsContext(context.Background(), match, search, fields)
+	if err != nil {
+		log.Error(err)
+	}
+	return
+}
+
+// GetObjectsContext query each handler that match for fully qualified namespaces.
+func (hl HandlerList) GetObjectsContext(ctx context.Context, match, search, fields string) (out Config, err error) {
+	spec := ParseNamespace(match)
+	pgm := rsql.DefaultParse(search)
+	flds := parseFields(fields)
+	matches := hl.matchSearch(spec)
+
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		if len(matches[i]) == 0 {
+			return nil, nil
+		}
 		log.Debug("QUERY ", hldr.Match)
-		arr := hldr.GetObjects(matches[i], pgm, flds)
-		if arr != nil {
+		return hldr.GetObjects(ctx, matches[i], pgm, flds)
+	})
+
+	for _, r := range results {
+		if arr, ok := r.(Config); ok {
 			out = append(out, arr...)
 		}
 	}
@@ -126,39 +333,83 @@ func (hl HandlerList) GetObjects(match, search, fields string) (out Config) {
 	return
 }
 
+// parseFields splits a comma separated list of fields dropping empty entries.
+func parseFields(fields string) (lis []string) {
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		lis = append(lis, f)
+	}
+	return
+}
+
 // WriteObjects write objects to backends
 func (hl HandlerList) WriteObjects(spaces Config) error {
-	matches := make([]Config, len(hl))
+	return hl.WriteObjectsContext(context.Background(), spaces)
+}
 
-	for _, s := range spaces {
-		for i, hldr := range hl {
-			ok, err := filepath.Match(hldr.Match, s.Space)
-			if !ok || err != nil {
-				continue
-			}
-			log.Debug("MATCH ", i, " ", s.Space)
-			matches[i] = append(matches[i], s)
-			break
-		}
+// WriteObjectsContext write objects to backends. Spaces are routed to
+// handlers by the WritePolicy of the first matching WriteRoutes entry. If a
+// handler fails the writes to the others are rolled back or restored.
+// Promotion records are refused unless written by promotion.
+func (hl HandlerList) WriteObjectsContext(ctx context.Context, spaces Config) error {
+	if err := checkReserved(ctx, spaces); err != nil {
+		return err
 	}
 
-	for i, hldr := range hl {
-		log.Debug("WRITE MATCH ", hldr.Match)
-		err := hldr.WriteObjects(matches[i])
-		if err != nil {
-			return err
-		}
+	writes, replicas := hl.routeWrites(spaces)
+
+	if err := hl.writeAll(ctx, writes, nil); err != nil {
+		return err
+	}
+	hl.writeReplicas(replicas, nil)
+	hl.observe(ctx, spaces)
+
+	return nil
+}
+
+// PatchObjectsContext applies the patch to the backends. Spaces are routed
+// as for WriteObjectsContext. Handlers that implement Patcher apply the
+// patch in place and the others are read, patched and written whole.
+func (hl HandlerList) PatchObjectsContext(ctx context.Context, patch Patch) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+	if err := checkReserved(ctx, patch.Spaces()); err != nil {
+		return err
+	}
+
+	writes, replicas := hl.routeWrites(patch.Spaces())
+
+	if err := hl.writeAll(ctx, writes, patch); err != nil {
+		return err
 	}
+	hl.writeReplicas(replicas, patch)
+	hl.observe(ctx, patch.Spaces())
 
 	return nil
 }
 
 // GetRules query each of the handlers for rules.
 func (hl HandlerList) GetRules(user ident.Ident) (lis Rules) {
-	for _, hldr := range hl {
-		arr := hldr.GetRules(user)
-		if arr != nil {
-			log.Debug("RULES ", hldr.Match)
+	lis, err := hl.GetRulesContext(context.Background(), user)
+	if err != nil {
+		log.Error(err)
+	}
+	return
+}
+
+// GetRulesContext query each of the handlers for rules.
+func (hl HandlerList) GetRulesContext(ctx context.Context, user ident.Ident) (lis Rules, err error) {
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		return hldr.GetRules(ctx, user)
+	})
+
+	for i, r := range results {
+		if arr, ok := r.(Rules); ok && arr != nil {
+			log.Debug("RULES ", hl[i].Match)
 			lis = append(lis, arr...)
 		}
 	}
@@ -168,15 +419,18 @@ func (hl HandlerList) GetRules(user ident.Ident) (lis Rules) {
 
 // GetNotify query each of the handlers for rules.
 func (hl HandlerList) GetNotify(event string) (lis ListNotify, err error) {
-	for _, hldr := range hl {
-		log.Debug("NOTIFY ", hldr.Match)
+	return hl.GetNotifyContext(context.Background(), event)
+}
 
-		arr := hldr.GetNotify(event)
-		if err != nil {
-			continue
-		}
-		if arr != nil {
-			log.Debug("NOTIFY ", hldr.Match)
+// GetNotifyContext query each of the handlers for notifies.
+func (hl HandlerList) GetNotifyContext(ctx context.Context, event string) (lis ListNotify, err error) {
+	results, err := hl.each(ctx, func(ctx context.Context, i int, hldr HandlerItem) (interface{}, error) {
+		return hldr.GetNotify(ctx, event)
+	})
+
+	for i, r := range results {
+		if arr, ok := r.(ListNotify); ok && arr != nil {
+			log.Debug("NOTIFY ", hl[i].Match)
 			lis = append(lis, arr...)
 		}
 	}
@@ -0,0 +1,99 @@
+package mercury
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+)
+
+type testHandler struct {
+	spaces Config
+	delay  time.Duration
+	err    error
+}
+
+func (h testHandler) wait(ctx context.Context) error {
+	select {
+	case <-time.After(h.delay):
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+func (h testHandler) GetIndex(ctx context.Context, _ NamespaceSearch, _ *rsql.Program) (Config, error) {
+	if err := h.wait(ctx); err != nil {
+		return nil, err
+	}
+	return h.spaces, nil
+}
+func (h testHandler) GetObjects(ctx context.Context, _ NamespaceSearch, _ *rsql.Program, _ []string) (Config, error) {
+	return h.GetIndex(ctx, nil, nil)
+}
+func (h testHandler) WriteObjects(ctx context.Context, _ Config) error {
+	return h.wait(ctx)
+}
+func (h testHandler) GetRules(ctx context.Context, _ ident.Ident) (Rules, error) {
+	if err := h.wait(ctx); err != nil {
+		return nil, err
+	}
+	return Rules{{Role: "read", Type: "NS", Match: "*"}}, nil
+}
+func (h testHandler) GetNotify(ctx context.Context, _ string) (ListNotify, error) {
+	if err := h.wait(ctx); err != nil {
+		return nil, err
+	}
+	return ListNotify{{Name: "test"}}, nil
+}
+
+func TestHandlerList_Context(t *testing.T) {
+	Convey("Given a list of handlers", t, func() {
+		hl := HandlerList{
+			{HandlerV2: testHandler{spaces: Config{NewSpace("a.one")}}, Match: "a.*"},
+			{HandlerV2: testHandler{err: fmt.Errorf("broken")}, Match: "*"},
+			{HandlerV2: testHandler{spaces: Config{NewSpace("b.one")}, delay: 200 * time.Millisecond}, Match: "b.*", Timeout: 10 * time.Millisecond},
+			{HandlerV2: testHandler{spaces: Config{NewSpace("c.one")}}, Match: "c.*"},
+		}
+
+		Convey("failed handlers are reported with results of the others", func() {
+			lis, err := hl.GetObjectsContext(context.Background(), "a.*,b.*,c.*", "", "")
+			So(lis.StringList(), ShouldEqual, "a.one\nc.one\n")
+
+			herrs, ok := err.(HandlerErrors)
+			So(ok, ShouldBeTrue)
+			So(herrs, ShouldHaveLength, 2)
+			So(herrs[0].Match, ShouldEqual, "*")
+			So(herrs[1].Match, ShouldEqual, "b.*")
+			So(herrs[1].Err == context.DeadlineExceeded, ShouldBeTrue)
+		})
+
+		Convey("handlers without a matching namespace are skipped", func() {
+			lis, err := hl.GetIndexContext(context.Background(), "c.one", "")
+			So(lis.StringList(), ShouldEqual, "c.one\n")
+			So(err.(HandlerErrors), ShouldHaveLength, 1)
+		})
+
+		Convey("rules are collected from handlers that succeed", func() {
+			lis, err := hl.GetRulesContext(context.Background(), nil)
+			So(lis, ShouldHaveLength, 2)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("a cancelled context stops waiting on handlers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := hl.GetNotifyContext(ctx, "updated")
+			So(err.(HandlerErrors), ShouldHaveLength, 4)
+		})
+
+		Convey("writes report the failed handler", func() {
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("d.one")})
+			So(err, ShouldResemble, HandlerError{Match: "*", Err: fmt.Errorf("broken")})
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package mercury
+
+import (
+	"sort"
+	"strings"
+
+	"sour.is/x/toolbox/gql"
+)
+
+// Page describes a window of spaces sorted by name.
+type Page struct {
+	// Limit the number of spaces returned. Zero returns all.
+	Limit uint64
+	// Offset skips spaces from the start of the window.
+	Offset uint64
+	// After is a cursor that starts the window after the named space.
+	After string
+	// Desc sorts spaces in descending order.
+	Desc bool
+}
+
+// NewPage builds a page from query input.
+// Sort accepts `space asc` or `space desc`.
+func NewPage(q *gql.QueryInput) (p Page) {
+	if q == nil {
+		return
+	}
+
+	if q.Limit != nil {
+		p.Limit = *q.Limit
+	}
+	if q.Offset != nil {
+		p.Offset = *q.Offset
+	}
+	if q.After != nil {
+		p.After = *q.After
+	}
+
+	for _, s := range q.Sort {
+		f := strings.Fields(s)
+		if len(f) < 1 || (f[0] != "space" && f[0] != "name") {
+			continue
+		}
+		if len(f) > 1 {
+			ord := strings.ToLower(f[1])
+			p.Desc = ord == "dec" || ord == "desc"
+		}
+	}
+
+	return
+}
+
+// Size returns the number of spaces a handler needs to return for the
+// window to be filled. Zero means all spaces are needed.
+func (p Page) Size() uint64 {
+	if p.Limit == 0 {
+		return 0
+	}
+	return p.Limit + p.Offset
+}
+
+// Order returns the sql order clause for the page on col.
+func (p Page) Order(col string) string {
+	if p.Desc {
+		return col + " desc"
+	}
+	return col + " asc"
+}
+
+// IsAfter returns true if the space sorts after the cursor.
+func (p Page) IsAfter(space string) bool {
+	if p.After == "" {
+		return true
+	}
+	if p.Desc {
+		return space < p.After
+	}
+	return space > p.After
+}
+
+// Apply sorts the spaces and returns the window described by page.
+func (p Page) Apply(lis Config) (out Config) {
+	out, _ = p.Window(lis)
+	return
+}
+
+// Window sorts the spaces and returns the window described by page and the
+// number of spaces after the cursor before the offset and limit are applied.
+func (p Page) Window(lis Config) (out Config, total uint64) {
+	if p.Desc {
+		sort.Sort(sort.Reverse(lis))
+	} else {
+		sort.Sort(lis)
+	}
+
+	for _, s := range lis {
+		if p.IsAfter(s.Space) {
+			out = append(out, s)
+		}
+	}
+	total = uint64(len(out))
+
+	if p.Offset >= total {
+		return nil, total
+	}
+	out = out[p.Offset:]
+
+	if p.Limit > 0 && p.Limit < uint64(len(out)) {
+		out = out[:p.Limit]
+	}
+
+	return
+}
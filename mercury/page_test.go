@@ -0,0 +1,130 @@
+package mercury
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/gql"
+	"sour.is/x/toolbox/ident"
+)
+
+func TestNewPage(t *testing.T) {
+	limit, offset, after := uint64(10), uint64(5), "svc.api"
+
+	Convey("Given query input", t, func() {
+		So(NewPage(nil), ShouldResemble, Page{})
+		So(NewPage(&gql.QueryInput{
+			Limit:  &limit,
+			Offset: &offset,
+			After:  &after,
+			Sort:   []string{"other asc", "space DESC"},
+		}), ShouldResemble, Page{Limit: 10, Offset: 5, After: "svc.api", Desc: true})
+	})
+}
+
+func TestPage_Apply(t *testing.T) {
+	newConfig := func() Config {
+		return Config{NewSpace("c"), NewSpace("a"), NewSpace("d"), NewSpace("b")}
+	}
+
+	tests := []struct {
+		name string
+		page Page
+		want string
+	}{
+		{"all", Page{}, "a\nb\nc\nd\n"},
+		{"desc", Page{Desc: true}, "d\nc\nb\na\n"},
+		{"limit", Page{Limit: 2}, "a\nb\n"},
+		{"offset", Page{Limit: 2, Offset: 1}, "b\nc\n"},
+		{"after", Page{Limit: 2, After: "b"}, "c\nd\n"},
+		{"after desc", Page{Desc: true, After: "c"}, "b\na\n"},
+		{"past end", Page{Offset: 4}, ""},
+	}
+
+	Convey("Given a config", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(tt.page.Apply(newConfig()).StringList(), ShouldEqual, tt.want)
+			})
+		}
+	})
+
+	Convey("Given a window", t, func() {
+		lis, total := Page{Limit: 1, Offset: 1, After: "a"}.Window(newConfig())
+		So(lis.StringList(), ShouldEqual, "c\n")
+		So(total, ShouldEqual, 3)
+
+		_, total = Page{Offset: 9}.Window(newConfig())
+		So(total, ShouldEqual, 4)
+	})
+}
+
+type pagerHandler struct {
+	lastPage Page
+	spaces   Config
+}
+
+func (h *pagerHandler) GetIndex(NamespaceSearch, *rsql.Program) Config { return h.spaces }
+func (h *pagerHandler) GetIndexPage(_ NamespaceSearch, _ *rsql.Program, page Page) Config {
+	h.lastPage = page
+	return h.spaces
+}
+func (*pagerHandler) GetObjects(NamespaceSearch, *rsql.Program, []string) Config { return nil }
+func (*pagerHandler) WriteObjects(Config) error                                  { return nil }
+func (*pagerHandler) GetRules(ident.Ident) Rules                                 { return nil }
+func (*pagerHandler) GetNotify(string) ListNotify                                { return nil }
+
+func TestHandlerList_GetIndexPage(t *testing.T) {
+	Convey("Given a handler that pages", t, func() {
+		h := &pagerHandler{spaces: Config{NewSpace("b"), NewSpace("a"), NewSpace("c")}}
+		hl := HandlerList{{HandlerV2: AdaptHandler(h), Match: "*"}}
+
+		lis := hl.GetIndexPage("*", "", Page{Limit: 2})
+		So(h.lastPage.Size(), ShouldEqual, 2)
+		So(lis.StringList(), ShouldEqual, "a\nb\n")
+
+		Convey("a window counts every space", func() {
+			h.spaces = Config{NewSpace("b"), NewSpace("a"), NewSpace("c"), NewSpace("d")}
+			lis, total, err := hl.GetIndexWindowContext(context.Background(), "*", "", Page{Limit: 2, Offset: 1})
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 4)
+			So(lis.StringList(), ShouldEqual, "b\nc\n")
+		})
+	})
+}
+
+func TestReadableIndex(t *testing.T) {
+	Convey("Given spaces the rules can read some of", t, func() {
+		h := &pagerHandler{}
+		for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+			h.spaces = append(h.spaces, NewSpace(name))
+		}
+		rules := Rules{
+			{Role: "read", Type: "NS", Match: "a"},
+			{Role: "read", Type: "NS", Match: "c"},
+			{Role: "read", Type: "NS", Match: "e"},
+		}
+
+		old := Registry
+		Registry = HandlerList{{HandlerV2: AdaptHandler(h), Match: "*"}}
+		Reset(func() { Registry = old })
+
+		ctx := context.Background()
+
+		Convey("pages are read until the window is full", func() {
+			lis, err := readableIndex(ctx, rules, "*", Page{Limit: 2})
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "a\nc\n")
+
+			lis, err = readableIndex(ctx, rules, "*", Page{Limit: 2, Offset: 1})
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "c\ne\n")
+
+			lis, err = readableIndex(ctx, rules, "*", Page{Limit: 2, After: "c"})
+			So(err, ShouldBeNil)
+			So(lis.StringList(), ShouldEqual, "e\n")
+		})
+	})
+}
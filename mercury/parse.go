@@ -8,7 +8,8 @@ import (
 	"sour.is/x/toolbox/log"
 )
 
-func parseText(body io.Reader) (config SpaceMap, err error) {
+// ParseText reads spaces in the text format written by Config.String.
+func ParseText(body io.Reader) (config SpaceMap, err error) {
 	config = make(SpaceMap)
 
 	var space string
@@ -89,7 +89,7 @@ func TestParseText(t *testing.T) {
 
 	Convey("Parse Text to SpaceMap", t, func() {
 		for _, tt := range tests {
-			gotConfig, err := parseText(reader(tt.text))
+			gotConfig, err := ParseText(reader(tt.text))
 			if tt.wantErr {
 				So(err, ShouldNotBeNil)
 			} else {
@@ -0,0 +1,336 @@
+package mercury
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"sour.is/x/toolbox/log"
+)
+
+// Patch operations.
+const (
+	PatchSet    = "set"
+	PatchAppend = "append"
+	PatchRemove = "remove"
+)
+
+// Patch fields. An empty field is the values of a key.
+const (
+	FieldValues = "values"
+	FieldTags   = "tags"
+	FieldNotes  = "notes"
+)
+
+// PatchOp changes a single key or the tags and notes of a space.
+//
+// set replaces the field, append adds to it and remove takes the listed
+// entries out of it. A remove of a key without a field or values removes
+// the key. Keys that do not exist are created by set and append.
+type PatchOp struct {
+	Op     string   `json:"op"`
+	Space  string   `json:"space"`
+	Name   string   `json:"name,omitempty"`
+	Field  string   `json:"field,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Patch is a list of operations applied in order.
+type Patch []PatchOp
+
+// Patcher is implemented by handlers that can apply a patch in place
+// instead of writing whole spaces. The patch is not visible until it is
+// committed.
+type Patcher interface {
+	PreparePatch(context.Context, Patch) (WriteTx, error)
+}
+
+func (op PatchOp) String() string {
+	target := op.Name
+	if op.Field != "" {
+		target += "#" + op.Field
+	}
+
+	s := fmt.Sprintf("%s %s %s", op.Op, op.Space, target)
+	for _, v := range op.Values {
+		s += " " + v
+	}
+	return s
+}
+
+// Validate checks the op, space and field are known.
+func (op PatchOp) Validate() error {
+	switch op.Op {
+	case PatchSet, PatchAppend, PatchRemove:
+	default:
+		return fmt.Errorf("unknown patch op: %q", op.Op)
+	}
+
+	if op.Space == "" {
+		return fmt.Errorf("patch %s: space required", op.Op)
+	}
+
+	switch op.Field {
+	case "", FieldValues, FieldTags, FieldNotes:
+	default:
+		return fmt.Errorf("patch %s %s: unknown field %q", op.Op, op.Space, op.Field)
+	}
+
+	if op.Name == "" && op.Field != FieldTags && op.Field != FieldNotes {
+		return fmt.Errorf("patch %s %s: name or space tags or notes required", op.Op, op.Space)
+	}
+
+	return nil
+}
+
+// Validate checks each op.
+func (p Patch) Validate() error {
+	for _, op := range p {
+		if err := op.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Spaces lists the spaces the patch changes in the order first seen.
+func (p Patch) Spaces() Config {
+	seen := make(map[string]struct{})
+	var lis Config
+	for _, op := range p {
+		if _, ok := seen[op.Space]; ok {
+			continue
+		}
+		seen[op.Space] = struct{}{}
+		lis = append(lis, NewSpace(op.Space))
+	}
+	return lis
+}
+
+// For returns the ops that change any of the spaces.
+func (p Patch) For(lis Config) Patch {
+	names := make(map[string]struct{}, len(lis))
+	for _, s := range lis {
+		names[s.Space] = struct{}{}
+	}
+
+	var out Patch
+	for _, op := range p {
+		if _, ok := names[op.Space]; ok {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// Apply returns a copy of the space with the ops for it applied. Existing
+// values keep their Seq and new keys are added after the last.
+func (p Patch) Apply(s *Space) (*Space, error) {
+	out := &Space{
+		Space: s.Space,
+		Tags:  append([]string(nil), s.Tags...),
+		Notes: append([]string(nil), s.Notes...),
+		List:  make([]Value, len(s.List)),
+	}
+
+	var next uint64
+	for i, v := range s.List {
+		v.Values = append([]string(nil), v.Values...)
+		v.Tags = append([]string(nil), v.Tags...)
+		v.Notes = append([]string(nil), v.Notes...)
+		out.List[i] = v
+
+		if v.Seq >= next {
+			next = v.Seq + 1
+		}
+	}
+
+	for _, op := range p {
+		if op.Space != s.Space {
+			continue
+		}
+		if err := op.Validate(); err != nil {
+			return nil, err
+		}
+
+		if op.Name == "" {
+			if op.Field == FieldTags {
+				out.Tags = op.apply(out.Tags)
+			} else {
+				out.Notes = op.apply(out.Notes)
+			}
+			continue
+		}
+
+		i := -1
+		for j := range out.List {
+			if out.List[j].Name == op.Name {
+				i = j
+				break
+			}
+		}
+
+		if op.Op == PatchRemove && op.Field == "" && len(op.Values) == 0 {
+			if i >= 0 {
+				out.List = append(out.List[:i], out.List[i+1:]...)
+			}
+			continue
+		}
+
+		if i < 0 {
+			if op.Op == PatchRemove {
+				continue
+			}
+			out.List = append(out.List, Value{Space: s.Space, Seq: next, Name: op.Name})
+			i = len(out.List) - 1
+			next++
+		}
+
+		v := &out.List[i]
+		switch op.Field {
+		case FieldTags:
+			v.Tags = op.apply(v.Tags)
+		case FieldNotes:
+			v.Notes = op.apply(v.Notes)
+		default:
+			v.Values = op.apply(v.Values)
+		}
+	}
+
+	return out, nil
+}
+
+// apply runs the op on one field.
+func (op PatchOp) apply(lis []string) []string {
+	switch op.Op {
+	case PatchSet:
+		return append([]string(nil), op.Values...)
+	case PatchAppend:
+		return append(lis, op.Values...)
+	}
+
+	if len(op.Values) == 0 {
+		return nil
+	}
+
+	drop := make(map[string]struct{}, len(op.Values))
+	for _, v := range op.Values {
+		drop[v] = struct{}{}
+	}
+
+	var out []string
+	for _, v := range lis {
+		if _, ok := drop[v]; !ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// applyPatch returns the patched spaces for the names in spaces. Spaces not
+// in current start empty.
+func applyPatch(patch Patch, current, spaces Config) (Config, error) {
+	cur := current.ToSpaceMap()
+
+	out := make(Config, 0, len(spaces))
+	for _, s := range spaces {
+		c, ok := cur[s.Space]
+		if !ok {
+			c = NewSpace(s.Space)
+		}
+
+		p, err := patch.Apply(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// ParsePatch reads patch ops one per line in the form
+//
+//	op space target [value]
+//
+// where target is a key name, name#field for the tags or notes of a key or
+// #field for the tags or notes of the space. The value is the rest of the
+// line. Blank lines and lines starting with # are skipped.
+//
+//	set    app.db host       db.example.com
+//	append app.db hosts      db2.example.com
+//	remove app.db old
+//	append app.db host#tags  prod
+//	set    app.db #notes     managed by ops
+func ParsePatch(r io.Reader) (patch Patch, err error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var op PatchOp
+		var target string
+		op.Op, text = cutField(text)
+		op.Space, text = cutField(text)
+		target, text = cutField(text)
+
+		if i := strings.IndexRune(target, '#'); i >= 0 {
+			op.Name, op.Field = target[:i], target[i+1:]
+		} else {
+			op.Name = target
+		}
+		if text != "" {
+			op.Values = []string{text}
+		}
+
+		if err = op.Validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		patch = append(patch, op)
+	}
+
+	return patch, scanner.Err()
+}
+
+func cutField(s string) (field, rest string) {
+	s = strings.TrimLeft(s, " \t")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// patchSpaces applies the ops for spaces the rules allow writing and sends
+// the updated notifies for them. Ops for other spaces are skipped and the
+// spaces patched are returned.
+func patchSpaces(ctx context.Context, rules Rules, patch Patch) (Config, error) {
+	if err := patch.Validate(); err != nil {
+		return nil, err
+	}
+
+	var allowed Config
+	for _, s := range patch.Spaces() {
+		if !rules.GetRoles("NS", s.Space).HasRole("write") {
+			log.Debug("SKIP ", s.Space)
+			continue
+		}
+		allowed = append(allowed, s)
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	if err := Registry.PatchObjectsContext(ctx, patch.For(allowed)); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	sendNotify(ctx, "updated", allowed)
+
+	return allowed, nil
+}
@@ -0,0 +1,157 @@
+package mercury
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// patchHandler applies patches itself when committed.
+type patchHandler struct {
+	*memHandler
+	patched Patch
+}
+
+type patchTx struct {
+	h     *patchHandler
+	patch Patch
+}
+
+func (h *patchHandler) PreparePatch(_ context.Context, patch Patch) (WriteTx, error) {
+	return &patchTx{h, patch}, nil
+}
+func (tx *patchTx) Commit() error {
+	tx.h.patched = append(tx.h.patched, tx.patch...)
+	cur, _ := tx.h.GetObjects(context.Background(), writeSearch(tx.patch.Spaces()), nil, nil)
+	lis, err := applyPatch(tx.patch, cur, tx.patch.Spaces())
+	if err != nil {
+		return err
+	}
+	return tx.h.WriteObjects(context.Background(), lis)
+}
+func (tx *patchTx) Rollback() error { return nil }
+
+func TestPatch_Apply(t *testing.T) {
+	space := &Space{Space: "app.db", Tags: []string{"db"}, List: []Value{
+		{Space: "app.db", Seq: 0, Name: "host", Values: []string{"a"}},
+		{Space: "app.db", Seq: 1, Name: "hosts", Values: []string{"a", "b"}, Tags: []string{"list"}},
+	}}
+
+	tests := []struct {
+		name  string
+		patch string
+		check func(*Space)
+	}{
+		{"set replaces values", "set app.db host b", func(s *Space) {
+			So(s.FirstValue("host").Values, ShouldResemble, []string{"b"})
+			So(s.FirstValue("host").Seq, ShouldEqual, 0)
+		}},
+		{"append adds values", "append app.db hosts c", func(s *Space) {
+			So(s.FirstValue("hosts").Values, ShouldResemble, []string{"a", "b", "c"})
+		}},
+		{"remove takes out values", "remove app.db hosts a", func(s *Space) {
+			So(s.FirstValue("hosts").Values, ShouldResemble, []string{"b"})
+		}},
+		{"remove drops a key", "remove app.db host", func(s *Space) {
+			So(s.List, ShouldHaveLength, 1)
+			So(s.List[0].Name, ShouldEqual, "hosts")
+			So(s.List[0].Seq, ShouldEqual, 1)
+		}},
+		{"set creates a key after the last", "set app.db port 5432", func(s *Space) {
+			So(s.List, ShouldHaveLength, 3)
+			So(s.List[2].Seq, ShouldEqual, 2)
+			So(s.List[2].Values, ShouldResemble, []string{"5432"})
+		}},
+		{"key tags are changed", "append app.db hosts#tags ha\nremove app.db hosts#tags list", func(s *Space) {
+			So(s.FirstValue("hosts").Tags, ShouldResemble, []string{"ha"})
+		}},
+		{"space notes are changed", "set app.db #notes managed by ops", func(s *Space) {
+			So(s.Notes, ShouldResemble, []string{"managed by ops"})
+		}},
+		{"space tags are cleared", "remove app.db #tags", func(s *Space) {
+			So(s.Tags, ShouldBeEmpty)
+		}},
+		{"other spaces are left", "set app.web host b", func(s *Space) {
+			So(s.FirstValue("host").Values, ShouldResemble, []string{"a"})
+		}},
+	}
+
+	Convey("Given a space", t, func() {
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				patch, err := ParsePatch(strings.NewReader(tt.patch))
+				So(err, ShouldBeNil)
+
+				s, err := patch.Apply(space)
+				So(err, ShouldBeNil)
+				tt.check(s)
+
+				// The original is not changed.
+				So(space.FirstValue("host").Values, ShouldResemble, []string{"a"})
+				So(space.FirstValue("hosts").Values, ShouldResemble, []string{"a", "b"})
+			})
+		}
+	})
+}
+
+func TestParsePatch(t *testing.T) {
+	Convey("Given patch text", t, func() {
+		patch, err := ParsePatch(strings.NewReader(`
+# comment
+set    app.db  host       db.example.com
+append app.db  host#notes primary   server
+remove app.db  old
+`))
+		So(err, ShouldBeNil)
+		So(patch, ShouldResemble, Patch{
+			{Op: PatchSet, Space: "app.db", Name: "host", Values: []string{"db.example.com"}},
+			{Op: PatchAppend, Space: "app.db", Name: "host", Field: FieldNotes, Values: []string{"primary   server"}},
+			{Op: PatchRemove, Space: "app.db", Name: "old"},
+		})
+
+		for _, bad := range []string{"move app.db host", "set", "set app.db", "set app.db host#other x", "set app.db #values x"} {
+			_, err = ParsePatch(strings.NewReader(bad))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestHandlerList_PatchObjects(t *testing.T) {
+	defer func(routes []WriteRoute) { WriteRoutes = routes }(WriteRoutes)
+
+	Convey("Given mirrored handlers", t, func() {
+		WriteRoutes = nil
+		SetWritePolicy("*", WriteMirror)
+
+		patcher, plain := &patchHandler{memHandler: newMemHandler("one")}, newMemHandler("one")
+		hl := HandlerList{
+			{HandlerV2: patcher, Match: "*", Priority: 2},
+			{HandlerV2: plain, Match: "*", Priority: 1},
+		}
+		patch := Patch{{Op: PatchSet, Space: "one", Name: "key", Values: []string{"value"}}}
+
+		Convey("a patcher is given the patch and others the patched space", func() {
+			err := hl.PatchObjectsContext(context.Background(), patch)
+			So(err, ShouldBeNil)
+			So(patcher.patched, ShouldResemble, patch)
+			So(plain.notes("one"), ShouldEqual, "old")
+			So(plain.spaces["one"].FirstValue("key").Values, ShouldResemble, []string{"value"})
+			So(patcher.spaces["one"].FirstValue("key").Values, ShouldResemble, []string{"value"})
+		})
+
+		Convey("a failure does not apply the patch", func() {
+			plain.fail = true
+
+			err := hl.PatchObjectsContext(context.Background(), patch)
+			So(err, ShouldNotBeNil)
+			So(patcher.patched, ShouldBeEmpty)
+		})
+
+		Convey("an invalid patch is rejected", func() {
+			err := hl.PatchObjectsContext(context.Background(), Patch{{Op: "move", Space: "one", Name: "key"}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,10 +1,12 @@
 package pg
 
 import (
+	"context"
+
+	"github.com/Masterminds/squirrel"
 	"sour.is/x/toolbox/dbm"
 	"sour.is/x/toolbox/dbm/rsql"
 	"sour.is/x/toolbox/ident"
-	"sour.is/x/toolbox/log"
 	"sour.is/x/toolbox/mercury"
 	"sour.is/x/toolbox/mercury/dummy"
 )
@@ -14,15 +16,14 @@ type postgresHandler struct {
 }
 
 func init() {
-	mercury.Register("*", 1, postgresHandler{})
+	mercury.RegisterV2("*", 1, postgresHandler{})
 }
 
-func (postgresHandler) GetIndex(search mercury.NamespaceSearch, pgm *rsql.Program) (lis mercury.Config) {
+func (postgresHandler) GetIndex(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program) (lis mercury.Config, err error) {
 	where := getWhere(search, dbm.GetDbInfo(Space{}))
-	spaces, err := ListSpace(where, 0, 0, []string{"space asc"})
+	spaces, err := ListSpaceContext(ctx, where, 0, 0, []string{"space asc"})
 	if err != nil {
-		log.Error(err)
-		return nil
+		return nil, err
 	}
 
 	for _, s := range spaces {
@@ -36,18 +37,50 @@ func (postgresHandler) GetIndex(search mercury.NamespaceSearch, pgm *rsql.Progra
 	return
 }
 
-func (p postgresHandler) GetObjects(search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) mercury.Config {
-	idx := p.GetIndex(search, pgm)
+func (postgresHandler) GetIndexPage(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, page mercury.Page) (lis mercury.Config, err error) {
+	d := dbm.GetDbInfo(Space{})
+	col := d.ColPanic("Space")
+
+	where := squirrel.And{getWhere(search, d)}
+	if page.After != "" {
+		if page.Desc {
+			where = append(where, squirrel.Lt{col: page.After})
+		} else {
+			where = append(where, squirrel.Gt{col: page.After})
+		}
+	}
+
+	spaces, err := ListSpaceContext(ctx, where, page.Size(), 0, []string{page.Order(col)})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range spaces {
+		lis = append(lis, &mercury.Space{
+			Space: s.Space,
+			Tags:  s.Tags,
+			Notes: s.Notes,
+		})
+	}
+
+	return
+}
+
+func (p postgresHandler) GetObjects(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (mercury.Config, error) {
+	idx, err := p.GetIndex(ctx, search, pgm)
+	if err != nil {
+		return nil, err
+	}
+
 	spaceMap := make(map[string]int, len(idx))
 	for u, s := range idx {
 		spaceMap[s.Space] = u
 	}
 
 	where := getWhere(search, dbm.GetDbInfo(Config{}))
-	values, err := ListConfig(where, 0, 0, []string{"space asc", "name asc"})
+	values, err := ListConfigContext(ctx, where, 0, 0, []string{"space asc", "name asc"})
 	if err != nil {
-		log.Error(err)
-		return nil
+		return nil, err
 	}
 
 	for _, v := range values {
@@ -63,26 +96,37 @@ func (p postgresHandler) GetObjects(search mercury.NamespaceSearch, pgm *rsql.Pr
 		}
 	}
 
-	return idx
+	return idx.Filter(pgm, fields), nil
 }
 
-func (postgresHandler) GetRules(user ident.Ident) (rules mercury.Rules) {
-	rules, err := GetRules(user)
-	if err != nil {
-		return nil
-	}
-
-	return
+func (postgresHandler) GetRules(ctx context.Context, user ident.Ident) (mercury.Rules, error) {
+	return GetRulesContext(ctx, user)
 }
 
-func (postgresHandler) GetNotify(event string) mercury.ListNotify {
-	return GetNotify(event)
+func (postgresHandler) GetNotify(ctx context.Context, event string) (mercury.ListNotify, error) {
+	return GetNotifyContext(ctx, event)
 }
 
-func (postgresHandler) WriteObjects(lis mercury.Config) error {
-	err := dbm.Transaction(func(tx *dbm.Tx) error {
+func (postgresHandler) WriteObjects(ctx context.Context, lis mercury.Config) error {
+	err := dbm.TransactionContext(ctx, func(tx *dbm.Tx) error {
 		return WriteConfig(tx, lis)
 	})
 
 	return err
 }
+
+// PrepareWrite implements mercury.WritePreparer. The spaces are written in a
+// transaction that is held open until it is committed or rolled back.
+func (postgresHandler) PrepareWrite(ctx context.Context, lis mercury.Config) (mercury.WriteTx, error) {
+	tx, err := dbm.NewTx(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = WriteConfig(tx, lis); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
@@ -1,6 +1,7 @@
 package pg
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/Masterminds/squirrel"
@@ -20,7 +21,18 @@ type Notify struct {
 
 // GetNotify get list of rules
 func GetNotify(event string) (lis mercury.ListNotify) {
-	err := dbm.Transaction(func(tx *dbm.Tx) error {
+	lis, err := GetNotifyContext(context.Background(), event)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	return
+}
+
+// GetNotifyContext get list of notifies for event with context
+func GetNotifyContext(ctx context.Context, event string) (lis mercury.ListNotify, err error) {
+	err = dbm.QueryContext(ctx, func(tx *dbm.Tx) error {
 		return tx.Fetch(
 			"mercury_notify_vw",
 			[]string{"name", "match", "event", "method", "url"},
@@ -47,10 +59,6 @@ func GetNotify(event string) (lis mercury.ListNotify) {
 			},
 		)
 	})
-	if err != nil {
-		log.Error(err)
-		return nil
-	}
 
 	return
 }
@@ -0,0 +1,207 @@
+package pg
+
+import (
+	"context"
+
+	"github.com/Masterminds/squirrel"
+	"sour.is/x/toolbox/dbm"
+	"sour.is/x/toolbox/dbm/qry"
+	"sour.is/x/toolbox/gql"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/mercury"
+)
+
+// PreparePatch implements mercury.Patcher. The patch is applied in a
+// transaction that is held open until it is committed or rolled back.
+func (postgresHandler) PreparePatch(ctx context.Context, patch mercury.Patch) (mercury.WriteTx, error) {
+	tx, err := dbm.NewTx(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = PatchConfig(tx, patch); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// patchLockID is the first key of the advisory locks on space names.
+const patchLockID = 0x6d6572 // "mer"
+
+// PatchConfig applies a patch to the database. Each space is locked while it
+// is patched and only the values the patch changes are written.
+func PatchConfig(tx *dbm.Tx, patch mercury.Patch) error {
+	d := dbm.GetDbInfo(Space{})
+
+	for _, s := range patch.Spaces() {
+		// Lock the space name so concurrent patches apply in turn, even to a
+		// space that does not exist yet. The lock is held until the end of
+		// the transaction.
+		if _, err := tx.ExecContext(tx.Context, "SELECT pg_advisory_xact_lock($1, hashtext($2))", patchLockID, s.Space); err != nil {
+			return err
+		}
+
+		// Lock the space row against writes that are not patches.
+		rows, err := tx.Select([]string{d.ColPanic("ID")}, d.Table).
+			Where(squirrel.Eq{d.ColPanic("Space"): s.Space}).
+			Suffix("FOR UPDATE").
+			QueryContext(tx.Context)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+
+		cur, id, err := getPatchSpace(tx, s.Space)
+		if err != nil {
+			return err
+		}
+
+		next, err := patch.Apply(cur)
+		if err != nil {
+			return err
+		}
+
+		if err = writePatch(tx, id, cur, next); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPatchSpace reads a space and its values. The id is 0 if the space does not exist.
+func getPatchSpace(tx *dbm.Tx, space string) (*mercury.Space, uint64, error) {
+	d := dbm.GetDbInfo(Space{})
+	lis, err := getSpaceTx(tx, qry.Input{DbInfo: &d, Search: squirrel.Eq{d.ColPanic("Space"): space}, Limit: 1})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(lis) == 0 {
+		return mercury.NewSpace(space), 0, nil
+	}
+
+	s := &mercury.Space{Space: space, Tags: lis[0].Tags, Notes: lis[0].Notes}
+
+	c := dbm.GetDbInfo(Config{})
+	values, err := getConfigTx(tx, qry.Input{
+		DbInfo: &c,
+		Search: squirrel.Eq{c.ColPanic("ID"): lis[0].ID},
+		Sort:   []string{"seq asc"},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, v := range values {
+		s.List = append(s.List, mercury.Value{
+			Space:  space,
+			Seq:    v.Seq,
+			Name:   v.Name,
+			Values: v.Values,
+			Notes:  v.Notes,
+			Tags:   v.Tags,
+		})
+	}
+
+	return s, lis[0].ID, nil
+}
+
+// writePatch writes the difference between cur and next. Values are
+// matched by Seq.
+func writePatch(tx *dbm.Tx, id uint64, cur, next *mercury.Space) (err error) {
+	d := dbm.GetDbInfo(Space{})
+	v := dbm.GetDbInfo(Value{})
+
+	// A space left empty is removed as for a write.
+	if len(next.Tags) == 0 && len(next.Notes) == 0 && len(next.List) == 0 {
+		if id == 0 {
+			return nil
+		}
+		if _, err = tx.Delete(v.Table).Where(squirrel.Eq{v.ColPanic("ID"): id}).ExecContext(tx.Context); err != nil {
+			return
+		}
+		_, err = tx.Delete(d.Table).Where(squirrel.Eq{d.ColPanic("ID"): id}).ExecContext(tx.Context)
+		log.Debugs("PATCH REMOVED", "space", next.Space)
+		return
+	}
+
+	if id == 0 || !equalStrings(cur.Tags, next.Tags) || !equalStrings(cur.Notes, next.Notes) {
+		o := Space{ID: id, Space: next.Space, Tags: next.Tags, Notes: next.Notes}
+		err = SpaceTx{Space: &o, Where: squirrel.Eq{d.ColPanic("ID"): id}, Tx: tx}.Save()
+		if err != nil {
+			return
+		}
+		id = o.ID
+	}
+
+	old := make(map[uint64]mercury.Value, len(cur.List))
+	for _, val := range cur.List {
+		old[val.Seq] = val
+	}
+
+	var changed int
+	for _, val := range next.List {
+		where := squirrel.Eq{v.ColPanic("ID"): id, v.ColPanic("Seq"): val.Seq}
+
+		o, ok := old[val.Seq]
+		delete(old, val.Seq)
+		switch {
+		case !ok:
+			_, err = tx.Insert(v.Table).SetMap(map[string]interface{}{
+				v.ColPanic("ID"):     id,
+				v.ColPanic("Seq"):    val.Seq,
+				v.ColPanic("Name"):   val.Name,
+				v.ColPanic("Values"): gql.ListStrings(val.Values),
+				v.ColPanic("Notes"):  gql.ListStrings(val.Notes),
+				v.ColPanic("Tags"):   gql.ListStrings(val.Tags),
+			}).ExecContext(tx.Context)
+
+		case !sameValue(o, val):
+			_, err = tx.Update(v.Table).SetMap(map[string]interface{}{
+				v.ColPanic("Name"):   val.Name,
+				v.ColPanic("Values"): gql.ListStrings(val.Values),
+				v.ColPanic("Notes"):  gql.ListStrings(val.Notes),
+				v.ColPanic("Tags"):   gql.ListStrings(val.Tags),
+			}).Where(where).ExecContext(tx.Context)
+
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+		changed++
+	}
+
+	for seq := range old {
+		_, err = tx.Delete(v.Table).Where(squirrel.Eq{v.ColPanic("ID"): id, v.ColPanic("Seq"): seq}).ExecContext(tx.Context)
+		if err != nil {
+			return
+		}
+		changed++
+	}
+
+	log.Debugs("PATCHED", "space", next.Space, "values", changed)
+	return
+}
+
+func sameValue(a, b mercury.Value) bool {
+	return a.Name == b.Name &&
+		equalStrings(a.Values, b.Values) &&
+		equalStrings(a.Notes, b.Notes) &&
+		equalStrings(a.Tags, b.Tags)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -351,7 +351,7 @@ func WriteConfig(tx *dbm.Tx, config mercury.Config) (err error) {
 	}
 
 	// get current spaces
-	lis, err := ListSpace(squirrel.Eq{d.ColPanic("Space"): names}, 0, 0, nil)
+	lis, err := getSpaceTx(tx, qry.Input{DbInfo: &d, Search: squirrel.Eq{d.ColPanic("Space"): names}})
 	if err != nil {
 		return
 	}
@@ -378,12 +378,11 @@ func WriteConfig(tx *dbm.Tx, config mercury.Config) (err error) {
 			continue
 		}
 
-		_, err = PutSpace(u.ID, func(mode Mode, db dbm.DbInfo, o SpaceTx) (err error) {
-			o.Notes = s.Notes
-			o.Tags = s.Tags
+		o := u
+		o.Notes = s.Notes
+		o.Tags = s.Tags
 
-			return o.Save()
-		})
+		err = SpaceTx{Space: &o, Where: squirrel.Eq{d.ColPanic("ID"): u.ID}, Tx: tx}.Save()
 		if err != nil {
 			return
 		}
@@ -601,8 +600,7 @@ func getWhere(search mercury.NamespaceSearch, d dbm.DbInfo) squirrel.Sqlizer {
 		case mercury.NamespaceStar:
 			where = append(where, squirrel.Like{d.ColPanic("Space"): m.Value()})
 		case mercury.NamespaceTrace:
-			e := squirrel.Expr(`? LIKE concat(`+d.ColPanic("Space")+`, '%')`, m.Value())
-			where = append(where, e)
+			where = append(where, squirrel.Eq{d.ColPanic("Space"): mercury.Ancestors(m.Raw())})
 		}
 	}
 	return where
@@ -1,6 +1,7 @@
 package pg
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/Masterminds/squirrel"
@@ -12,6 +13,11 @@ import (
 
 // GetRules get list of rules
 func GetRules(user ident.Ident) (lis mercury.Rules, err error) {
+	return GetRulesContext(context.Background(), user)
+}
+
+// GetRulesContext get list of rules with context
+func GetRulesContext(ctx context.Context, user ident.Ident) (lis mercury.Rules, err error) {
 	var ids []string
 	ids = append(ids, "U-"+user.GetIdentity())
 	switch u := user.(type) {
@@ -21,7 +27,7 @@ func GetRules(user ident.Ident) (lis mercury.Rules, err error) {
 		}
 	}
 
-	err = dbm.Transaction(func(tx *dbm.Tx) error {
+	err = dbm.QueryContext(ctx, func(tx *dbm.Tx) error {
 		return tx.Fetch(
 			"mercury_rules_vw",
 			[]string{"role", "type", "match"},
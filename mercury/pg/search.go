@@ -0,0 +1,144 @@
+package pg
+
+import (
+	"context"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"sour.is/x/toolbox/dbm"
+	"sour.is/x/toolbox/mercury"
+)
+
+// Search implements mercury.Searcher. Names use the name index, values the
+// trigram index on mercury_values_text and tags the gin indexes on the tag
+// arrays. The indexes are added by mercury/schema/0002-search.up.sql.
+//
+// Regex is not run by postgres as its syntax differs from Go. The literal
+// text the regex requires is found with LIKE on the trigram index, or ILIKE
+// where it is case insensitive, and mercury checks the regex on the results.
+func (p postgresHandler) Search(ctx context.Context, search mercury.NamespaceSearch, q mercury.Query) (mercury.Config, error) {
+	d := dbm.GetDbInfo(Config{})
+	s := dbm.GetDbInfo(Space{})
+
+	where := squirrel.And{getWhere(search, d)}
+	if q.Name != "" {
+		where = append(where, squirrel.Like{d.ColPanic("Name"): strings.Replace(likeEscape(q.Name), "*", "%", -1)})
+	}
+	if q.Value != "" {
+		where = append(where, squirrel.Expr(
+			"mercury_values_text("+d.ColPanic("Values")+") LIKE ?",
+			"%"+likeEscape(q.Value)+"%",
+		))
+	}
+	for _, lit := range regexLiterals(q.Regex) {
+		op := " LIKE ?"
+		if lit.fold {
+			op = " ILIKE ?"
+		}
+		where = append(where, squirrel.Expr(
+			"mercury_values_text("+d.ColPanic("Values")+")"+op,
+			"%"+likeEscape(lit.text)+"%",
+		))
+	}
+	if q.Tag != "" {
+		where = append(where, squirrel.Or{
+			squirrel.Expr(d.ColPanic("Tags")+" @> ARRAY[?]::varchar[]", q.Tag),
+			squirrel.Expr(
+				d.ColPanic("ID")+" IN (SELECT "+s.ColPanic("ID")+" FROM "+s.Table+" WHERE "+s.ColPanic("Tags")+" @> ARRAY[?]::varchar[])",
+				q.Tag,
+			),
+		})
+	}
+
+	values, err := ListConfigContext(ctx, where, 0, 0, []string{"space asc", "name asc"})
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var names []string
+	seen := make(map[string]struct{})
+	for _, v := range values {
+		if _, ok := seen[v.Space]; !ok {
+			seen[v.Space] = struct{}{}
+			names = append(names, v.Space)
+		}
+	}
+
+	spaces, err := ListSpaceContext(ctx, squirrel.Eq{s.ColPanic("Space"): names}, 0, 0, []string{"space asc"})
+	if err != nil {
+		return nil, err
+	}
+
+	idx := make(map[string]*mercury.Space, len(spaces))
+	var lis mercury.Config
+	for _, sp := range spaces {
+		o := &mercury.Space{Space: sp.Space, Tags: sp.Tags, Notes: sp.Notes}
+		idx[sp.Space] = o
+		lis = append(lis, o)
+	}
+
+	for _, v := range values {
+		if o, ok := idx[v.Space]; ok {
+			o.List = append(o.List, mercury.Value{
+				Space:  v.Space,
+				Name:   v.Name,
+				Seq:    v.Seq,
+				Notes:  v.Notes,
+				Tags:   v.Tags,
+				Values: v.Values,
+			})
+		}
+	}
+
+	return lis, nil
+}
+
+type literal struct {
+	text string
+	fold bool
+}
+
+// regexLiterals returns the literal runs that every match of the regex
+// contains. Only literals, concatenations, groups and repeats of at least
+// one are followed so the result may be empty.
+func regexLiterals(expr string) (lis []literal) {
+	if expr == "" {
+		return nil
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+
+	var walk func(*syntax.Regexp)
+	walk = func(re *syntax.Regexp) {
+		switch re.Op {
+		case syntax.OpLiteral:
+			lis = append(lis, literal{string(re.Rune), re.Flags&syntax.FoldCase != 0})
+		case syntax.OpConcat:
+			for _, sub := range re.Sub {
+				walk(sub)
+			}
+		case syntax.OpCapture, syntax.OpPlus:
+			walk(re.Sub[0])
+		case syntax.OpRepeat:
+			if re.Min > 0 {
+				walk(re.Sub[0])
+			}
+		}
+	}
+	walk(re.Simplify())
+
+	return
+}
+
+// likeEscape escapes the LIKE wildcards in s.
+func likeEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	return strings.Replace(s, "_", `\_`, -1)
+}
@@ -0,0 +1,29 @@
+package pg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_regexLiterals(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []literal
+	}{
+		{"", nil},
+		{"abc", []literal{{"abc", false}}},
+		{"(?i)abc", []literal{{"ABC", true}}},
+		{"^host-[0-9]+\\.local$", []literal{{"host-", false}, {".local", false}}},
+		{"(ab)+c", []literal{{"ab", false}, {"c", false}}},
+		{"a*b?", nil},
+		{"foo|bar", nil},
+		{"50%_\\\\", []literal{{"50%_\\", false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := regexLiterals(tt.expr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("regexLiterals() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
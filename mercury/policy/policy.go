@@ -0,0 +1,423 @@
+package policy // import "sour.is/x/toolbox/mercury/policy"
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+	"sour.is/x/toolbox/mercury"
+	"sour.is/x/toolbox/mercury/app"
+)
+
+// Default spaces that hold definitions. They use the same layout as the
+// config.policy, config.groups and config.notify spaces of the pg handler.
+const (
+	RulesSpace  = "@mercury.rules"
+	GroupsSpace = "@mercury.groups"
+	NotifySpace = "@mercury.notify"
+)
+
+// Set is a parsed set of definitions.
+type Set struct {
+	// Rules are lines of "role type match" by group.
+	Rules map[string]mercury.Rules
+	// Groups are the members of each group as U-<identity>, G-<group> or
+	// R-<role>.
+	Groups map[string][]string
+	// Notify are lines of "match event method url" by name.
+	Notify mercury.ListNotify
+}
+
+// DefaultTTL is how long definitions read from spaces are kept when the
+// handler has no TTL.
+const DefaultTTL = time.Minute
+
+// Handler provides rules and notifies from config and mercury spaces for
+// deployments without the pg handler. The definitions are read when first
+// needed and kept until Reload is called or the TTL passes. Writes through
+// the registry of this process to its spaces reload them at once, the TTL
+// picks up changes made by other processes.
+type Handler struct {
+	// Config holds definitions read from settings.
+	Config Set
+
+	// Spaces the definitions are read from. Empty names are not read.
+	RulesSpace  string
+	GroupsSpace string
+	NotifySpace string
+
+	// TTL is how long definitions read from the spaces are kept. Zero uses
+	// DefaultTTL and a negative TTL keeps them until Reload.
+	TTL time.Duration
+
+	mu     sync.RWMutex
+	set    *Set
+	stale  bool
+	loaded time.Time
+}
+
+var handlers struct {
+	sync.Mutex
+	lis []*Handler
+}
+
+func init() {
+	for _, key := range []string{"mercury.rules.*", "mercury.groups.*", "mercury.notify.*"} {
+		app.RegisterReload(key, reloadConfig)
+	}
+}
+
+// Config registers a handler from the mercury.rules, mercury.groups and
+// mercury.notify settings. When mercury.policy.spaces is true the default
+// spaces are read as well and read again after mercury.policy.ttl. Nothing
+// is registered if neither is set.
+func Config() error {
+	set, err := ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	h := &Handler{Config: set, TTL: viper.GetDuration("mercury.policy.ttl")}
+	if viper.GetBool("mercury.policy.spaces") {
+		h.RulesSpace, h.GroupsSpace, h.NotifySpace = RulesSpace, GroupsSpace, NotifySpace
+	} else if set.IsEmpty() {
+		return nil
+	}
+
+	Register(h)
+	return nil
+}
+
+// ReadConfig parses the definitions in settings.
+func ReadConfig() (Set, error) {
+	return ReadConfigFrom(viper.GetViper())
+}
+
+// ReadConfigFrom parses the definitions in the given settings.
+func ReadConfigFrom(settings *viper.Viper) (Set, error) {
+	return ParseSet(
+		settings.GetStringMapStringSlice("mercury.rules"),
+		settings.GetStringMapStringSlice("mercury.groups"),
+		settings.GetStringMapStringSlice("mercury.notify"),
+	)
+}
+
+// reloadConfig reparses the settings of registered handlers.
+func reloadConfig(settings *viper.Viper) error {
+	set, err := ReadConfigFrom(settings)
+	if err != nil {
+		return err
+	}
+
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	for _, h := range handlers.lis {
+		h.mu.Lock()
+		h.Config = set
+		h.stale = true
+		h.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Register adds the handler to the mercury registry. Its match is empty so
+// no spaces are routed to it. The registry asks every handler for rules and
+// notifies.
+func Register(h *Handler) {
+	handlers.Lock()
+	handlers.lis = append(handlers.lis, h)
+	handlers.Unlock()
+
+	mercury.RegisterV2("", 0, h)
+}
+
+// Reload marks the loaded definitions stale so they are read again when
+// next needed.
+func (h *Handler) Reload() {
+	h.mu.Lock()
+	h.stale = true
+	h.mu.Unlock()
+}
+
+// Written implements mercury.WriteObserver
+func (h *Handler) Written(ctx context.Context, lis mercury.Config) {
+	for _, s := range lis {
+		if s.Space == "" {
+			continue
+		}
+		if s.Space == h.RulesSpace || s.Space == h.GroupsSpace || s.Space == h.NotifySpace {
+			log.Infos("mercury policy reload", "space", s.Space)
+			h.Reload()
+			return
+		}
+	}
+}
+
+// GetIndex implements mercury.HandlerV2
+func (*Handler) GetIndex(context.Context, mercury.NamespaceSearch, *rsql.Program) (mercury.Config, error) {
+	return nil, nil
+}
+
+// GetObjects implements mercury.HandlerV2
+func (*Handler) GetObjects(context.Context, mercury.NamespaceSearch, *rsql.Program, []string) (mercury.Config, error) {
+	return nil, nil
+}
+
+// WriteObjects implements mercury.HandlerV2
+func (*Handler) WriteObjects(context.Context, mercury.Config) error {
+	return nil
+}
+
+// GetRules implements mercury.HandlerV2
+// Rules of each group the user is a member of are returned.
+func (h *Handler) GetRules(ctx context.Context, user ident.Ident) (mercury.Rules, error) {
+	if user == nil || !user.IsActive() {
+		return nil, nil
+	}
+
+	set, err := h.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return set.GetRules(user), nil
+}
+
+// GetNotify implements mercury.HandlerV2
+func (h *Handler) GetNotify(ctx context.Context, event string) (mercury.ListNotify, error) {
+	set, err := h.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return set.GetNotify(event), nil
+}
+
+// load returns the definitions from config merged with those in the spaces.
+// If reading the spaces fails the previous definitions are kept.
+func (h *Handler) load(ctx context.Context) (*Set, error) {
+	h.mu.RLock()
+	set, stale := h.set, h.isStale()
+	h.mu.RUnlock()
+	if set != nil && !stale {
+		return set, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.set != nil && !h.isStale() {
+		return h.set, nil
+	}
+
+	set, err := h.read(ctx)
+	if err != nil {
+		if h.set == nil {
+			return nil, err
+		}
+		log.Warning(err)
+		return h.set, nil
+	}
+
+	h.set, h.stale, h.loaded = set, false, time.Now()
+	return set, nil
+}
+
+// isStale returns true if the definitions need to be read. The caller holds mu.
+func (h *Handler) isStale() bool {
+	if h.stale {
+		return true
+	}
+	if h.RulesSpace == "" && h.GroupsSpace == "" && h.NotifySpace == "" {
+		return false
+	}
+
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return ttl > 0 && time.Since(h.loaded) > ttl
+}
+
+// read parses the definitions from config and the spaces.
+func (h *Handler) read(ctx context.Context) (*Set, error) {
+	set := &Set{}
+	set.Merge(h.Config)
+
+	var names []string
+	for _, name := range []string{h.RulesSpace, h.GroupsSpace, h.NotifySpace} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) > 0 {
+		lis, err := mercury.Registry.GetObjectsContext(ctx, strings.Join(names, ";"), "", "")
+		if _, ok := err.(mercury.HandlerErrors); err != nil && !ok {
+			return nil, err
+		} else if err != nil {
+			log.Warning(err)
+		}
+
+		rules, groups, notify := make(map[string][]string), make(map[string][]string), make(map[string][]string)
+		for _, s := range lis {
+			var m map[string][]string
+			switch s.Space {
+			case h.RulesSpace:
+				m = rules
+			case h.GroupsSpace:
+				m = groups
+			case h.NotifySpace:
+				m = notify
+			default:
+				continue
+			}
+
+			for _, v := range s.List {
+				m[v.Name] = append(m[v.Name], v.Values...)
+			}
+		}
+
+		spaces, err := ParseSet(rules, groups, notify)
+		if err != nil {
+			return nil, err
+		}
+		set.Merge(spaces)
+	}
+
+	return set, nil
+}
+
+// ParseSet parses maps of rule, group and notify lines.
+func ParseSet(rules, groups, notify map[string][]string) (set Set, err error) {
+	set.Rules = make(map[string]mercury.Rules, len(rules))
+	for group, lines := range rules {
+		for _, line := range lines {
+			r, err := ParseRule(line)
+			if err != nil {
+				return set, fmt.Errorf("rules %s: %s", group, err)
+			}
+			set.Rules[group] = append(set.Rules[group], r)
+		}
+	}
+
+	set.Groups = make(map[string][]string, len(groups))
+	for group, members := range groups {
+		set.Groups[group] = append(set.Groups[group], members...)
+	}
+
+	var names []string
+	for name := range notify {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, line := range notify[name] {
+			n, err := ParseNotify(name, line)
+			if err != nil {
+				return set, fmt.Errorf("notify %s: %s", name, err)
+			}
+			set.Notify = append(set.Notify, n)
+		}
+	}
+
+	return set, nil
+}
+
+// ParseRule parses a line of "role type match".
+func ParseRule(line string) (r mercury.Rule, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return r, fmt.Errorf("rule %q is not role type match", line)
+	}
+
+	return mercury.Rule{Role: fields[0], Type: fields[1], Match: fields[2]}, nil
+}
+
+// ParseNotify parses a line of "match event method url".
+func ParseNotify(name, line string) (n mercury.Notify, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return n, fmt.Errorf("notify %q is not match event method url", line)
+	}
+
+	return mercury.Notify{Name: name, Match: fields[0], Event: fields[1], Method: fields[2], URL: fields[3]}, nil
+}
+
+// IsEmpty returns true if the set has no definitions.
+func (s Set) IsEmpty() bool {
+	return len(s.Rules) == 0 && len(s.Groups) == 0 && len(s.Notify) == 0
+}
+
+// Merge adds the definitions of o to the set.
+func (s *Set) Merge(o Set) {
+	if s.Rules == nil {
+		s.Rules = make(map[string]mercury.Rules)
+	}
+	if s.Groups == nil {
+		s.Groups = make(map[string][]string)
+	}
+
+	for group, rules := range o.Rules {
+		s.Rules[group] = append(s.Rules[group], rules...)
+	}
+	for group, members := range o.Groups {
+		s.Groups[group] = append(s.Groups[group], members...)
+	}
+	s.Notify = append(s.Notify, o.Notify...)
+}
+
+// GetRules returns the rules of each group the user is a member of. Group
+// names are compared without case as settings keys are lower case.
+func (s Set) GetRules(user ident.Ident) (lis mercury.Rules) {
+	ids := map[string]struct{}{"U-" + user.GetIdentity(): {}}
+	for _, g := range user.GetGroups() {
+		ids["G-"+g] = struct{}{}
+	}
+	for _, r := range user.GetRoles() {
+		ids["R-"+r] = struct{}{}
+	}
+
+	groups := make(map[string]struct{})
+	for group, members := range s.Groups {
+		for _, m := range members {
+			if _, ok := ids[m]; ok {
+				groups[strings.ToLower(group)] = struct{}{}
+				break
+			}
+		}
+	}
+
+	var names []string
+	for name := range s.Rules {
+		if _, ok := groups[strings.ToLower(name)]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		lis = append(lis, s.Rules[name]...)
+	}
+
+	return
+}
+
+// GetNotify returns the notifies for event.
+func (s Set) GetNotify(event string) (lis mercury.ListNotify) {
+	for _, n := range s.Notify {
+		if n.Event == event {
+			lis = append(lis, n)
+		}
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
+	"sour.is/x/toolbox/mercury"
+)
+
+// spaceHandler keeps spaces in memory.
+type spaceHandler struct {
+	spaces map[string]*mercury.Space
+}
+
+func (h *spaceHandler) GetIndex(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program) (mercury.Config, error) {
+	return h.GetObjects(ctx, search, pgm, nil)
+}
+func (h *spaceHandler) GetObjects(ctx context.Context, search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (lis mercury.Config, err error) {
+	for name, s := range h.spaces {
+		if search.Match(name) {
+			lis = append(lis, s)
+		}
+	}
+	return
+}
+func (h *spaceHandler) WriteObjects(ctx context.Context, lis mercury.Config) error {
+	for _, s := range lis {
+		h.spaces[s.Space] = s
+	}
+	return nil
+}
+func (*spaceHandler) GetRules(context.Context, ident.Ident) (mercury.Rules, error) { return nil, nil }
+func (*spaceHandler) GetNotify(context.Context, string) (mercury.ListNotify, error) {
+	return nil, nil
+}
+
+func TestParseSet(t *testing.T) {
+	Convey("Given definitions", t, func() {
+		set, err := ParseSet(
+			map[string][]string{"admins": {"read NS *", "write  NS  app.*"}},
+			map[string][]string{"admins": {"U-jon", "G-ops"}},
+			map[string][]string{"hook": {"app.* updated POST http://localhost/hook"}},
+		)
+		So(err, ShouldBeNil)
+		So(set.Rules["admins"], ShouldResemble, mercury.Rules{
+			{Role: "read", Type: "NS", Match: "*"},
+			{Role: "write", Type: "NS", Match: "app.*"},
+		})
+		So(set.Notify, ShouldResemble, mercury.ListNotify{
+			{Name: "hook", Match: "app.*", Event: "updated", Method: "POST", URL: "http://localhost/hook"},
+		})
+
+		Convey("rules are given to members", func() {
+			So(set.GetRules(mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)), ShouldHaveLength, 2)
+			So(set.GetRules(mock.NewMock("ann", "test", "Ann", []string{"ops"}, nil, nil, true)), ShouldHaveLength, 2)
+			So(set.GetRules(mock.NewMock("bob", "test", "Bob", []string{"dev"}, nil, nil, true)), ShouldBeEmpty)
+		})
+
+		Convey("notifies are found by event", func() {
+			So(set.GetNotify("updated"), ShouldHaveLength, 1)
+			So(set.GetNotify("deleted"), ShouldBeEmpty)
+		})
+
+		Convey("bad lines fail", func() {
+			_, err := ParseSet(map[string][]string{"admins": {"read NS"}}, nil, nil)
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseSet(nil, nil, map[string][]string{"hook": {"app.* updated POST"}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestHandler(t *testing.T) {
+	Convey("Given a handler reading spaces", t, func() {
+		mem := &spaceHandler{spaces: map[string]*mercury.Space{
+			GroupsSpace: {Space: GroupsSpace, List: []mercury.Value{{Name: "Dev", Values: []string{"R-developer"}}}},
+			RulesSpace:  {Space: RulesSpace, List: []mercury.Value{{Name: "Dev", Values: []string{"read NS app.*"}}}},
+		}}
+
+		h := &Handler{RulesSpace: RulesSpace, GroupsSpace: GroupsSpace, NotifySpace: NotifySpace}
+		h.Config, _ = ParseSet(map[string][]string{"dev": {"write NS app.dev"}}, nil, nil)
+
+		old := mercury.Registry
+		mercury.Registry = mercury.HandlerList{
+			{Match: "@mercury.*", Priority: 1, HandlerV2: mem},
+			{Match: "", HandlerV2: h},
+		}
+		Reset(func() { mercury.Registry = old })
+
+		ctx := context.Background()
+		user := mock.NewMock("jon", "test", "Jon", nil, []string{"developer"}, nil, true)
+
+		Convey("config and space rules are merged", func() {
+			rules, err := mercury.Registry.GetRulesContext(ctx, user)
+			So(err, ShouldBeNil)
+			So(rules, ShouldResemble, mercury.Rules{
+				{Role: "read", Type: "NS", Match: "app.*"},
+				{Role: "write", Type: "NS", Match: "app.dev"},
+			})
+		})
+
+		Convey("inactive users have no rules", func() {
+			rules, err := h.GetRules(ctx, mock.NewMock("jon", "test", "Jon", nil, []string{"developer"}, nil, false))
+			So(err, ShouldBeNil)
+			So(rules, ShouldBeEmpty)
+		})
+
+		Convey("writes to the spaces reload them", func() {
+			lis, err := h.GetNotify(ctx, "updated")
+			So(err, ShouldBeNil)
+			So(lis, ShouldBeEmpty)
+
+			err = mercury.Registry.WriteObjectsContext(ctx, mercury.Config{
+				{Space: NotifySpace, List: []mercury.Value{{Name: "hook", Values: []string{"app.* updated POST http://localhost/hook"}}}},
+			})
+			So(err, ShouldBeNil)
+
+			lis, err = h.GetNotify(ctx, "updated")
+			So(err, ShouldBeNil)
+			So(lis, ShouldHaveLength, 1)
+		})
+
+		Convey("changes made elsewhere are read after the TTL", func() {
+			h.TTL = time.Hour
+			_, err := h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+
+			mem.spaces[RulesSpace].List[0].Values = []string{"read NS app.*", "read NS other.*"}
+			rules, err := h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+			So(rules, ShouldHaveLength, 2)
+
+			h.TTL = time.Nanosecond
+			rules, err = h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+			So(rules, ShouldHaveLength, 3)
+
+			h.TTL = -1
+			mem.spaces[RulesSpace].List[0].Values = nil
+			rules, err = h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+			So(rules, ShouldHaveLength, 3)
+		})
+
+		Convey("bad definitions keep the last ones read", func() {
+			_, err := h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+
+			mem.spaces[RulesSpace].List[0].Values = []string{"read"}
+			h.Reload()
+
+			rules, err := h.GetRules(ctx, user)
+			So(err, ShouldBeNil)
+			So(rules, ShouldHaveLength, 2)
+		})
+	})
+}
@@ -0,0 +1,391 @@
+package mercury
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/log"
+)
+
+// PromoteRole is the rule role that allows approving a promotion into a space.
+const PromoteRole = "promote"
+
+// PromoteSpace prefixes the spaces that record the promotion of each target.
+const PromoteSpace = "@promote."
+
+// Promotion errors.
+var (
+	ErrPromoteDenied   = errors.New("promotion denied")
+	ErrPromoteNotFound = errors.New("promotion not found")
+	ErrPromoteStale    = errors.New("promotion is stale, the spaces changed since it was requested")
+	ErrPromoteEmpty    = errors.New("nothing to promote")
+	// ErrPromoteReserved is returned for writes to promotion records that
+	// are not made by RequestPromotion or ApprovePromotion.
+	ErrPromoteReserved = errors.New("promotion records are only written by promotion")
+)
+
+type promoteWriteKey struct{}
+
+// withPromoteWrite marks the context of writes made by promotion.
+func withPromoteWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, promoteWriteKey{}, true)
+}
+
+// checkReserved returns ErrPromoteReserved if any of the spaces are
+// promotion records and the context was not made by withPromoteWrite.
+func checkReserved(ctx context.Context, spaces Config) error {
+	if v, _ := ctx.Value(promoteWriteKey{}).(bool); v {
+		return nil
+	}
+	for _, s := range spaces {
+		if strings.HasPrefix(s.Space, PromoteSpace) {
+			return fmt.Errorf("%v: %s", ErrPromoteReserved, s.Space)
+		}
+	}
+	return nil
+}
+
+// Promotion is a change from one space to another that is applied once a
+// second identity approves it.
+type Promotion struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Exclude lists key names that are not promoted. They may use *
+	// wildcards and entries starting with # match a tag, eg. host* or #secret.
+	Exclude []string `json:"exclude,omitempty"`
+	// Secrets includes values tagged secret. They are excluded by default.
+	Secrets bool `json:"secrets,omitempty"`
+	// Patch changes the target to match the source. Secret values are
+	// masked and read again from the source when it is approved.
+	Patch Patch `json:"patch"`
+	// Hash identifies the request. It is sent with the approval so a
+	// promotion requested after the approver reviewed it is not applied.
+	Hash string `json:"hash"`
+
+	RequestedBy string    `json:"requested_by"`
+	Requested   time.Time `json:"requested"`
+	ApprovedBy  string    `json:"approved_by,omitempty"`
+	Approved    time.Time `json:"approved"`
+}
+
+// IsApproved returns true if the promotion was applied.
+func (p Promotion) IsApproved() bool {
+	return p.ApprovedBy != ""
+}
+
+// Diff returns the ops that make the keys of to match from. Keys excluded
+// in either space are left alone. Space tags and notes are not changed.
+func Diff(from, to *Space, exclude []string) (patch Patch) {
+	have := make(map[string]Value, len(to.List))
+	for _, v := range to.List {
+		if _, ok := have[v.Name]; !ok {
+			have[v.Name] = v
+		}
+	}
+
+	seen := make(map[string]struct{}, len(from.List))
+	for _, v := range from.List {
+		if _, ok := seen[v.Name]; ok {
+			continue
+		}
+		seen[v.Name] = struct{}{}
+
+		if excluded(v, exclude) {
+			continue
+		}
+
+		cur, ok := have[v.Name]
+		if ok && excluded(cur, exclude) {
+			continue
+		}
+		if !ok || !equalStrings(cur.Values, v.Values) {
+			patch = append(patch, PatchOp{Op: PatchSet, Space: to.Space, Name: v.Name, Values: v.Values})
+		}
+		if !equalStrings(cur.Tags, v.Tags) {
+			patch = append(patch, PatchOp{Op: PatchSet, Space: to.Space, Name: v.Name, Field: FieldTags, Values: v.Tags})
+		}
+	}
+
+	for _, v := range to.List {
+		if _, ok := seen[v.Name]; ok || excluded(v, exclude) {
+			continue
+		}
+		seen[v.Name] = struct{}{}
+		patch = append(patch, PatchOp{Op: PatchRemove, Space: to.Space, Name: v.Name})
+	}
+
+	return
+}
+
+func excluded(v Value, exclude []string) bool {
+	for _, e := range exclude {
+		if strings.HasPrefix(e, "#") {
+			if v.HasTag(e[1:]) {
+				return true
+			}
+		} else if likeMatch(e, v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestPromotion records the diff from one space to another for approval.
+// The user must be able to read both spaces. Values tagged secret are only
+// promoted if secrets is set and the user has the SecretRole on both spaces.
+// A pending promotion to the same space is replaced.
+func RequestPromotion(ctx context.Context, user ident.Ident, from, to string, exclude []string, secrets bool) (*Promotion, error) {
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return nil, err
+	}
+	if from == to || !rules.GetRoles("NS", from).HasRole("read", "write") || !rules.GetRoles("NS", to).HasRole("read", "write") {
+		return nil, ErrPromoteDenied
+	}
+	if secrets && (!rules.GetRoles("NS", from).HasRole(SecretRole) || !rules.GetRoles("NS", to).HasRole(SecretRole)) {
+		return nil, ErrPromoteDenied
+	}
+
+	p := &Promotion{
+		From:        from,
+		To:          to,
+		Exclude:     exclude,
+		Secrets:     secrets,
+		RequestedBy: user.GetIdentity(),
+		Requested:   time.Now().UTC(),
+	}
+
+	patch, secret, err := p.diff(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) == 0 {
+		return nil, ErrPromoteEmpty
+	}
+	p.Patch = maskPatch(patch, secret)
+	p.Hash = p.hash()
+
+	if err = Registry.WriteObjectsContext(withPromoteWrite(ctx), Config{p.toSpace()}); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// GetPromotion returns the last promotion requested for the space if the
+// user can read it.
+func GetPromotion(ctx context.Context, user ident.Ident, to string) (*Promotion, error) {
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return nil, err
+	}
+	if !rules.GetRoles("NS", to).HasRole("read", "write", PromoteRole) {
+		return nil, ErrPromoteDenied
+	}
+
+	return loadPromotion(ctx, to)
+}
+
+// ApprovePromotion applies the pending promotion to the space. The user must
+// hold the PromoteRole on the space and not be the one that requested it.
+// The patch is applied in one write and the updated notifies are sent for
+// the space. If hash is not that of the pending promotion or the spaces
+// changed since the request it fails as stale.
+func ApprovePromotion(ctx context.Context, user ident.Ident, to, hash string) (*Promotion, error) {
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return nil, err
+	}
+	if !rules.GetRoles("NS", to).HasRole(PromoteRole) {
+		return nil, ErrPromoteDenied
+	}
+
+	p, err := loadPromotion(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsApproved() {
+		return nil, ErrPromoteNotFound
+	}
+	if p.Hash != hash {
+		return nil, ErrPromoteStale
+	}
+	if p.RequestedBy == user.GetIdentity() {
+		return nil, fmt.Errorf("%v: approval must be by a second identity", ErrPromoteDenied)
+	}
+
+	patch, secret, err := p.diff(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !samePatch(maskPatch(patch, secret), p.Patch) {
+		return nil, ErrPromoteStale
+	}
+
+	if err = Registry.PatchObjectsContext(ctx, patch); err != nil {
+		return nil, err
+	}
+	log.Infos("mercury promote", "from", p.From, "to", p.To, "requested_by", p.RequestedBy, "approved_by", user.GetIdentity())
+
+	p.ApprovedBy = user.GetIdentity()
+	p.Approved = time.Now().UTC()
+	if err = Registry.WriteObjectsContext(withPromoteWrite(ctx), Config{p.toSpace()}); err != nil {
+		log.Error(err)
+	}
+
+	sendNotify(ctx, "updated", Config{NewSpace(p.To)})
+
+	return p, nil
+}
+
+// diff reads both spaces and returns the diff between them with the names
+// of the keys that are secret in either.
+func (p Promotion) diff(ctx context.Context) (Patch, map[string]bool, error) {
+	lis, err := Registry.GetObjectsContext(ctx, p.From+","+p.To, "", "")
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return nil, nil, err
+	}
+
+	m := lis.ToSpaceMap()
+	src, ok := m[p.From]
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %s does not exist", ErrPromoteNotFound, p.From)
+	}
+	dst, ok := m[p.To]
+	if !ok {
+		dst = NewSpace(p.To)
+	}
+
+	secret := make(map[string]bool)
+	for _, v := range append(src.List, dst.List...) {
+		if v.IsSecret() {
+			secret[v.Name] = true
+		}
+	}
+
+	exclude := p.Exclude
+	if !p.Secrets {
+		exclude = append(exclude[:len(exclude):len(exclude)], "#"+SecretTag)
+	}
+
+	return Diff(src, dst, exclude), secret, nil
+}
+
+// maskPatch masks the values set on secret keys as Redact does, so they
+// are not stored or returned with the promotion.
+func maskPatch(patch Patch, secret map[string]bool) Patch {
+	out := make(Patch, len(patch))
+	for i, op := range patch {
+		if op.Op == PatchSet && op.Field == "" && secret[op.Name] {
+			masked := make([]string, len(op.Values))
+			for j := range op.Values {
+				masked[j] = MaskSecret(op.Values[j])
+			}
+			op.Values = masked
+		}
+		out[i] = op
+	}
+	return out
+}
+
+// loadPromotion reads the promotion record of the space.
+func loadPromotion(ctx context.Context, to string) (*Promotion, error) {
+	space := PromoteSpace + to
+
+	lis, err := Registry.GetObjectsContext(ctx, space, "", "")
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return nil, err
+	}
+
+	for _, s := range lis {
+		if s.Space == space {
+			return promotionFromSpace(s)
+		}
+	}
+
+	return nil, ErrPromoteNotFound
+}
+
+// toSpace stores the promotion as values. Each patch op is a line of JSON.
+func (p Promotion) toSpace() *Space {
+	s := NewSpace(PromoteSpace + p.To)
+
+	var ops []string
+	for _, op := range p.Patch {
+		b, _ := json.Marshal(op)
+		ops = append(ops, string(b))
+	}
+
+	s.AddKeys(
+		NewValue("from").SetValues(p.From),
+		NewValue("exclude").SetValues(p.Exclude...),
+		NewValue("secrets").SetValues(fmt.Sprint(p.Secrets)),
+		NewValue("patch").SetValues(ops...),
+		NewValue("requested_by").SetValues(p.RequestedBy),
+		NewValue("requested").SetValues(p.Requested.Format(time.RFC3339)),
+	)
+	if p.IsApproved() {
+		s.AddKeys(
+			NewValue("approved_by").SetValues(p.ApprovedBy),
+			NewValue("approved").SetValues(p.Approved.Format(time.RFC3339)),
+		)
+	}
+
+	return s
+}
+
+func promotionFromSpace(s *Space) (*Promotion, error) {
+	p := &Promotion{
+		From:        s.FirstValue("from").First(),
+		To:          strings.TrimPrefix(s.Space, PromoteSpace),
+		Exclude:     s.FirstValue("exclude").Values,
+		Secrets:     s.FirstValue("secrets").First() == "true",
+		RequestedBy: s.FirstValue("requested_by").First(),
+		ApprovedBy:  s.FirstValue("approved_by").First(),
+	}
+
+	for _, line := range s.FirstValue("patch").Values {
+		var op PatchOp
+		if err := json.Unmarshal([]byte(line), &op); err != nil {
+			return nil, fmt.Errorf("promotion %s: %v", p.To, err)
+		}
+		p.Patch = append(p.Patch, op)
+	}
+
+	p.Requested, _ = time.Parse(time.RFC3339, s.FirstValue("requested").First())
+	p.Approved, _ = time.Parse(time.RFC3339, s.FirstValue("approved").First())
+	p.Hash = p.hash()
+
+	return p, nil
+}
+
+// hash returns a digest of the request as it is stored.
+func (p Promotion) hash() string {
+	h := sha256.New()
+	fmt.Fprintln(h, p.From, p.To, p.Secrets, p.RequestedBy, p.Requested.Format(time.RFC3339))
+	fmt.Fprintln(h, strings.Join(p.Exclude, ","))
+	for _, op := range p.Patch {
+		b, _ := json.Marshal(op)
+		fmt.Fprintf(h, "%s\n", b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func samePatch(a, b Patch) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() || !equalStrings(a[i].Values, b[i].Values) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package mercury
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident"
+	"sour.is/x/toolbox/ident/mock"
+)
+
+// identRulesHandler returns rules by identity.
+type identRulesHandler struct {
+	*memHandler
+	rules map[string]Rules
+}
+
+func (h identRulesHandler) GetRules(_ context.Context, user ident.Ident) (Rules, error) {
+	return h.rules[user.GetIdentity()], nil
+}
+
+func TestDiff(t *testing.T) {
+	Convey("Given a source and target space", t, func() {
+		from := &Space{Space: "svc.staging", List: []Value{
+			{Name: "image", Values: []string{"v2"}},
+			{Name: "replicas", Values: []string{"3"}, Tags: []string{"scale"}},
+			{Name: "host", Values: []string{"staging.example.com"}},
+			{Name: "password", Values: []string{"s"}, Tags: []string{SecretTag}},
+			{Name: "feature", Values: []string{"on"}},
+		}}
+		to := &Space{Space: "svc.prod", List: []Value{
+			{Name: "image", Values: []string{"v1"}},
+			{Name: "replicas", Values: []string{"3"}},
+			{Name: "host", Values: []string{"prod.example.com"}},
+			{Name: "password", Values: []string{"p"}, Tags: []string{SecretTag}},
+			{Name: "old", Values: []string{"x"}},
+		}}
+
+		So(Diff(from, to, []string{"host*", "#secret"}), ShouldResemble, Patch{
+			{Op: PatchSet, Space: "svc.prod", Name: "image", Values: []string{"v2"}},
+			{Op: PatchSet, Space: "svc.prod", Name: "replicas", Field: FieldTags, Values: []string{"scale"}},
+			{Op: PatchSet, Space: "svc.prod", Name: "feature", Values: []string{"on"}},
+			{Op: PatchRemove, Space: "svc.prod", Name: "old"},
+		})
+
+		So(Diff(from, from, nil), ShouldBeEmpty)
+	})
+}
+
+func TestPromotion(t *testing.T) {
+	Convey("Given staging and prod spaces", t, func() {
+		mem := newMemHandler()
+		mem.spaces["svc.staging"] = &Space{Space: "svc.staging", List: []Value{
+			{Name: "image", Values: []string{"v2"}},
+			{Name: "host", Values: []string{"staging.example.com"}},
+			{Name: "token", Values: []string{"s3cret"}, Tags: []string{SecretTag}},
+		}}
+		mem.spaces["svc.prod"] = &Space{Space: "svc.prod", List: []Value{
+			{Name: "image", Values: []string{"v1"}},
+			{Name: "host", Values: []string{"prod.example.com"}},
+			{Name: "token", Values: []string{"old"}, Tags: []string{SecretTag}},
+		}}
+
+		rules := map[string]Rules{
+			"jon": {{Role: "write", Type: "NS", Match: "svc.*"}},
+			"ann": {{Role: "read", Type: "NS", Match: "svc.*"}, {Role: PromoteRole, Type: "NS", Match: "svc.prod"}},
+			"bob": {{Role: "read", Type: "NS", Match: "svc.*"}},
+		}
+
+		old := Registry
+		Registry = HandlerList{{Match: "*", Priority: 1, HandlerV2: identRulesHandler{mem, rules}}}
+		Reset(func() { Registry = old })
+
+		ctx := context.Background()
+		jon := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+		ann := mock.NewMock("ann", "test", "Ann", nil, nil, nil, true)
+		bob := mock.NewMock("bob", "test", "Bob", nil, nil, nil, true)
+
+		p, err := RequestPromotion(ctx, jon, "svc.staging", "svc.prod", []string{"host"}, false)
+		So(err, ShouldBeNil)
+		So(p.Patch, ShouldResemble, Patch{{Op: PatchSet, Space: "svc.prod", Name: "image", Values: []string{"v2"}}})
+
+		Convey("it is recorded until approved", func() {
+			got, err := GetPromotion(ctx, bob, "svc.prod")
+			So(err, ShouldBeNil)
+			So(got.RequestedBy, ShouldEqual, "jon")
+			So(got.Patch, ShouldResemble, p.Patch)
+			So(got.Hash, ShouldEqual, p.Hash)
+			So(got.IsApproved(), ShouldBeFalse)
+			So(mem.spaces["svc.prod"].FirstValue("image").Values, ShouldResemble, []string{"v1"})
+		})
+
+		Convey("a second identity with the promote role applies it", func() {
+			_, err := ApprovePromotion(ctx, jon, "svc.prod", p.Hash)
+			So(err, ShouldEqual, ErrPromoteDenied)
+
+			_, err = ApprovePromotion(ctx, bob, "svc.prod", p.Hash)
+			So(err, ShouldEqual, ErrPromoteDenied)
+
+			got, err := ApprovePromotion(ctx, ann, "svc.prod", p.Hash)
+			So(err, ShouldBeNil)
+			So(got.ApprovedBy, ShouldEqual, "ann")
+			So(mem.spaces["svc.prod"].FirstValue("image").Values, ShouldResemble, []string{"v2"})
+			So(mem.spaces["svc.prod"].FirstValue("host").Values, ShouldResemble, []string{"prod.example.com"})
+
+			got, err = GetPromotion(ctx, bob, "svc.prod")
+			So(err, ShouldBeNil)
+			So(got.ApprovedBy, ShouldEqual, "ann")
+
+			_, err = ApprovePromotion(ctx, ann, "svc.prod", p.Hash)
+			So(err, ShouldEqual, ErrPromoteNotFound)
+		})
+
+		Convey("the requester can not approve", func() {
+			rules["jon"] = append(rules["jon"], Rule{Role: PromoteRole, Type: "NS", Match: "svc.prod"})
+
+			_, err := ApprovePromotion(ctx, jon, "svc.prod", p.Hash)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, ErrPromoteDenied.Error())
+		})
+
+		Convey("promotion records can not be written directly", func() {
+			rec := NewSpace(PromoteSpace + "svc.prod")
+			rec.AddKeys(NewValue("requested_by").SetValues("ann"))
+
+			err := Registry.WriteObjectsContext(ctx, Config{rec})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, ErrPromoteReserved.Error())
+
+			err = Registry.PatchObjectsContext(ctx, Patch{{Op: PatchSet, Space: rec.Space, Name: "requested_by", Values: []string{"ann"}}})
+			So(err, ShouldNotBeNil)
+
+			got, err := GetPromotion(ctx, bob, "svc.prod")
+			So(err, ShouldBeNil)
+			So(got.RequestedBy, ShouldEqual, "jon")
+		})
+
+		Convey("secrets are only promoted when asked and are masked", func() {
+			_, err := RequestPromotion(ctx, jon, "svc.staging", "svc.prod", []string{"host"}, true)
+			So(err, ShouldEqual, ErrPromoteDenied)
+
+			rules["jon"] = append(rules["jon"], Rule{Role: SecretRole, Type: "NS", Match: "svc.*"})
+			p, err := RequestPromotion(ctx, jon, "svc.staging", "svc.prod", []string{"host"}, true)
+			So(err, ShouldBeNil)
+			So(p.Patch, ShouldContain, PatchOp{Op: PatchSet, Space: "svc.prod", Name: "token", Values: []string{"****"}})
+
+			rec := mem.spaces[PromoteSpace+"svc.prod"]
+			for _, v := range rec.FirstValue("patch").Values {
+				So(v, ShouldNotContainSubstring, "s3cret")
+			}
+
+			got, err := ApprovePromotion(ctx, ann, "svc.prod", p.Hash)
+			So(err, ShouldBeNil)
+			So(got.Patch, ShouldResemble, p.Patch)
+			So(mem.spaces["svc.prod"].FirstValue("token").Values, ShouldResemble, []string{"s3cret"})
+		})
+
+		Convey("a promotion replaced since it was reviewed is stale", func() {
+			_, err := RequestPromotion(ctx, jon, "svc.staging", "svc.prod", nil, false)
+			So(err, ShouldBeNil)
+
+			_, err = ApprovePromotion(ctx, ann, "svc.prod", p.Hash)
+			So(err, ShouldEqual, ErrPromoteStale)
+			So(mem.spaces["svc.prod"].FirstValue("host").Values, ShouldResemble, []string{"prod.example.com"})
+		})
+
+		Convey("changes since the request make it stale", func() {
+			mem.spaces["svc.staging"].List[0].Values = []string{"v3"}
+
+			_, err := ApprovePromotion(ctx, ann, "svc.prod", p.Hash)
+			So(err, ShouldEqual, ErrPromoteStale)
+		})
+	})
+}
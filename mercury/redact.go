@@ -0,0 +1,82 @@
+package mercury
+
+import (
+	"regexp"
+
+	"sour.is/x/toolbox/dbm"
+)
+
+const (
+	// SecretTag marks a value as secret. Secret values are masked for users
+	// without the SecretRole on the space.
+	SecretTag = "secret"
+
+	// SecretRole is the rule role that allows reading raw secret values.
+	SecretRole = "secret"
+)
+
+var envPair = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.]*)=(.*)$`)
+
+// MaskSecret hides a secret value. Passwords in connect strings are masked
+// as dbm does for logging and NAME=value pairs keep their name.
+func MaskSecret(s string) string {
+	if m := envPair.FindStringSubmatch(s); m != nil {
+		return m[1] + "=" + MaskSecret(m[2])
+	}
+
+	if masked := dbm.MaskConnect(s); masked != s {
+		return masked
+	}
+
+	return "****"
+}
+
+// IsSecret returns true if the value is tagged secret.
+func (v Value) IsSecret() bool {
+	for _, t := range v.Tags {
+		if t == SecretTag {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact masks secret values in spaces the user does not have the SecretRole
+// for. Searches must be filtered after masking so they can not be used to
+// probe raw values.
+func (rules Rules) Redact(lis Config) Config {
+	out := make(Config, 0, len(lis))
+
+	for _, s := range lis {
+		if rules.GetRoles("NS", s.Space).HasRole(SecretRole) || !s.hasSecret() {
+			out = append(out, s)
+			continue
+		}
+
+		space := *s
+		space.List = make([]Value, len(s.List))
+		for i, v := range s.List {
+			if v.IsSecret() {
+				masked := make([]string, len(v.Values))
+				for j := range v.Values {
+					masked[j] = MaskSecret(v.Values[j])
+				}
+				v.Values = masked
+			}
+			space.List[i] = v
+		}
+
+		out = append(out, &space)
+	}
+
+	return out
+}
+
+func (s *Space) hasSecret() bool {
+	for _, v := range s.List {
+		if v.IsSecret() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package mercury
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+)
+
+func TestMaskSecret(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hunter2", "****"},
+		{"user:pass@tcp(host)/db", "user:****@tcp(host)/db"},
+		{"host=localhost password=hunter2 sslmode=disable", "host=localhost password=**** sslmode=disable"},
+		{"API_TOKEN=abc", "API_TOKEN=****"},
+	}
+
+	Convey("Given secret values", t, func() {
+		for _, tt := range tests {
+			So(MaskSecret(tt.in), ShouldEqual, tt.want)
+		}
+	})
+}
+
+func TestRules_Redact(t *testing.T) {
+	newConfig := func() Config {
+		return Config{
+			&Space{Space: "app.settings", List: []Value{
+				{Name: "app.name", Values: []string{"test"}},
+				{Name: "db.password", Values: []string{"hunter2"}, Tags: []string{SecretTag}},
+			}},
+		}
+	}
+
+	Convey("Given a space with secrets", t, func() {
+		Convey("readers see masked values", func() {
+			rules := Rules{{Role: "read", Type: "NS", Match: "app.*"}}
+			cfg := newConfig()
+
+			lis := rules.Redact(cfg)
+			So(lis[0].List[0].Values, ShouldResemble, []string{"test"})
+			So(lis[0].List[1].Values, ShouldResemble, []string{"****"})
+			So(cfg[0].List[1].Values, ShouldResemble, []string{"hunter2"})
+		})
+
+		Convey("a search can not probe raw values", func() {
+			rules := Rules{{Role: "read", Type: "NS", Match: "app.*"}}
+			search := func(q string) Config {
+				return rules.Redact(newConfig()).Filter(rsql.DefaultParse(q), []string{"db.password"})
+			}
+
+			So(search("value==hunter2"), ShouldBeEmpty)
+			So(search("value!=hunter2"), ShouldHaveLength, 1)
+			So(search("value!=hunter3"), ShouldHaveLength, 1)
+			So(search("value>hunter1"), ShouldResemble, search("value>hunter3"))
+			So(search("value<hunter1"), ShouldResemble, search("value<hunter3"))
+		})
+
+		Convey("the secret role sees raw values", func() {
+			rules := Rules{
+				{Role: "read", Type: "NS", Match: "app.*"},
+				{Role: SecretRole, Type: "NS", Match: "app.settings"},
+			}
+
+			lis := rules.Redact(newConfig())
+			So(lis[0].List[1].Values, ShouldResemble, []string{"hunter2"})
+		})
+	})
+}
@@ -0,0 +1,328 @@
+package mercury
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"sour.is/x/toolbox/ident"
+)
+
+// TemplateKey is the name of the value that holds a template.
+const TemplateKey = "template"
+
+// MaxRenderSize limits the output of a template.
+const MaxRenderSize = 1 << 20
+
+// RenderTimeout limits how long a template may run.
+var RenderTimeout = 5 * time.Second
+
+// MaxTemplateCalls limits the number of template calls a template expands
+// to, not counting ranges, so nested calls can not multiply the work.
+const MaxTemplateCalls = 1000
+
+// TemplateFuncs are the helpers available to templates. They mirror the
+// Space methods and are safe to call with a missing space. Templates have
+// no other functions so can not reach files or run commands.
+var TemplateFuncs = template.FuncMap{
+	"firstValue": func(s *Space, name string) string {
+		if s == nil {
+			return ""
+		}
+		return s.FirstValue(name).First()
+	},
+	"getValues": func(s *Space, name string) (lis []string) {
+		if s == nil {
+			return nil
+		}
+		for _, v := range s.GetValues(name) {
+			lis = append(lis, v.Values...)
+		}
+		return
+	},
+	"hasTag": func(s *Space, tag string) bool {
+		return s != nil && s.HasTag(tag)
+	},
+	"join": strings.Join,
+}
+
+// RenderData is passed to templates.
+type RenderData struct {
+	// Spaces are the spaces the template is rendered against in order.
+	Spaces Config
+}
+
+// Space returns the named space or nil if it was not found.
+func (d RenderData) Space(name string) *Space {
+	for _, s := range d.Spaces {
+		if s.Space == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// TemplateSpace returns the space a template is stored in. Templates are
+// kept in @ spaces so the @ may be left out.
+func TemplateSpace(name string) string {
+	if strings.HasPrefix(name, "@") {
+		return name
+	}
+	return "@" + name
+}
+
+// LoadTemplate returns the template stored in the named space if the user
+// can read it. The template is empty if it was not found.
+func LoadTemplate(ctx context.Context, user ident.Ident, name string) (string, error) {
+	space := TemplateSpace(name)
+
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return "", err
+	}
+	if !rules.GetRoles("NS", space).HasRole("read", "write") {
+		return "", nil
+	}
+
+	lis, err := Registry.GetObjectsContext(ctx, space, "", "")
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		return "", err
+	}
+
+	for _, s := range lis {
+		if s.Space == space {
+			return s.FirstValue(TemplateKey).Join(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// ParseTemplate parses text with the TemplateFuncs. Ranges over numbers are
+// refused as they loop without reading any data. Recursive templates and
+// templates expanding to more than MaxTemplateCalls calls are refused as the
+// work they do can grow without writing any output.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make(map[string]bool)
+	calls := make(map[string][]string)
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if err = checkRange(t.Tree.Root, numbers); err != nil {
+			return nil, fmt.Errorf("template: %s: %v", t.Name(), err)
+		}
+		calls[t.Name()] = templateCalls(t.Tree.Root, nil)
+	}
+
+	costs := make(map[string]int)
+	for name := range calls {
+		if _, err = callCost(name, calls, costs, make(map[string]bool)); err != nil {
+			return nil, fmt.Errorf("template: %s: %v", name, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// templateCalls appends the names of the templates called under node.
+func templateCalls(node parse.Node, lis []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return lis
+		}
+		for _, c := range n.Nodes {
+			lis = templateCalls(c, lis)
+		}
+
+	case *parse.TemplateNode:
+		lis = append(lis, n.Name)
+
+	case *parse.RangeNode:
+		lis = templateCalls(n.List, lis)
+		lis = templateCalls(n.ElseList, lis)
+
+	case *parse.IfNode:
+		lis = templateCalls(n.List, lis)
+		lis = templateCalls(n.ElseList, lis)
+
+	case *parse.WithNode:
+		lis = templateCalls(n.List, lis)
+		lis = templateCalls(n.ElseList, lis)
+	}
+
+	return lis
+}
+
+// callCost returns the number of template calls name expands to. It returns
+// an error if name calls itself or expands to more than MaxTemplateCalls.
+func callCost(name string, calls map[string][]string, costs map[string]int, visiting map[string]bool) (int, error) {
+	if cost, ok := costs[name]; ok {
+		return cost, nil
+	}
+	if visiting[name] {
+		return 0, fmt.Errorf("recursive call to %q", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	cost := 1
+	for _, c := range calls[name] {
+		n, err := callCost(c, calls, costs, visiting)
+		if err != nil {
+			return 0, err
+		}
+		cost += n
+		if cost > MaxTemplateCalls {
+			return 0, fmt.Errorf("more than %d template calls", MaxTemplateCalls)
+		}
+	}
+
+	costs[name] = cost
+	return cost, nil
+}
+
+// checkRange returns an error for a range over a number or a variable set
+// to one.
+func checkRange(node parse.Node, numbers map[string]bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkRange(c, numbers); err != nil {
+				return err
+			}
+		}
+
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 && isNumber(n.Pipe, numbers) {
+			for _, v := range n.Pipe.Decl {
+				numbers[v.Ident[0]] = true
+			}
+		}
+
+	case *parse.RangeNode:
+		if isNumber(n.Pipe, numbers) {
+			return fmt.Errorf("range over a number at %s", n.Pipe)
+		}
+		if err := checkRange(n.List, numbers); err != nil {
+			return err
+		}
+		return checkRange(n.ElseList, numbers)
+
+	case *parse.IfNode:
+		if err := checkRange(n.List, numbers); err != nil {
+			return err
+		}
+		return checkRange(n.ElseList, numbers)
+
+	case *parse.WithNode:
+		if err := checkRange(n.List, numbers); err != nil {
+			return err
+		}
+		return checkRange(n.ElseList, numbers)
+	}
+
+	return nil
+}
+
+func isNumber(pipe *parse.PipeNode, numbers map[string]bool) bool {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	switch a := pipe.Cmds[0].Args[0].(type) {
+	case *parse.NumberNode:
+		return true
+	case *parse.VariableNode:
+		return len(a.Ident) == 1 && numbers[a.Ident[0]]
+	}
+	return false
+}
+
+// Render executes the template against the spaces matching space that the
+// user can read. Secrets are masked as for reads. The template is stopped
+// at its next write once RenderTimeout passes.
+func Render(ctx context.Context, user ident.Ident, tmpl *template.Template, space string) ([]byte, error) {
+	// Handler failures are returned with the results of the others.
+	var partial HandlerErrors
+
+	rules, err := Registry.GetRulesContext(ctx, user)
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	ns := rules.ReduceSearch(ParseNamespace(space))
+
+	lis, err := Registry.GetObjectsContext(ctx, ns.String(), "", "")
+	if herrs, ok := err.(HandlerErrors); ok {
+		partial = append(partial, herrs...)
+	} else if err != nil {
+		return nil, err
+	}
+
+	lis, err = rules.filterSpace(lis)
+	if err != nil {
+		return nil, err
+	}
+	lis = rules.Redact(lis)
+	sort.Sort(lis)
+
+	rctx, cancel := context.WithTimeout(ctx, RenderTimeout)
+	defer cancel()
+
+	buf := &limitBuffer{ctx: rctx}
+	done := make(chan error, 1)
+	go func() { done <- tmpl.Execute(buf, RenderData{Spaces: lis}) }()
+
+	select {
+	case err = <-done:
+	case <-rctx.Done():
+		err = rctx.Err()
+	}
+	if err != nil {
+		if rctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("render took longer than %s", RenderTimeout)
+		}
+		return nil, err
+	}
+
+	if len(partial) > 0 {
+		return buf.Bytes(), partial
+	}
+	return buf.Bytes(), nil
+}
+
+// limitBuffer fails writes past MaxRenderSize or once ctx is done.
+type limitBuffer struct {
+	ctx context.Context
+	buf bytes.Buffer
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if b.buf.Len()+len(p) > MaxRenderSize {
+		return 0, fmt.Errorf("render is larger than %d bytes", MaxRenderSize)
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
@@ -0,0 +1,136 @@
+package mercury
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/ident/mock"
+)
+
+func TestRender(t *testing.T) {
+	Convey("Given a template and spaces", t, func() {
+		mem := newMemHandler()
+		mem.spaces["@tpl.nginx"] = &Space{Space: "@tpl.nginx", List: []Value{{Name: TemplateKey, Values: []string{
+			`{{range .Spaces}}{{if hasTag . "web"}}server {{firstValue . "host"}}:{{firstValue . "port"}};`,
+			`{{end}}{{end}}pass {{firstValue (.Space "svc.web.a") "password"}}`,
+			`{{join (getValues (.Space "svc.web.b") "alias") ","}}{{firstValue (.Space "none") "host"}}`,
+		}}}}
+		mem.spaces["svc.web.a"] = &Space{Space: "svc.web.a", Tags: []string{"web"}, List: []Value{
+			{Name: "host", Values: []string{"a.example.com"}},
+			{Name: "port", Values: []string{"80"}},
+			{Name: "password", Values: []string{"hunter2"}, Tags: []string{SecretTag}},
+		}}
+		mem.spaces["svc.web.b"] = &Space{Space: "svc.web.b", Tags: []string{"web"}, List: []Value{
+			{Name: "host", Values: []string{"b.example.com"}},
+			{Name: "port", Values: []string{"8080"}},
+			{Name: "alias", Values: []string{"b1"}},
+			{Name: "alias", Values: []string{"b2"}},
+		}}
+		mem.spaces["svc.db"] = &Space{Space: "svc.db", Tags: []string{"web"}, List: []Value{
+			{Name: "host", Values: []string{"db.example.com"}},
+		}}
+
+		rules := Rules{{Role: "read", Type: "NS", Match: "@tpl.*"}, {Role: "read", Type: "NS", Match: "svc.web.*"}}
+
+		old := Registry
+		Registry = HandlerList{{Match: "*", Priority: 1, HandlerV2: rulesHandler{mem, rules}}}
+		Reset(func() { Registry = old })
+
+		ctx := context.Background()
+		user := mock.NewMock("jon", "test", "Jon", nil, nil, nil, true)
+
+		text, err := LoadTemplate(ctx, user, "tpl.nginx")
+		So(err, ShouldBeNil)
+		So(text, ShouldStartWith, "{{range .Spaces}}")
+
+		tmpl, err := ParseTemplate("tpl.nginx", text)
+		So(err, ShouldBeNil)
+
+		Convey("it renders the readable spaces with secrets masked", func() {
+			out, err := Render(ctx, user, tmpl, "svc.*")
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, strings.Join([]string{
+				"server a.example.com:80;",
+				"server b.example.com:8080;",
+				"pass " + MaskSecret("hunter2"),
+				"b1,b2",
+			}, "\n"))
+		})
+
+		Convey("unreadable templates are not found", func() {
+			mem.spaces["@private.tpl"] = &Space{Space: "@private.tpl", List: []Value{{Name: TemplateKey, Values: []string{"x"}}}}
+
+			text, err := LoadTemplate(ctx, user, "@private.tpl")
+			So(err, ShouldBeNil)
+			So(text, ShouldBeEmpty)
+		})
+
+		Convey("templates have no file or exec helpers", func() {
+			_, err := ParseTemplate("bad", `{{readFile "/etc/passwd"}}`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("output is limited", func() {
+			tmpl, err := ParseTemplate("big", `{{define "x"}}{{.}}{{.}}{{.}}{{.}}{{end}}{{range getValues (.Space "svc.web.a") "port"}}{{template "x" (printf "%0100000d" 0)}}{{template "x" (printf "%0999999d" 0)}}{{end}}`)
+			So(err, ShouldBeNil)
+
+			_, err = Render(ctx, user, tmpl, "svc.*")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("slow templates are stopped", func() {
+			old := RenderTimeout
+			RenderTimeout = time.Nanosecond
+			defer func() { RenderTimeout = old }()
+
+			before := runtime.NumGoroutine()
+
+			_, err := Render(ctx, user, tmpl, "svc.*")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "longer than")
+
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+		})
+
+		Convey("recursive and fanned out templates are refused", func() {
+			for _, text := range []string{
+				`{{define "x"}}{{template "x" .}}{{end}}{{template "x" .}}`,
+				`{{define "a"}}{{template "b" .}}{{end}}{{define "b"}}{{template "a" .}}{{end}}`,
+				`{{define "a"}}{{template "b"}}{{template "b"}}{{template "b"}}{{template "b"}}{{end}}` +
+					`{{define "b"}}{{template "c"}}{{template "c"}}{{template "c"}}{{template "c"}}{{end}}` +
+					`{{define "c"}}{{template "d"}}{{template "d"}}{{template "d"}}{{template "d"}}{{end}}` +
+					`{{define "d"}}{{template "e"}}{{template "e"}}{{template "e"}}{{template "e"}}{{end}}` +
+					`{{define "e"}}{{template "f"}}{{template "f"}}{{template "f"}}{{template "f"}}{{end}}` +
+					`{{define "f"}}{{end}}{{template "a"}}`,
+			} {
+				_, err := ParseTemplate("calls", text)
+				So(err, ShouldNotBeNil)
+			}
+
+			_, err := ParseTemplate("calls", `{{define "a"}}{{template "b"}}{{template "b"}}{{end}}{{define "b"}}{{end}}{{template "a"}}`)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("ranges over numbers are refused", func() {
+			for _, text := range []string{
+				`{{range 1000000000}}{{end}}`,
+				`{{$n := 1000000000}}{{range $i := $n}}{{end}}`,
+				`{{define "x"}}{{range 9}}{{end}}{{end}}`,
+			} {
+				_, err := ParseTemplate("loop", text)
+				So(err, ShouldNotBeNil)
+			}
+
+			_, err := ParseTemplate("spaces", `{{$n := .Spaces}}{{range $n}}{{end}}`)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -2,11 +2,17 @@ package mercury
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/gql"
 	"sour.is/x/toolbox/httpsrv"
 	"sour.is/x/toolbox/ident"
 	"sour.is/x/toolbox/log"
@@ -20,6 +26,18 @@ func init() {
 
 		{Name: "get-mercury-config", Method: "GET", Pattern: "/v1/mercury-config", HandlerFunc: getConfig},
 		{Name: "post-mercury-config", Method: "POST", Pattern: "/v1/mercury-config", HandlerFunc: postConfig},
+		{Name: "patch-mercury-config", Method: "PATCH", Pattern: "/v1/mercury-config", HandlerFunc: patchConfig},
+
+		{Name: "get-mercury-ancestors", Method: "GET", Pattern: "/v1/mercury-ancestors", HandlerFunc: getAncestors},
+		{Name: "get-mercury-search", Method: "GET", Pattern: "/v1/mercury-search", HandlerFunc: getSearch},
+		{Name: "get-mercury-render", Method: "GET", Pattern: "/v1/mercury-render", HandlerFunc: getRender},
+
+		{Name: "get-mercury-export", Method: "GET", Pattern: "/v1/mercury-export", HandlerFunc: getExport},
+		{Name: "post-mercury-import", Method: "POST", Pattern: "/v1/mercury-import", HandlerFunc: postImport},
+
+		{Name: "get-mercury-promote", Method: "GET", Pattern: "/v1/mercury-promote", HandlerFunc: getPromote},
+		{Name: "post-mercury-promote", Method: "POST", Pattern: "/v1/mercury-promote", HandlerFunc: postPromote},
+		{Name: "post-mercury-promote-approve", Method: "POST", Pattern: "/v1/mercury-promote-approve", HandlerFunc: postPromoteApprove},
 	})
 }
 
@@ -35,6 +53,18 @@ func init() {
 //     required: false
 //     type: string
 //     format: string
+//   - name: search
+//     in: query
+//     description: RSQL filter on values. eg. name~db_*;tag==secret
+//     required: false
+//     type: string
+//     format: string
+//   - name: fields
+//     in: query
+//     description: Comma separated list of value names to return
+//     required: false
+//     type: string
+//     format: string
 // consumes:
 //   - "application/json"
 // produces:
@@ -66,7 +96,13 @@ func getConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 		return
 	}
 
-	rules := Registry.GetRules(id)
+	ctx := r.Context()
+
+	rules, err := Registry.GetRulesContext(ctx, id)
+	if !checkPartial(w, err) {
+		return
+	}
+
 	space := r.URL.Query().Get("space")
 	if space == "" {
 		space = "*"
@@ -75,13 +111,21 @@ func getConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 	ns := ParseNamespace(space)
 	ns = rules.ReduceSearch(ns)
 
-	var err error
-	lis := Registry.GetObjects(ns.String(), "", "")
-	lis, err = lis.accessFilter(id)
+	search := r.URL.Query().Get("search")
+	fields := r.URL.Query().Get("fields")
+
+	// The search is applied after masking so secret values can not be probed.
+	lis, err := Registry.GetObjectsContext(ctx, ns.String(), "", fields)
+	if !checkPartial(w, err) {
+		return
+	}
+
+	lis, err = rules.filterSpace(lis)
 	if err != nil {
 		w.WriteError(500, "ERR: "+err.Error())
 		return
 	}
+	lis = rules.Redact(lis).Filter(rsql.DefaultParse(search), parseFields(fields))
 
 	sort.Sort(lis)
 	var content string
@@ -151,7 +195,7 @@ func postConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 		w.WriteError(401, "NO_AUTH")
 		return
 	}
-	config, err := parseText(r.Body)
+	config, err := ParseText(r.Body)
 	r.Body.Close()
 	if err != nil {
 		w.WriteError(400, "PARSE_ERR")
@@ -161,46 +205,94 @@ func postConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 	c, _ := json.MarshalIndent(config, "", "  ")
 	log.Debug(string(c))
 
-	func() {
-		rules := Registry.GetRules(id)
+	if err = checkReserved(r.Context(), config.ToArray()); err != nil {
+		w.WriteError(403, "ERR: "+err.Error())
+		return
+	}
 
-		notify, err := Registry.GetNotify("updated")
-		if err != nil {
-			log.Error(err)
-		}
-		_ = rules
-		var notifyActive = make(map[string]struct{})
-		var filteredConfigs Config
-		for ns, c := range config {
-			if !rules.GetRoles("NS", ns).HasRole("write") {
-				log.Debug("SKIP", ns)
-				continue
-			}
+	// Handlers may record the writer from the context.
+	ctx := ident.WithContext(r.Context(), id)
 
-			log.Debug("SAVE", ns)
-			for _, n := range notify.Find(ns) {
-				notifyActive[n.Name] = struct{}{}
-			}
-			filteredConfigs = append(filteredConfigs, c)
-		}
+	rules, err := Registry.GetRulesContext(ctx, id)
+	if err != nil {
+		log.Error(err)
+	}
 
-		err = Registry.WriteObjects(filteredConfigs)
-		if err != nil {
-			log.Error(err)
-			return
-		}
+	_, err = writeSpaces(ctx, rules, config.ToArray())
+	if err != nil {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
 
-		log.Debug("SEND NOTIFYS ", notifyActive)
-		for _, n := range notify {
-			if _, ok := notifyActive[n.Name]; ok {
-				err = n.sendNotify()
-				if err != nil {
-					log.Debug(err)
-				}
-			}
+	w.WriteText(202, "OK")
+}
+
+// swagger:operation PATCH /v1/mercury-config mercury patch-mercury-config
+//
+// Patch Mercury Keys
+//
+// ---
+// parameters:
+//   - name: payload
+//     in: body
+//     description: Patch ops one per line as "op space target [value]" or a JSON list of ops
+//     required: true
+//     type: string
+//     format: string
+// consumes:
+//   - "text/plain"
+//   - "application/json"
+// produces:
+//   - "text/plain"
+// responses:
+//   "202":
+//     description: Success
+//     schema:
+//       type: string
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func patchConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	var patch Patch
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = json.NewDecoder(r.Body).Decode(&patch)
+		if err == nil {
+			err = patch.Validate()
 		}
-		log.Debug("DONE!")
-	}()
+	} else {
+		patch, err = ParsePatch(r.Body)
+	}
+	r.Body.Close()
+	if err != nil {
+		w.WriteError(400, "PARSE_ERR: "+err.Error())
+		return
+	}
+
+	if err = checkReserved(r.Context(), patch.Spaces()); err != nil {
+		w.WriteError(403, "ERR: "+err.Error())
+		return
+	}
+
+	// Handlers may record the writer from the context.
+	ctx := ident.WithContext(r.Context(), id)
+
+	rules, err := Registry.GetRulesContext(ctx, id)
+	if err != nil {
+		log.Error(err)
+	}
+
+	_, err = patchSpaces(ctx, rules, patch)
+	if err != nil {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
 
 	w.WriteText(202, "OK")
 }
@@ -217,6 +309,35 @@ func postConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 //     required: false
 //     type: string
 //     format: string
+//   - name: limit
+//     in: query
+//     description: Limit the number of spaces returned
+//     required: false
+//     type: integer
+//     format: uint64
+//   - name: offset
+//     in: query
+//     description: Where to start limit
+//     required: false
+//     type: integer
+//     format: uint64
+//   - name: after
+//     in: query
+//     description: Cursor to start after the named space
+//     required: false
+//     type: string
+//     format: string
+//   - name: sort
+//     in: query
+//     description: Sort by `space asc` or `space desc`
+//     required: false
+//     type: string
+//     format: string
+//   - name: window
+//     in: query
+//     description: Return json as a ResultWindow with the total number of spaces
+//     required: false
+//     type: boolean
 // consumes:
 //   - "application/json"
 // produces:
@@ -224,17 +345,11 @@ func postConfig(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 //   - "application/json"
 // responses:
 //   "200":
-//     description: Success
+//     description: Success. A ResultWindow of the spaces if window is set.
 //     schema:
-//       type: object
-//       allOf:
-//       - "$ref": "#/definitions/Space"
-//       - type: object
-//         properties:
-//           items:
-//             type: array
-//             items:
-//               "$ref": "#/definitions/Audience"
+//       type: array
+//       items:
+//         "$ref": "#/definitions/Space"
 //   "5xx":
 //     description: unexpected error
 //     schema:
@@ -246,7 +361,12 @@ func getSpace(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 		return
 	}
 
-	rules := Registry.GetRules(id)
+	ctx := r.Context()
+
+	rules, err := Registry.GetRulesContext(ctx, id)
+	if !checkPartial(w, err) {
+		return
+	}
 	log.Debug(rules)
 
 	space := r.URL.Query().Get("space")
@@ -258,8 +378,25 @@ func getSpace(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 	ns = rules.ReduceSearch(ns)
 	log.Debug(ns.String())
 
-	lis := Registry.GetIndex(ns.String(), "")
-	sort.Sort(lis)
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteError(400, "ERR: "+err.Error())
+		return
+	}
+
+	// The window needs every space to count them so the handlers are not paged.
+	window, _ := strconv.ParseBool(r.URL.Query().Get("window"))
+
+	var lis Config
+	var total uint64
+	if window {
+		lis, total, err = Registry.GetIndexWindowContext(ctx, ns.String(), "", page)
+	} else {
+		lis, err = Registry.GetIndexPageContext(ctx, ns.String(), "", page)
+	}
+	if !checkPartial(w, err) {
+		return
+	}
 
 	switch httputil.NegotiateContentType(r, []string{
 		"text/plain",
@@ -268,6 +405,620 @@ func getSpace(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
 	case "text/plain":
 		w.WriteText(200, lis.StringList())
 	case "application/json":
+		if window {
+			w.WriteWindow(200, total, page.Limit, page.Offset, lis)
+			return
+		}
 		w.WriteObject(200, lis)
 	}
 }
+
+func parsePage(r *http.Request) (Page, error) {
+	q := r.URL.Query()
+	var input gql.QueryInput
+
+	for _, name := range []string{"limit", "offset"} {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return Page{}, fmt.Errorf("invalid %s: %s", name, s)
+		}
+
+		switch name {
+		case "limit":
+			input.Limit = &i
+		case "offset":
+			input.Offset = &i
+		}
+	}
+
+	if after := q.Get("after"); after != "" {
+		input.After = &after
+	}
+	input.Sort = q["sort"]
+
+	return NewPage(&input), nil
+}
+
+// checkPartial adds a warning header when some handlers failed and writes an
+// error response for any other failure. It returns false if the request is done.
+func checkPartial(w httpsrv.ResponseWriter, err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return true
+	case HandlerErrors:
+		w.Header().Add("Warning", "199 - "+strconv.Quote("partial results: "+err.Error()))
+		return true
+	default:
+		w.WriteError(500, "ERR: "+err.Error())
+		return false
+	}
+}
+
+// swagger:operation GET /v1/mercury-ancestors mercury get-mercury-ancestors
+//
+// Get Mercury Space Ancestors
+//
+// Returns the space and each of its ancestors that exist, from the least to
+// the most specific, and the merged view where the most specific values win.
+//
+// ---
+// parameters:
+//   - name: space
+//     in: query
+//     description: Space. eg. svc.api.prod.host1
+//     required: true
+//     type: string
+//     format: string
+// produces:
+//   - "application/json"
+//   - "text/plain"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: object
+//       properties:
+//         chain:
+//           type: array
+//           items:
+//             "$ref": "#/definitions/Space"
+//         merged:
+//           "$ref": "#/definitions/Space"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getAncestors(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	space := r.URL.Query().Get("space")
+	if space == "" || strings.ContainsAny(space, "*,;:") {
+		w.WriteError(400, "ERR: a single space is required")
+		return
+	}
+
+	a, err := Resolve(r.Context(), id, space)
+	if !checkPartial(w, err) {
+		return
+	}
+
+	if httputil.NegotiateContentType(r, []string{"application/json", "text/plain"}, "application/json") == "text/plain" {
+		w.WriteText(200, Config{a.Merged}.String())
+		return
+	}
+
+	w.WriteObject(200, a)
+}
+
+// swagger:operation GET /v1/mercury-render mercury get-mercury-render
+//
+// Render Mercury Template
+//
+// Executes the Go text/template in the template value of a template space
+// against the spaces the caller can read.
+//
+// ---
+// parameters:
+//   - name: template
+//     in: query
+//     description: Template space. The leading @ may be left out. eg. tpl.nginx
+//     required: true
+//     type: string
+//     format: string
+//   - name: space
+//     in: query
+//     description: Spaces to render. eg. svc.web.*
+//     required: false
+//     type: string
+//     format: string
+// produces:
+//   - "text/plain"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: string
+//   "404":
+//     description: template not found
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getRender(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	name := r.URL.Query().Get("template")
+	if name == "" || strings.ContainsAny(name, "*,;:") {
+		w.WriteError(400, "ERR: a single template is required")
+		return
+	}
+
+	space := r.URL.Query().Get("space")
+	if space == "" {
+		space = "*"
+	}
+
+	text, err := LoadTemplate(r.Context(), id, name)
+	if err != nil {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
+	if text == "" {
+		w.WriteError(404, "ERR: template not found")
+		return
+	}
+
+	tmpl, err := ParseTemplate(name, text)
+	if err != nil {
+		w.WriteError(400, "ERR: "+err.Error())
+		return
+	}
+
+	out, err := Render(r.Context(), id, tmpl, space)
+	if _, ok := err.(HandlerErrors); err != nil && !ok {
+		w.WriteError(400, "ERR: "+err.Error())
+		return
+	}
+	if !checkPartial(w, err) {
+		return
+	}
+
+	w.WriteText(200, string(out))
+}
+
+// swagger:operation GET /v1/mercury-search mercury get-mercury-search
+//
+// Search Mercury Values
+//
+// ---
+// parameters:
+//   - name: space
+//     in: query
+//     description: Spaces to search. eg. svc.*
+//     required: false
+//     type: string
+//     format: string
+//   - name: name
+//     in: query
+//     description: Key name. May use * wildcards
+//     required: false
+//     type: string
+//     format: string
+//   - name: value
+//     in: query
+//     description: Substring of a value
+//     required: false
+//     type: string
+//     format: string
+//   - name: regex
+//     in: query
+//     description: Regular expression matched against each value
+//     required: false
+//     type: string
+//     format: string
+//   - name: tag
+//     in: query
+//     description: Tag on the value or its space
+//     required: false
+//     type: string
+//     format: string
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: array
+//       items:
+//         "$ref": "#/definitions/Space"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getSearch(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	args := r.URL.Query()
+	q := Query{
+		Name:  args.Get("name"),
+		Value: args.Get("value"),
+		Regex: args.Get("regex"),
+		Tag:   args.Get("tag"),
+	}
+	if err := q.Validate(); err != nil {
+		w.WriteError(400, "ERR: "+err.Error())
+		return
+	}
+
+	lis, err := Find(r.Context(), id, args.Get("space"), q)
+	if !checkPartial(w, err) {
+		return
+	}
+	if lis == nil {
+		lis = Config{}
+	}
+
+	w.WriteObject(200, lis)
+}
+
+// swagger:operation GET /v1/mercury-export mercury get-mercury-export
+//
+// Export Mercury Namespace
+//
+// ---
+// parameters:
+//   - name: space
+//     in: query
+//     description: Namespace to export. eg. svc.staging.*
+//     required: true
+//     type: string
+//     format: string
+//   - name: format
+//     in: query
+//     description: Archive format json or tar
+//     required: false
+//     type: string
+//     format: string
+// produces:
+//   - "application/json"
+//   - "application/gzip"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: file
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getExport(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	space := r.URL.Query().Get("space")
+	if space == "" {
+		w.WriteError(400, "ERR: space required")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatTar {
+		w.WriteError(400, "ERR: unknown format "+format)
+		return
+	}
+
+	dump, err := Export(r.Context(), id, space)
+	if err != nil {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
+
+	name := strings.TrimSuffix(strings.Replace(space, "*", "", -1), ".")
+	if name == "" {
+		name = "mercury"
+	}
+	if format == FormatTar {
+		w.Header().Set("Content-Type", "application/gzip")
+		name += ".tar.gz"
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		name += ".json"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	if err = WriteDump(w, dump, format); err != nil {
+		log.Error(err)
+	}
+}
+
+// swagger:operation POST /v1/mercury-import mercury post-mercury-import
+//
+// Import Mercury Namespace
+//
+// ---
+// parameters:
+//   - name: rewrite
+//     in: query
+//     description: Rewrite a space prefix. eg. svc.staging.*:svc.prod.*
+//     required: false
+//     type: string
+//     format: string
+//   - name: mode
+//     in: query
+//     description: merge or replace existing spaces
+//     required: false
+//     type: string
+//     format: string
+//   - name: payload
+//     in: body
+//     description: Export in json or tar format
+//     required: true
+//     type: file
+// consumes:
+//   - "application/json"
+//   - "application/gzip"
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Success
+//     schema:
+//       type: object
+//   "413":
+//     description: The dump is larger than MaxDumpSize
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func postImport(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	from, to, err := ParseRewrite(r.URL.Query().Get("rewrite"))
+	if err != nil {
+		w.WriteError(400, "ERR: "+err.Error())
+		return
+	}
+
+	mode := ImportMode(r.URL.Query().Get("mode"))
+	if mode != "" && mode != ImportMerge && mode != ImportReplace {
+		w.WriteError(400, "ERR: unknown mode "+string(mode))
+		return
+	}
+
+	dump, err := ReadDump(http.MaxBytesReader(w, r.Body, MaxDumpSize))
+	r.Body.Close()
+	var maxErr *http.MaxBytesError
+	if errors.Is(err, ErrDumpTooLarge) || errors.As(err, &maxErr) {
+		w.WriteError(413, "TOO_LARGE")
+		return
+	}
+	if err != nil {
+		w.WriteError(400, "PARSE_ERR")
+		return
+	}
+
+	// Handlers may record the writer from the context.
+	ctx := ident.WithContext(r.Context(), id)
+
+	opts := ImportOptions{Mode: mode, From: from, To: to}
+	result, err := Import(ctx, id, dump, opts)
+	if err != nil {
+		w.WriteError(500, "ERR: "+err.Error())
+		return
+	}
+
+	w.WriteObject(200, result)
+}
+
+// swagger:operation GET /v1/mercury-promote mercury get-mercury-promote
+//
+// Get Mercury Promotion
+//
+// Returns the last promotion requested into a space.
+//
+// ---
+// parameters:
+//   - name: to
+//     in: query
+//     description: Target space. eg. svc.api.prod
+//     required: true
+//     type: string
+//     format: string
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Success
+//   "404":
+//     description: no promotion
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func getPromote(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	p, err := GetPromotion(r.Context(), id, r.URL.Query().Get("to"))
+	if !checkPromote(w, err) {
+		return
+	}
+
+	w.WriteObject(200, p)
+}
+
+// swagger:operation POST /v1/mercury-promote mercury post-mercury-promote
+//
+// Request Mercury Promotion
+//
+// Records the diff from one space to another. It is applied when a second
+// identity with the promote role approves it.
+//
+// ---
+// parameters:
+//   - name: from
+//     in: query
+//     description: Source space. eg. svc.api.staging
+//     required: true
+//     type: string
+//     format: string
+//   - name: to
+//     in: query
+//     description: Target space. eg. svc.api.prod
+//     required: true
+//     type: string
+//     format: string
+//   - name: exclude
+//     in: query
+//     description: Comma separated key names or #tags not promoted. eg. host*,#secret
+//     required: false
+//     type: string
+//     format: string
+//   - name: secrets
+//     in: query
+//     description: Promote values tagged secret. Needs the secret role on both spaces.
+//     required: false
+//     type: boolean
+// produces:
+//   - "application/json"
+// responses:
+//   "201":
+//     description: Requested
+//   "403":
+//     description: denied
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func postPromote(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" || to == "" || strings.ContainsAny(from+to, "*,;:") {
+		w.WriteError(400, "ERR: a single from and to space are required")
+		return
+	}
+
+	var exclude []string
+	if s := r.URL.Query().Get("exclude"); s != "" {
+		exclude = strings.Split(s, ",")
+	}
+
+	secrets := r.URL.Query().Get("secrets") == "true"
+
+	p, err := RequestPromotion(r.Context(), id, from, to, exclude, secrets)
+	if !checkPromote(w, err) {
+		return
+	}
+
+	w.WriteObject(201, p)
+}
+
+// swagger:operation POST /v1/mercury-promote-approve mercury post-mercury-promote-approve
+//
+// Approve Mercury Promotion
+//
+// Applies the pending promotion into a space. The approver must hold the
+// promote role and not be the requester.
+//
+// ---
+// parameters:
+//   - name: to
+//     in: query
+//     description: Target space. eg. svc.api.prod
+//     required: true
+//     type: string
+//     format: string
+//   - name: hash
+//     in: query
+//     description: Hash of the reviewed promotion as returned when it was requested.
+//     required: true
+//     type: string
+//     format: string
+// produces:
+//   - "application/json"
+// responses:
+//   "200":
+//     description: Applied
+//   "403":
+//     description: denied
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "409":
+//     description: the promotion or the spaces changed since it was reviewed
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+//   "5xx":
+//     description: unexpected error
+//     schema:
+//       "$ref": "#/definitions/ResultError"
+func postPromoteApprove(w httpsrv.ResponseWriter, r *http.Request, id ident.Ident) {
+	if !id.IsActive() {
+		w.WriteError(401, "NO_AUTH")
+		return
+	}
+
+	p, err := ApprovePromotion(r.Context(), id, r.URL.Query().Get("to"), r.URL.Query().Get("hash"))
+	if !checkPromote(w, err) {
+		return
+	}
+
+	w.WriteObject(200, p)
+}
+
+// checkPromote writes the status for promotion errors. Returns false if
+// there was an error.
+func checkPromote(w httpsrv.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	msg := "ERR: " + err.Error()
+	switch {
+	case strings.HasPrefix(err.Error(), ErrPromoteDenied.Error()),
+		strings.HasPrefix(err.Error(), ErrPromoteReserved.Error()):
+		w.WriteError(403, msg)
+	case strings.HasPrefix(err.Error(), ErrPromoteNotFound.Error()):
+		w.WriteError(404, msg)
+	case err == ErrPromoteStale, err == ErrPromoteEmpty:
+		w.WriteError(409, msg)
+	default:
+		w.WriteError(500, msg)
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package mercury
 
 import (
 	"path/filepath"
+	"strings"
 )
 
 // Rule is a type of rule
@@ -92,3 +93,21 @@ func (r Roles) HasRole(roles ...string) bool {
 	}
 	return false
 }
+
+// MatchOverlaps returns true if two glob patterns could match the same space.
+func MatchOverlaps(a, b string) bool {
+	if ok, _ := filepath.Match(a, b); ok {
+		return true
+	}
+	if ok, _ := filepath.Match(b, a); ok {
+		return true
+	}
+
+	ai, bi := strings.IndexRune(a, '*'), strings.IndexRune(b, '*')
+	if ai < 0 || bi < 0 {
+		return false
+	}
+
+	pa, pb := a[:ai], b[:bi]
+	return strings.HasPrefix(pa, pb) || strings.HasPrefix(pb, pa)
+}
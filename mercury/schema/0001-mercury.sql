@@ -88,4 +88,4 @@ join (
 	,      unnest(values) rules
 	from mercury_registry_vw
 	where space = 'config.policy'
-) tt on (g.group_id = tt.group_id);
\ No newline at end of file
+) tt on (g.group_id = tt.group_id);
@@ -0,0 +1,5 @@
+-- pg_trgm is left installed as other tables may use it.
+drop index if exists mercury_spaces_tags_index;
+drop index if exists mercury_values_tags_index;
+drop index if exists mercury_values_text_trgm_index;
+drop function if exists mercury_values_text(character varying[]);
@@ -0,0 +1,15 @@
+-- Indexes for mercury.Searcher in mercury/pg.
+create extension if not exists pg_trgm;
+
+create or replace function mercury_values_text(character varying[]) returns text
+	language sql immutable
+	as $$ select array_to_string($1, E'\n') $$;
+
+create index mercury_values_text_trgm_index
+	on mercury_values using gin (mercury_values_text(values) gin_trgm_ops);
+
+create index mercury_values_tags_index
+	on mercury_values using gin (tags);
+
+create index mercury_spaces_tags_index
+	on mercury_spaces using gin (tags);
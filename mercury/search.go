@@ -67,7 +67,9 @@ func (NamespaceNode) Type() string { return TypeNamespaceNode }
 // Value to return the value
 func (n NamespaceNode) Value() string { return string(n) }
 
-// NamespaceTrace implements a trace search value
+// NamespaceTrace implements a trace search value. It is written with the
+// "trace:" prefix and matches the space and each of its ancestors, so
+// trace:svc.api.prod matches svc, svc.api and svc.api.prod.
 type NamespaceTrace string
 
 // Type returns the type of the value
@@ -85,7 +87,11 @@ func (NamespaceStar) Type() string { return TypeNamespaceStar }
 // Value to return the value
 func (n NamespaceStar) Value() string { return strings.Replace(string(n), "*", "%", -1) }
 
-// ParseNamespace returns a list of parsed values
+// ParseNamespace returns a list of parsed values. Parts are separated by ;
+// and each holds a comma separated list of spaces. Spaces with a * are
+// patterns. Parts that start with trace: match the ancestors of each space.
+//
+//	app.settings,svc.*;trace:svc.api.prod.host1
 func ParseNamespace(ns string) (lis NamespaceSearch) {
 	for _, part := range strings.Split(ns, ";") {
 		if strings.HasPrefix(part, "trace:") {
@@ -130,11 +136,7 @@ func (n NamespaceStar) Raw() string { return string(n) }
 // Match returns true if any match.
 func (n NamespaceSearch) Match(s string) bool {
 	for _, m := range n {
-		ok, err := filepath.Match(m.Raw(), s)
-		if err != nil {
-			return false
-		}
-		if ok {
+		if m.Match(s) {
 			return true
 		}
 	}
@@ -153,8 +155,26 @@ func match(n NamespaceSpec, s string) bool {
 // Match returns true if any match.
 func (n NamespaceNode) Match(s string) bool { return match(n, s) }
 
-// Match returns true if any match.
-func (n NamespaceTrace) Match(s string) bool { return match(n, s) }
+// Match returns true if s is the space or one of its ancestors.
+func (n NamespaceTrace) Match(s string) bool {
+	return s == string(n) || strings.HasPrefix(string(n), s+".")
+}
+
+// Ancestors returns the space and each of its ancestors from the least to
+// the most specific. The ancestors of svc.api.prod are svc, svc.api and
+// svc.api.prod.
+func Ancestors(space string) []string {
+	if space == "" {
+		return nil
+	}
+
+	parts := strings.Split(space, ".")
+	lis := make([]string, len(parts))
+	for i := range parts {
+		lis[i] = strings.Join(parts[:i+1], ".")
+	}
+	return lis
+}
 
 // Match returns true if any match.
 func (n NamespaceStar) Match(s string) bool { return match(n, s) }
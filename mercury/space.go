@@ -5,7 +5,6 @@ import (
 	"strings"
 
 	"sour.is/x/toolbox/gql"
-	"sour.is/x/toolbox/ident"
 )
 
 // Space stores a registry of spaces
@@ -328,25 +327,6 @@ func (lis Config) IniString() string {
 	return buf.String()
 }
 
-func (lis Config) accessFilter(id ident.Ident) (out Config, err error) {
-	rules := Registry.GetRules(id)
-
-	accessList := make(map[string]struct{})
-	for _, o := range lis {
-		if _, ok := accessList[o.Space]; ok {
-			out = append(out, o)
-			continue
-		}
-
-		if role := rules.GetRoles("NS", o.Space); role.HasRole("read", "write") && !role.HasRole("deny") {
-			accessList[o.Space] = struct{}{}
-			out = append(out, o)
-		}
-	}
-
-	return
-}
-
 func (rules Rules) filterSpace(lis Config) (out Config, err error) {
 	accessList := make(map[string]struct{})
 	for _, o := range lis {
@@ -80,7 +80,7 @@ func TestConfig_String(t *testing.T) {
 			So(result, ShouldResemble, tt.want)
 
 			in := strings.NewReader(result)
-			reverse, err := parseText(in)
+			reverse, err := ParseText(in)
 			So(err, ShouldBeNil)
 			So(reverse.ToArray(), ShouldResemble, tt.value)
 		}
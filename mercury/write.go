@@ -0,0 +1,377 @@
+package mercury
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"sour.is/x/toolbox/log"
+)
+
+// WritePolicy selects which of the matching handlers a space is written to.
+type WritePolicy int
+
+const (
+	// WriteFirst writes to the highest priority matching handler.
+	WriteFirst WritePolicy = iota
+	// WriteMirror writes to every matching handler. If any handler fails the
+	// write is undone on the others.
+	WriteMirror
+	// WriteReplica writes to the highest priority matching handler and
+	// copies the write to the other matching handlers in the background.
+	WriteReplica
+)
+
+func (p WritePolicy) String() string {
+	switch p {
+	case WriteMirror:
+		return "mirror"
+	case WriteReplica:
+		return "replica"
+	default:
+		return "first"
+	}
+}
+
+// ParseWritePolicy returns the policy for a name as used in config files.
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "first":
+		return WriteFirst, nil
+	case "mirror":
+		return WriteMirror, nil
+	case "replica":
+		return WriteReplica, nil
+	default:
+		return WriteFirst, fmt.Errorf("unknown write policy: %s", s)
+	}
+}
+
+// WriteRoute sets the write policy for spaces matching a pattern.
+type WriteRoute struct {
+	Match  string
+	Policy WritePolicy
+}
+
+// WriteRoutes are checked in order and the first that matches a space is
+// used. Spaces that match no route use WriteFirst.
+var WriteRoutes []WriteRoute
+
+var writeRoutesMu sync.RWMutex
+
+// SetWritePolicy sets the write policy for spaces matching pattern.
+func SetWritePolicy(match string, policy WritePolicy) {
+	writeRoutesMu.Lock()
+	defer writeRoutesMu.Unlock()
+
+	for i, r := range WriteRoutes {
+		if r.Match == match {
+			WriteRoutes[i].Policy = policy
+			return
+		}
+	}
+
+	log.Infos("mercury write policy", "match", match, "policy", policy)
+	WriteRoutes = append(WriteRoutes, WriteRoute{Match: match, Policy: policy})
+}
+
+func writePolicy(space string) WritePolicy {
+	writeRoutesMu.RLock()
+	defer writeRoutesMu.RUnlock()
+
+	for _, r := range WriteRoutes {
+		if ok, err := filepath.Match(r.Match, space); ok && err == nil {
+			return r.Policy
+		}
+	}
+
+	return WriteFirst
+}
+
+// WritePreparer is implemented by handlers that can write in two phases.
+// The prepared write is not visible until it is committed.
+type WritePreparer interface {
+	PrepareWrite(context.Context, Config) (WriteTx, error)
+}
+
+// WriteTx is a prepared write. Exactly one of Commit or Rollback must be called.
+type WriteTx interface {
+	Commit() error
+	Rollback() error
+}
+
+// WriteObserver is implemented by handlers that act on writes made through
+// the registry, such as reloading definitions kept in spaces. Written is
+// called with the spaces after a write or patch succeeds.
+type WriteObserver interface {
+	Written(context.Context, Config)
+}
+
+// observe tells each handler that implements WriteObserver of a write.
+func (hl HandlerList) observe(ctx context.Context, spaces Config) {
+	for _, hldr := range hl {
+		if o, ok := hldr.HandlerV2.(WriteObserver); ok {
+			o.Written(ctx, spaces)
+		}
+	}
+}
+
+// routeWrites splits the spaces into the writes that must succeed for each
+// handler and the writes to copy to replicas afterwards.
+func (hl HandlerList) routeWrites(spaces Config) (writes, replicas []Config) {
+	writes = make([]Config, len(hl))
+	replicas = make([]Config, len(hl))
+
+	for _, s := range spaces {
+		policy := writePolicy(s.Space)
+		primary := true
+
+		for i, hldr := range hl {
+			ok, err := filepath.Match(hldr.Match, s.Space)
+			if !ok || err != nil {
+				continue
+			}
+			log.Debug("MATCH ", i, " ", s.Space, " ", policy)
+
+			switch {
+			case primary, policy == WriteMirror:
+				writes[i] = append(writes[i], s)
+			case policy == WriteReplica:
+				replicas[i] = append(replicas[i], s)
+			}
+
+			if policy == WriteFirst {
+				break
+			}
+			primary = false
+		}
+	}
+
+	return
+}
+
+// writeAll writes to each handler so that either all writes are applied or
+// none are. Handlers that implement WritePreparer are prepared before any
+// other handler is written and committed after. Handlers are read before
+// writing so a failure can be compensated by writing back what was there.
+//
+// If patch is set the writes only name the spaces to patch. Handlers that
+// implement Patcher are prepared with the patch and the others are written
+// the patched copy of what was read.
+func (hl HandlerList) writeAll(ctx context.Context, writes []Config, patch Patch) error {
+	var (
+		prepared []int
+		txs      = make([]WriteTx, len(hl))
+		before   = make([]Config, len(hl))
+		applied  []int
+	)
+
+	undo := func(err error) error {
+		for _, i := range prepared {
+			if rerr := txs[i].Rollback(); rerr != nil {
+				log.Errors("mercury rollback failed", "match", hl[i].Match, "err", rerr)
+			}
+		}
+		for j := len(applied) - 1; j >= 0; j-- {
+			i := applied[j]
+			if rerr := hl[i].restore(writes[i], before[i]); rerr != nil {
+				log.Errors("mercury restore failed", "match", hl[i].Match, "err", rerr)
+			}
+		}
+		return err
+	}
+
+	for i, hldr := range hl {
+		if len(writes[i]) == 0 {
+			continue
+		}
+
+		v, err := hldr.call(ctx, func(ctx context.Context) (interface{}, error) {
+			return hldr.GetObjects(ctx, writeSearch(writes[i]), nil, nil)
+		})
+		if err != nil {
+			return undo(HandlerError{Match: hldr.Match, Err: err})
+		}
+		before[i], _ = v.(Config)
+
+		// Not run with call so a slow prepare is never abandoned with the
+		// transaction left open. The context bounds it until commit.
+		pctx, cancel := context.WithTimeout(ctx, hldr.timeout())
+		defer cancel()
+
+		var tx WriteTx
+		pp, isPatcher := hldr.HandlerV2.(Patcher)
+		if patch != nil && isPatcher {
+			log.Debug("PATCH PREPARE ", hldr.Match)
+			if tx, err = pp.PreparePatch(pctx, patch.For(writes[i])); errors.Is(err, ErrNotSupported) {
+				isPatcher, err = false, nil
+			}
+		}
+		if patch != nil && !isPatcher && err == nil {
+			writes[i], err = applyPatch(patch, before[i], writes[i])
+		}
+
+		if p, ok := hldr.HandlerV2.(WritePreparer); ok && tx == nil && err == nil {
+			log.Debug("WRITE PREPARE ", hldr.Match)
+			if tx, err = p.PrepareWrite(pctx, writes[i]); errors.Is(err, ErrNotSupported) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return undo(HandlerError{Match: hldr.Match, Err: err})
+		}
+		if tx == nil {
+			continue
+		}
+		txs[i] = tx
+		prepared = append(prepared, i)
+	}
+
+	for i, hldr := range hl {
+		if len(writes[i]) == 0 || txs[i] != nil {
+			continue
+		}
+
+		log.Debug("WRITE MATCH ", hldr.Match)
+		_, err := hldr.call(ctx, func(ctx context.Context) (interface{}, error) {
+			return nil, hldr.WriteObjects(ctx, writes[i])
+		})
+		// A failed handler may have applied part of the write so it is restored too.
+		applied = append(applied, i)
+		if err != nil {
+			return undo(HandlerError{Match: hldr.Match, Err: err})
+		}
+	}
+
+	for len(prepared) > 0 {
+		i := prepared[0]
+		prepared = prepared[1:]
+
+		log.Debug("WRITE COMMIT ", hl[i].Match)
+		if err := txs[i].Commit(); err != nil {
+			return undo(HandlerError{Match: hl[i].Match, Err: err})
+		}
+		applied = append(applied, i)
+	}
+
+	return nil
+}
+
+// writeReplicas copies writes to replica handlers in the background.
+// If patch is set each replica is patched from what it holds.
+// Failures are logged.
+func (hl HandlerList) writeReplicas(replicas []Config, patch Patch) {
+	for i, hldr := range hl {
+		if len(replicas[i]) == 0 {
+			continue
+		}
+
+		go func(hldr HandlerItem, lis Config) {
+			log.Debug("WRITE REPLICA ", hldr.Match)
+			_, err := hldr.call(context.Background(), func(ctx context.Context) (interface{}, error) {
+				if patch == nil {
+					return nil, hldr.WriteObjects(ctx, lis)
+				}
+
+				cur, err := hldr.GetObjects(ctx, writeSearch(lis), nil, nil)
+				if err != nil {
+					return nil, err
+				}
+				if lis, err = applyPatch(patch, cur, lis); err != nil {
+					return nil, err
+				}
+				return nil, hldr.WriteObjects(ctx, lis)
+			})
+			if err != nil {
+				log.Errors("mercury replica write failed", "match", hldr.Match, "err", err)
+			}
+		}(hldr, replicas[i])
+	}
+}
+
+// restore writes back the spaces read before a write. Spaces that did not
+// exist are written empty which removes them.
+func (h HandlerItem) restore(written, before Config) error {
+	old := make(SpaceMap, len(before))
+	for _, s := range before {
+		old[s.Space] = s
+	}
+
+	lis := make(Config, 0, len(written))
+	for _, s := range written {
+		if o, ok := old[s.Space]; ok {
+			lis = append(lis, o)
+			continue
+		}
+		lis = append(lis, NewSpace(s.Space))
+	}
+
+	log.Debug("WRITE RESTORE ", h.Match)
+	// The request context may be the reason the write failed.
+	_, err := h.call(context.Background(), func(ctx context.Context) (interface{}, error) {
+		return nil, h.WriteObjects(ctx, lis)
+	})
+	return err
+}
+
+func writeSearch(lis Config) NamespaceSearch {
+	search := make(NamespaceSearch, 0, len(lis))
+	for _, s := range lis {
+		search = append(search, NamespaceNode(s.Space))
+	}
+	return search
+}
+
+// writeSpaces writes the spaces the rules allow and sends the updated
+// notifies for them. Spaces without write access are skipped and the
+// spaces written are returned.
+func writeSpaces(ctx context.Context, rules Rules, lis Config) (Config, error) {
+	var filteredConfigs Config
+	for _, c := range lis {
+		if !rules.GetRoles("NS", c.Space).HasRole("write") {
+			log.Debug("SKIP ", c.Space)
+			continue
+		}
+
+		log.Debug("SAVE ", c.Space)
+		filteredConfigs = append(filteredConfigs, c)
+	}
+
+	err := Registry.WriteObjectsContext(ctx, filteredConfigs)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	sendNotify(ctx, "updated", filteredConfigs)
+
+	return filteredConfigs, nil
+}
+
+// sendNotify sends each notify for the event that matches any of the spaces once.
+func sendNotify(ctx context.Context, event string, lis Config) {
+	notify, err := Registry.GetNotifyContext(ctx, event)
+	if err != nil {
+		log.Error(err)
+	}
+
+	var notifyActive = make(map[string]struct{})
+	for _, c := range lis {
+		for _, n := range notify.Find(c.Space) {
+			notifyActive[n.Name] = struct{}{}
+		}
+	}
+
+	log.Debug("SEND NOTIFYS ", notifyActive)
+	for _, n := range notify {
+		if _, ok := notifyActive[n.Name]; ok {
+			if err := n.sendNotify(); err != nil {
+				log.Debug(err)
+			}
+		}
+	}
+	log.Debug("DONE!")
+}
@@ -0,0 +1,213 @@
+package mercury
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"sour.is/x/toolbox/dbm/rsql"
+	"sour.is/x/toolbox/ident"
+)
+
+type memHandler struct {
+	mu     sync.Mutex
+	spaces SpaceMap
+	fail   bool
+	wrote  chan struct{}
+}
+
+func newMemHandler(spaces ...string) *memHandler {
+	h := &memHandler{spaces: make(SpaceMap), wrote: make(chan struct{}, 10)}
+	for _, s := range spaces {
+		h.spaces[s] = NewSpace(s).SetNotes("old")
+	}
+	return h
+}
+
+func (h *memHandler) GetIndex(ctx context.Context, search NamespaceSearch, _ *rsql.Program) (Config, error) {
+	return h.GetObjects(ctx, search, nil, nil)
+}
+func (h *memHandler) GetObjects(_ context.Context, search NamespaceSearch, _ *rsql.Program, _ []string) (lis Config, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, s := range h.spaces {
+		for _, c := range search {
+			if c.Match(name) {
+				c := *s
+				lis = append(lis, &c)
+				break
+			}
+		}
+	}
+	sort.Sort(lis)
+	return
+}
+func (h *memHandler) WriteObjects(_ context.Context, lis Config) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer func() { h.wrote <- struct{}{} }()
+
+	if h.fail {
+		return fmt.Errorf("broken")
+	}
+	for _, s := range lis {
+		if len(s.Tags) == 0 && len(s.Notes) == 0 && len(s.List) == 0 {
+			delete(h.spaces, s.Space)
+			continue
+		}
+		h.spaces[s.Space] = s
+	}
+	return nil
+}
+func (h *memHandler) GetRules(context.Context, ident.Ident) (Rules, error)  { return nil, nil }
+func (h *memHandler) GetNotify(context.Context, string) (ListNotify, error) { return nil, nil }
+
+func (h *memHandler) notes(space string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.spaces[space]; ok && len(s.Notes) > 0 {
+		return s.Notes[0]
+	}
+	return ""
+}
+
+type prepHandler struct {
+	*memHandler
+	failCommit bool
+	rollbacks  int
+}
+
+type prepTx struct {
+	h   *prepHandler
+	lis Config
+}
+
+func (h *prepHandler) PrepareWrite(_ context.Context, lis Config) (WriteTx, error) {
+	return &prepTx{h, lis}, nil
+}
+func (tx *prepTx) Commit() error {
+	if tx.h.failCommit {
+		return fmt.Errorf("commit failed")
+	}
+	return tx.h.WriteObjects(context.Background(), tx.lis)
+}
+func (tx *prepTx) Rollback() error {
+	tx.h.rollbacks++
+	return nil
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	Convey("Given policy names", t, func() {
+		for _, p := range []WritePolicy{WriteFirst, WriteMirror, WriteReplica} {
+			got, err := ParseWritePolicy(p.String())
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, p)
+		}
+
+		_, err := ParseWritePolicy("other")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHandlerList_WritePolicy(t *testing.T) {
+	defer func(routes []WriteRoute) { WriteRoutes = routes }(WriteRoutes)
+
+	Convey("Given handlers that overlap", t, func() {
+		WriteRoutes = nil
+		SetWritePolicy("mirror.*", WriteMirror)
+		SetWritePolicy("replica.*", WriteReplica)
+
+		first, second := newMemHandler("mirror.one"), newMemHandler("mirror.one")
+		hl := HandlerList{
+			{HandlerV2: first, Match: "*", Priority: 2},
+			{HandlerV2: second, Match: "*", Priority: 1},
+		}
+
+		Convey("first match writes only the primary", func() {
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("other").SetNotes("new")})
+			So(err, ShouldBeNil)
+			So(first.notes("other"), ShouldEqual, "new")
+			So(second.notes("other"), ShouldEqual, "")
+		})
+
+		Convey("mirror writes all handlers", func() {
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("mirror.one").SetNotes("new")})
+			So(err, ShouldBeNil)
+			So(first.notes("mirror.one"), ShouldEqual, "new")
+			So(second.notes("mirror.one"), ShouldEqual, "new")
+		})
+
+		Convey("mirror restores handlers when one fails", func() {
+			second.fail = true
+
+			err := hl.WriteObjectsContext(context.Background(), Config{
+				NewSpace("mirror.one").SetNotes("new"),
+				NewSpace("mirror.two").SetNotes("new"),
+			})
+			So(err, ShouldResemble, HandlerError{Match: "*", Err: fmt.Errorf("broken")})
+			So(first.notes("mirror.one"), ShouldEqual, "old")
+			So(first.notes("mirror.two"), ShouldEqual, "")
+		})
+
+		Convey("replica is written in the background", func() {
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("replica.one").SetNotes("new")})
+			So(err, ShouldBeNil)
+			So(first.notes("replica.one"), ShouldEqual, "new")
+
+			select {
+			case <-second.wrote:
+			case <-time.After(time.Second):
+			}
+			So(second.notes("replica.one"), ShouldEqual, "new")
+		})
+
+		Convey("replica failure does not fail the write", func() {
+			second.fail = true
+
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("replica.one").SetNotes("new")})
+			So(err, ShouldBeNil)
+			So(first.notes("replica.one"), ShouldEqual, "new")
+		})
+	})
+
+	Convey("Given a handler that prepares writes", t, func() {
+		WriteRoutes = nil
+		SetWritePolicy("*", WriteMirror)
+
+		prep, plain := &prepHandler{memHandler: newMemHandler()}, newMemHandler("one")
+		hl := HandlerList{
+			{HandlerV2: prep, Match: "*", Priority: 2},
+			{HandlerV2: plain, Match: "*", Priority: 1},
+		}
+
+		Convey("it is committed after the others are written", func() {
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("one").SetNotes("new")})
+			So(err, ShouldBeNil)
+			So(prep.notes("one"), ShouldEqual, "new")
+			So(plain.notes("one"), ShouldEqual, "new")
+		})
+
+		Convey("it is rolled back when another fails", func() {
+			plain.fail = true
+
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("one").SetNotes("new")})
+			So(err, ShouldNotBeNil)
+			So(prep.rollbacks, ShouldEqual, 1)
+			So(prep.notes("one"), ShouldEqual, "")
+		})
+
+		Convey("the others are restored when commit fails", func() {
+			prep.failCommit = true
+
+			err := hl.WriteObjectsContext(context.Background(), Config{NewSpace("one").SetNotes("new")})
+			So(err, ShouldResemble, HandlerError{Match: "*", Err: fmt.Errorf("commit failed")})
+			So(plain.notes("one"), ShouldEqual, "old")
+		})
+	})
+}
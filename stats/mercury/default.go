@@ -33,7 +33,7 @@ func (config) GetIndex(search mercury.NamespaceSearch, _ *rsql.Program) (lis mer
 	return
 }
 
-func (config) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ []string) (lis mercury.Config) {
+func (config) GetObjects(search mercury.NamespaceSearch, pgm *rsql.Program, fields []string) (lis mercury.Config) {
 	registry := stats.GetRegistry()
 
 	for k, fn := range registry {
@@ -47,7 +47,7 @@ func (config) GetObjects(search mercury.NamespaceSearch, _ *rsql.Program, _ []st
 		}
 	}
 
-	return
+	return lis.Filter(pgm, fields)
 }
 
 // Rules returns nil
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"sour.is/x/toolbox/dbm"
+	"sour.is/x/toolbox/stats"
+	"sour.is/x/toolbox/stats/exposition"
+)
+
+func init() {
+	stats.Register("db.pools", getPoolStats)
+}
+
+type poolStats []dbm.PoolStats
+
+func getPoolStats() exposition.Expositioner {
+	return poolStats(dbm.Stats())
+}
+
+func (lis poolStats) Exposition() (out exposition.Expositions) {
+	healthy := exposition.New("db_pool_healthy", exposition.Gauge)
+	reads := exposition.New("db_pool_reads", exposition.Counter)
+	open := exposition.New("db_pool_conns_open", exposition.Gauge)
+	inUse := exposition.New("db_pool_conns_in_use", exposition.Gauge)
+	idle := exposition.New("db_pool_conns_idle", exposition.Gauge)
+	waits := exposition.New("db_pool_waits", exposition.Counter)
+
+	for _, s := range lis {
+		var h float64
+		if s.Healthy {
+			h = 1
+		}
+
+		tag := func(row *exposition.Row) {
+			row.AddTag("name", s.Name).AddTag("role", s.Role).AddTag("connect", s.Connect)
+		}
+		tag(healthy.AddRow(h))
+		tag(reads.AddRow(float64(s.Reads)))
+		tag(open.AddRow(float64(s.OpenConnections)))
+		tag(inUse.AddRow(float64(s.InUse)))
+		tag(idle.AddRow(float64(s.Idle)))
+		tag(waits.AddRow(float64(s.WaitCount)))
+	}
+
+	return exposition.Expositions{healthy, reads, open, inUse, idle, waits}
+}
+
+func (lis poolStats) String() string {
+	return lis.Exposition().String()
+}
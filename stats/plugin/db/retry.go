@@ -0,0 +1,33 @@
+package db
+
+import (
+	"sour.is/x/toolbox/dbm"
+	"sour.is/x/toolbox/stats"
+	"sour.is/x/toolbox/stats/exposition"
+)
+
+func init() {
+	stats.Register("db.retry", getRetryStats)
+}
+
+type retryStats []dbm.RetryStats
+
+func getRetryStats() exposition.Expositioner {
+	return retryStats(dbm.GetRetryStats())
+}
+
+func (lis retryStats) Exposition() (out exposition.Expositions) {
+	retries := exposition.New("db_tx_retries", exposition.Counter)
+	exhausted := exposition.New("db_tx_retries_exhausted", exposition.Counter)
+
+	for _, s := range lis {
+		retries.AddRow(float64(s.Retries)).AddTag("name", s.Name)
+		exhausted.AddRow(float64(s.Exhausted)).AddTag("name", s.Name)
+	}
+
+	return exposition.Expositions{retries, exhausted}
+}
+
+func (lis retryStats) String() string {
+	return lis.Exposition().String()
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"sour.is/x/toolbox/dbm"
+	"sour.is/x/toolbox/stats"
+	"sour.is/x/toolbox/stats/exposition"
+)
+
+func init() {
+	stats.Register("db.tx", getTxStats)
+}
+
+type txStats struct {
+	Open    []dbm.TxInfo `json:"open"`
+	Expired uint64       `json:"expired"`
+}
+
+func getTxStats() exposition.Expositioner {
+	return txStats{Open: dbm.OpenTx(), Expired: dbm.ExpiredTx()}
+}
+
+func (s txStats) Exposition() (out exposition.Expositions) {
+	open := exposition.New("db_tx_open", exposition.Gauge)
+	oldest := exposition.New("db_tx_oldest_seconds", exposition.Gauge)
+	expired := exposition.New("db_tx_expired", exposition.Counter)
+
+	count := make(map[string]int)
+	age := make(map[string]float64)
+	for _, t := range s.Open {
+		count[t.Name]++
+		if a := t.Age.Seconds(); a > age[t.Name] {
+			age[t.Name] = a
+		}
+	}
+	for name, n := range count {
+		open.AddRow(float64(n)).AddTag("name", name)
+		oldest.AddRow(age[name]).AddTag("name", name)
+	}
+	expired.AddRow(float64(s.Expired))
+
+	return exposition.Expositions{open, oldest, expired}
+}
+
+func (s txStats) String() string {
+	return s.Exposition().String()
+}
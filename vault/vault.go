@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/spf13/viper"
 	"sour.is/x/toolbox/log"
@@ -184,13 +186,29 @@ func LoadVault() error {
 	}
 
 	log.NilDebugf("%#v", data.Data)
+	loaded.Lock()
 	for key, value := range data.Data {
 		viper.Set(key, value)
+		loaded.keys = append(loaded.keys, strings.ToLower(key))
 	}
+	loaded.Unlock()
 
 	return nil
 }
 
+var loaded struct {
+	sync.Mutex
+	keys []string
+}
+
+// Keys returns the viper keys that were loaded from vault.
+func Keys() []string {
+	loaded.Lock()
+	defer loaded.Unlock()
+
+	return append([]string(nil), loaded.keys...)
+}
+
 func certAuth(pki pki) error {
 	if pki.Cert == "" || pki.Key == "" {
 		log.Fatal("Certificate not defined for pki authentication")